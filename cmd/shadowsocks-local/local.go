@@ -29,8 +29,9 @@ var (
 )
 
 const (
-	socksVer5       = 5
-	socksCmdConnect = 1
+	socksVer5            = 5
+	socksCmdConnect      = 1
+	socksCmdUDPAssociate = 3
 )
 
 func init() {
@@ -74,7 +75,7 @@ func handShake(conn net.Conn) (err error) {
 	return
 }
 
-func getRequest(conn net.Conn) (rawaddr []byte, host string, err error) {
+func getRequest(conn net.Conn) (rawaddr []byte, host string, cmd byte, err error) {
 	const (
 		idVer   = 0
 		idCmd   = 1
@@ -104,7 +105,8 @@ func getRequest(conn net.Conn) (rawaddr []byte, host string, err error) {
 		err = errVer
 		return
 	}
-	if buf[idCmd] != socksCmdConnect {
+	cmd = buf[idCmd]
+	if cmd != socksCmdConnect && cmd != socksCmdUDPAssociate {
 		err = errCmd
 		return
 	}
@@ -342,11 +344,15 @@ func handleConnection(conn net.Conn, userID int) {
 		log.Println("socks handshake:", err)
 		return
 	}
-	rawaddr, addr, err := getRequest(conn)
+	rawaddr, addr, cmd, err := getRequest(conn)
 	if err != nil {
 		log.Println("error getting request:", err)
 		return
 	}
+	if cmd == socksCmdUDPAssociate {
+		handleUDPAssociate(conn, userID)
+		return
+	}
 	// Sending connection established message immediately to client.
 	// This some round trip time for creating socks connection with the client.
 	// But if connection failed, the client will get connection reset error.
@@ -403,14 +409,20 @@ func runNameServer(listenAddr string, userID int) {
 		log.Fatal(err)
 	}
 	log.Printf("Starting local Name Server at %s\n", uaddr)
+	buf := ss.GetUDPBuffer(ss.UDPBufSize)
 	for {
-		buf := ss.LeakyBuffer.Get()
 		n, src, err := conn.ReadFromUDP(buf)
 		if err != nil {
 			log.Printf("Read packet from UDP error: %v\n", err)
 			continue
 		}
-		go handleUDPPacket(conn, n, src, buf, userID)
+		if ss.UDPTooLarge(n) {
+			debug.Printf("oversized packet from %v dropped\n", src)
+			continue
+		}
+		data := ss.GetUDPBuffer(n)
+		copy(data, buf)
+		go handleUDPPacket(conn, n, src, data, userID)
 	}
 }
 
@@ -482,6 +494,10 @@ func main() {
 	if config.EnableDNSProxy {
 		TargetNameServer = config.TargetDNSServer
 		dnsProxyPort := config.DNSProxyPort
+		if err := initUDPOverTCP(config.UDPOverTCP, config.UserID); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
 		go runNameServer(fmt.Sprintf("%s:%d", cmdLocal, dnsProxyPort), config.UserID)
 	}
 	runTCP(cmdLocal+":"+strconv.Itoa(config.LocalPort), config.UserID)
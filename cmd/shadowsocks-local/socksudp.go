@@ -0,0 +1,156 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	ss "github.com/shadowsocks/shadowsocks-go/shadowsocks"
+)
+
+// udpAssociation relays the datagrams of a SOCKS5 UDP ASSOCIATE request
+// through a server, for as long as the TCP connection of the request lasts.
+// Fragmented datagrams are reassembled before they are sent, replies are
+// never fragmented.
+type udpAssociation struct {
+	relay    *net.UDPConn
+	clientIP net.IP // packets from other hosts are dropped
+	userID   int
+	frags    ss.FragReassembler // used by serve only
+
+	lock   sync.Mutex
+	client *net.UDPAddr // where the last packet came from
+	remote *ss.UDPConn  // opened by the first packet
+	closed bool
+}
+
+func handleUDPAssociate(conn net.Conn, userID int) {
+	laddr := conn.LocalAddr().(*net.TCPAddr)
+	relay, err := net.ListenUDP("udp", &net.UDPAddr{IP: laddr.IP})
+	if err != nil {
+		log.Println("error listening for udp associate:", err)
+		// general failure
+		conn.Write([]byte{socksVer5, 0x01, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00})
+		return
+	}
+	header, _ := ss.ParseHeader(relay.LocalAddr())
+	reply := append([]byte{socksVer5, 0x00, 0x00}, header...)
+	if _, err = conn.Write(reply); err != nil {
+		debug.Println("send udp associate reply:", err)
+		relay.Close()
+		return
+	}
+	a := &udpAssociation{
+		relay:    relay,
+		clientIP: conn.RemoteAddr().(*net.TCPAddr).IP,
+		userID:   userID,
+	}
+	go a.serve()
+	// The association ends with the TCP connection.
+	conn.SetReadDeadline(time.Time{})
+	io.Copy(ioutil.Discard, conn)
+	a.close()
+	// Without a metrics endpoint the counters of all associations go to the
+	// debug log.
+	frags := ss.GetFragStats()
+	debug.Printf("udp associate of %v closed, fragmented datagrams reassembled %d expired %d dropped %d\n",
+		conn.RemoteAddr(), frags.Reassembled, frags.Expired, frags.Dropped)
+}
+
+func (a *udpAssociation) serve() {
+	buf := ss.GetUDPBuffer(ss.UDPBufSize)
+	defer ss.PutUDPBuffer(buf)
+	for {
+		n, src, err := a.relay.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		if !src.IP.Equal(a.clientIP) {
+			debug.Printf("udp packet from %v is not of the association\n", src)
+			continue
+		}
+		if ss.UDPTooLarge(n) {
+			debug.Printf("oversized packet from %v dropped\n", src)
+			continue
+		}
+		frag, header, data, err := ss.ParseSOCKSUDP(buf[:n])
+		if err != nil {
+			debug.Printf("bad udp request from %v: %v\n", src, err)
+			continue
+		}
+		if header, data = a.frags.Add(frag, header, data, time.Now()); header == nil {
+			continue
+		}
+		if err = a.send(src, header, data); err != nil {
+			log.Println("Got error when send data:[UDP]", err)
+		}
+	}
+}
+
+// send sends a datagram of the client at src to the server.
+func (a *udpAssociation) send(src *net.UDPAddr, header, data []byte) error {
+	a.lock.Lock()
+	a.client = src
+	remote := a.remote
+	if remote == nil && !a.closed {
+		var err error
+		if remote, err = chooseRemoteServer(); err != nil {
+			a.lock.Unlock()
+			return err
+		}
+		a.remote = remote
+		go a.readReplies(remote)
+	}
+	a.lock.Unlock()
+	if remote == nil {
+		return nil
+	}
+	packet := make([]byte, 0, len(header)+len(data))
+	packet = append(append(packet, header...), data...)
+	if remote.IsOta() {
+		packet[0] |= ss.OneTimeAuthMask
+	}
+	_, err := remote.WriteWithUserID(packet, ss.UserID2Byte(a.userID))
+	return err
+}
+
+func (a *udpAssociation) readReplies(remote *ss.UDPConn) {
+	defer remote.Close()
+	buf := ss.GetUDPBuffer(ss.UDPBufSize)
+	defer ss.PutUDPBuffer(buf)
+	for {
+		n, err := remote.Read(buf)
+		if err != nil {
+			if _, ok := err.(net.Error); ok {
+				return
+			}
+			debug.Println("bad udp reply:", err)
+			continue
+		}
+		if n == 0 || ss.UDPTooLarge(3+n) {
+			continue
+		}
+		a.lock.Lock()
+		client := a.client
+		a.lock.Unlock()
+		// RSV and FRAG 0, then the address and payload from the server.
+		reply := make([]byte, 3+n)
+		copy(reply[3:], buf[:n])
+		reply[3] &= ss.AddrMask
+		a.relay.WriteToUDP(reply, client)
+	}
+}
+
+func (a *udpAssociation) close() {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.closed = true
+	a.relay.Close()
+	if a.remote != nil {
+		// readReplies closes the rest once its read fails.
+		a.remote.UDPConn.Close()
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"log"
 	"math/rand"
 	"net"
+	"time"
 
 	ss "github.com/shadowsocks/shadowsocks-go/shadowsocks"
 )
@@ -16,6 +17,33 @@ const (
 
 var TargetNameServer = ""
 
+// how long to wait for the reply of a UDP packet before trying UDP over TCP
+const udpReplyTimeout = 5 * time.Second
+
+var (
+	uotSwitch ss.UoTSwitch
+	uotClient *ss.UoTClient
+)
+
+func initUDPOverTCP(mode string, userID int) error {
+	var err error
+	if uotSwitch.Mode, err = ss.ParseUoTMode(mode); err != nil {
+		return err
+	}
+	uotClient = ss.NewUoTClient(func() (*ss.Conn, error) {
+		remote, err := createServerConnWithUserID(ss.UoTRawAddr(), ss.UoTHost, userID)
+		if err != nil {
+			return nil, err
+		}
+		if remote.IsOta() {
+			remote.Close()
+			return nil, errors.New("udp over tcp does not support one time auth")
+		}
+		return remote, nil
+	}, 0)
+	return nil
+}
+
 func dialUDPConnection(serverId int) (*ss.UDPConn, error) {
 	srv := servers.srvCipher[serverId]
 	srvAddr, err := net.ResolveUDPAddr("udp", srv.server)
@@ -99,7 +127,23 @@ func ParseSSUDPResponse(buf []byte, n int) []byte {
 	return buf[dataPos:n]
 }
 
+func sendUDPOverTCP(conn *net.UDPConn, src *net.UDPAddr, buf []byte, n int) {
+	data, _, err := GenerateSSUDPData(buf, n, false)
+	if err != nil {
+		log.Println("Got error when generate data:[UDP]", err)
+		return
+	}
+	if err := uotClient.Send(conn, src, data, nil); err != nil {
+		log.Println("Got error when send data:[UDP over TCP]", err)
+	}
+}
+
 func handleUDPPacket(conn *net.UDPConn, n int, src *net.UDPAddr, buf []byte, userID int) {
+	defer ss.PutUDPBuffer(buf)
+	if uotSwitch.UseTCP() {
+		sendUDPOverTCP(conn, src, buf, n)
+		return
+	}
 	remote, err := chooseRemoteServer()
 	if err != nil {
 		log.Println("Got error when choose shadowsocks server:[UDP]", err)
@@ -112,9 +156,16 @@ func handleUDPPacket(conn *net.UDPConn, n int, src *net.UDPAddr, buf []byte, use
 		return
 	}
 	remote.WriteWithUserID(data, ss.UserID2Byte(userID))
-	retBuf := make([]byte, 4096)
+	retBuf := ss.GetUDPBuffer(ss.UDPBufSize)
+	defer ss.PutUDPBuffer(retBuf)
+	remote.SetReadDeadline(time.Now().Add(udpReplyTimeout))
 	rn, err := remote.Read(retBuf)
 	if err != nil {
+		if ne, ok := err.(net.Error); ok && ne.Timeout() && uotSwitch.UDPFailed() {
+			log.Println("no reply over UDP, switching to UDP over TCP")
+			sendUDPOverTCP(conn, src, buf, n)
+			return
+		}
 		log.Println("Got error when receive data:[UDP]", err)
 		return
 	}
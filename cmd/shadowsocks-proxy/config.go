@@ -18,7 +18,8 @@ import (
 //    "timeout": 600,
 //    "proxies": [
 //        ["127.0.0.1:5353", "114.114.114.114:53", "tcpudp"]
-//    ]
+//    ],
+//    "udp_over_tcp": "auto"
 // }
 type ProxyConfig struct {
 	ServerPassword [][]string `json:"server_password"`
@@ -27,6 +28,8 @@ type ProxyConfig struct {
 	Proxies        [][]string `json:"proxies"`
 	Timeout        int        `json:"timeout"`
 	Auth           bool       `json:"auth"`
+	UDPOverTCP     string     `json:"udp_over_tcp"` // auto, never or always
+	UDPMaxSize     int        `json:"udp_max_size"` // largest datagram, 0 means 65507
 }
 
 func ParseProxyConfig(path string) (config *ProxyConfig, err error) {
@@ -47,5 +50,6 @@ func ParseProxyConfig(path string) (config *ProxyConfig, err error) {
 	}
 	timeout := time.Duration(config.Timeout) * time.Second
 	ss.SetTimeout(timeout)
+	ss.SetMaxUDPSize(config.UDPMaxSize)
 	return
 }
@@ -167,6 +167,10 @@ func main() {
 	}
 
 	parseServerConfig(config)
+	if uotSwitch.Mode, err = ss.ParseUoTMode(config.UDPOverTCP); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
 	proxies := parseProxies(config)
 	for _, proxyInfo := range proxies {
 		listenAddr := proxyInfo.LocalAddr
@@ -33,7 +33,7 @@ func handleTCPConnection(conn net.Conn, userID int, remoteAddr string) {
 			conn.Close()
 		}
 	}()
-	remote, err := createServerConnWithUserID(remoteAddr, userID)
+	remote, err := createServerConnWithUserID(generateRawAddress(remoteAddr), userID)
 	if err != nil {
 		if len(servers.srvCipher) > 1 {
 			log.Println("Failed connect to all avaiable shadowsocks server")
@@ -54,7 +54,7 @@ func handleTCPConnection(conn net.Conn, userID int, remoteAddr string) {
 	}
 }
 
-func createServerConnWithUserID(remoteAddr string, userID int) (remote *ss.Conn, err error) {
+func createServerConnWithUserID(rawaddr []byte, userID int) (remote *ss.Conn, err error) {
 	const baseFailCnt = 20
 	n := len(servers.srvCipher)
 	skipped := make([]int, 0)
@@ -64,14 +64,14 @@ func createServerConnWithUserID(remoteAddr string, userID int) (remote *ss.Conn,
 			skipped = append(skipped, i)
 			continue
 		}
-		remote, err = connectToServerWithUserID(i, remoteAddr, userID)
+		remote, err = connectToServerWithUserID(i, rawaddr, userID)
 		if err == nil {
 			return
 		}
 	}
 	// last resort, try skipped servers, not likely to succeed
 	for _, i := range skipped {
-		remote, err = connectToServerWithUserID(i, remoteAddr, userID)
+		remote, err = connectToServerWithUserID(i, rawaddr, userID)
 		if err == nil {
 			return
 		}
@@ -101,8 +101,7 @@ func generateRawAddress(addr string) []byte {
 	return buf
 }
 
-func connectToServerWithUserID(serverId int, addr string, userID int) (remote *ss.Conn, err error) {
-	rawaddr := generateRawAddress(addr)
+func connectToServerWithUserID(serverId int, rawaddr []byte, userID int) (remote *ss.Conn, err error) {
 	se := servers.srvCipher[serverId]
 	remote, err = ss.DialWithRawAddrAndUserID(rawaddr, se.server, se.cipher.Copy(), ss.UserID2Byte(userID))
 	if err != nil {
@@ -6,6 +6,7 @@ import (
 	"math/rand"
 	"net"
 	"os"
+	"time"
 
 	ss "github.com/shadowsocks/shadowsocks-go/shadowsocks"
 )
@@ -15,6 +16,25 @@ const (
 	typeIPv6 = 4 // type is ipv6 address
 )
 
+// how long to wait for the reply of a UDP packet before trying UDP over TCP
+const udpReplyTimeout = 5 * time.Second
+
+var uotSwitch ss.UoTSwitch
+
+func newUoTClient(userID int) *ss.UoTClient {
+	return ss.NewUoTClient(func() (*ss.Conn, error) {
+		remote, err := createServerConnWithUserID(ss.UoTRawAddr(), userID)
+		if err != nil {
+			return nil, err
+		}
+		if remote.IsOta() {
+			remote.Close()
+			return nil, errors.New("udp over tcp does not support one time auth")
+		}
+		return remote, nil
+	}, 0)
+}
+
 func runUDPProxy(listenAddr string, remoteAddr string, userID int) {
 	uaddr, err := net.ResolveUDPAddr("udp", listenAddr)
 	if err != nil {
@@ -25,17 +45,24 @@ func runUDPProxy(listenAddr string, remoteAddr string, userID int) {
 	if err != nil {
 		log.Fatal(err)
 	}
+	uot := newUoTClient(userID)
+	buf := ss.GetUDPBuffer(ss.UDPBufSize)
 	for {
-		buf := ss.LeakyBuffer.Get()
 		n, src, err := conn.ReadFromUDP(buf)
 		if err != nil {
 			log.Printf("Read packet from UDP error: %v\n", err)
 			continue
 		}
+		if ss.UDPTooLarge(n) {
+			debug.Printf("oversized packet from %v dropped\n", src)
+			continue
+		}
 		if debug {
 			debug.Printf("UDP connection from %v\n", src)
 		}
-		go handleUDPPacket(conn, n, src, buf, userID, remoteAddr)
+		data := ss.GetUDPBuffer(n)
+		copy(data, buf)
+		go handleUDPPacket(conn, n, src, data, userID, remoteAddr, uot)
 	}
 }
 
@@ -121,7 +148,23 @@ func ParseSSUDPResponse(buf []byte, n int) []byte {
 	return buf[dataPos:n]
 }
 
-func handleUDPPacket(conn *net.UDPConn, n int, src *net.UDPAddr, buf []byte, userID int, remoteAddr string) {
+func sendUDPOverTCP(uot *ss.UoTClient, conn *net.UDPConn, src *net.UDPAddr, buf []byte, n int, remoteAddr string) {
+	data, _, err := GenerateSSUDPData(buf, n, false, remoteAddr)
+	if err != nil {
+		log.Println("Got error when generate data:[UDP]", err)
+		return
+	}
+	if err := uot.Send(conn, src, data, nil); err != nil {
+		log.Println("Got error when send data:[UDP over TCP]", err)
+	}
+}
+
+func handleUDPPacket(conn *net.UDPConn, n int, src *net.UDPAddr, buf []byte, userID int, remoteAddr string, uot *ss.UoTClient) {
+	defer ss.PutUDPBuffer(buf)
+	if uotSwitch.UseTCP() {
+		sendUDPOverTCP(uot, conn, src, buf, n, remoteAddr)
+		return
+	}
 	remote, err := chooseRemoteServer()
 	if err != nil {
 		log.Println("Got error when choose shadowsocks server:[UDP]", err)
@@ -134,9 +177,16 @@ func handleUDPPacket(conn *net.UDPConn, n int, src *net.UDPAddr, buf []byte, use
 		return
 	}
 	remote.WriteWithUserID(data, ss.UserID2Byte(userID))
-	retBuf := make([]byte, 4096)
+	retBuf := ss.GetUDPBuffer(ss.UDPBufSize)
+	defer ss.PutUDPBuffer(retBuf)
+	remote.SetReadDeadline(time.Now().Add(udpReplyTimeout))
 	rn, err := remote.Read(retBuf)
 	if err != nil {
+		if ne, ok := err.(net.Error); ok && ne.Timeout() && uotSwitch.UDPFailed() {
+			log.Println("no reply over UDP, switching to UDP over TCP")
+			sendUDPOverTCP(uot, conn, src, buf, n, remoteAddr)
+			return
+		}
 		log.Println("Got error when receive data:[UDP]", err)
 		return
 	}
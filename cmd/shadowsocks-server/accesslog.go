@@ -0,0 +1,264 @@
+package main
+
+// Access log, one JSON record per TCP session and UDP flow, written to a
+// rotating file or syslog.
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	ss "github.com/shadowsocks/shadowsocks-go/shadowsocks"
+)
+
+const (
+	defaultAccessLogMaxSize    = 100 // in MB
+	defaultAccessLogMaxBackups = 5
+)
+
+// Close reasons
+const (
+	closeClient    = "client_closed"
+	closeRemote    = "remote_closed"
+	closeIdle      = "idle_timeout"
+	closeError     = "error"
+	closeDialError = "dial_error"
+	closeBlocked   = "blocked"
+	closeKicked    = "kicked"
+	closeOverQuota = "over_quota"
+	closeEvicted   = "evicted"
+	closeShutdown  = "shutdown"
+)
+
+// AccessRecord is a line of the access log.
+type AccessRecord struct {
+	Time     time.Time `json:"time"` // when the session ended
+	Proto    string    `json:"proto"`
+	UserID   int       `json:"user_id"`
+	ClientIP string    `json:"client_ip"`
+	Target   string    `json:"target"`
+	BytesIn  uint64    `json:"bytes_in"`
+	BytesOut uint64    `json:"bytes_out"`
+	Duration float64   `json:"duration"` // in seconds
+	Reason   string    `json:"reason"`
+}
+
+type accessLogSink interface {
+	WriteRecord(line []byte) error
+}
+
+type accessLogger struct {
+	sink       accessLogSink
+	sampleRate float64
+	hashSalt   []byte // targets are hashed when not nil
+
+	lock sync.Mutex
+	rand *rand.Rand
+}
+
+// accessLog is nil when the access log is disabled.
+var accessLog *accessLogger
+
+func initAccessLog() error {
+	if config.AccessLog == "" {
+		return nil
+	}
+	var sink accessLogSink
+	var err error
+	if config.AccessLog == "syslog" {
+		sink, err = newSyslogSink()
+	} else {
+		maxSize := config.AccessLogMaxSize
+		if maxSize <= 0 {
+			maxSize = defaultAccessLogMaxSize
+		}
+		maxBackups := config.AccessLogMaxBackups
+		if maxBackups <= 0 {
+			maxBackups = defaultAccessLogMaxBackups
+		}
+		sink, err = newRotatingFile(config.AccessLog, int64(maxSize)<<20, maxBackups)
+	}
+	if err != nil {
+		return fmt.Errorf("access log: %v", err)
+	}
+	sampleRate := config.AccessLogSampleRate
+	if sampleRate <= 0 || sampleRate > 1 {
+		sampleRate = 1
+	}
+	accessLog = &accessLogger{
+		sink:       sink,
+		sampleRate: sampleRate,
+		rand:       rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+	if config.AccessLogHashTargets {
+		if config.AccessLogHashSalt == "" {
+			serverLog.Warn("access_log_hash_salt is empty, hashed targets are easy to guess")
+		}
+		accessLog.hashSalt = []byte(config.AccessLogHashSalt)
+	}
+	return nil
+}
+
+// hashHost replaces the host of target with a keyed hash, the port is kept.
+func (l *accessLogger) hashHost(target string) string {
+	host, port, err := net.SplitHostPort(target)
+	if err != nil {
+		host, port = target, ""
+	}
+	mac := hmac.New(sha256.New, l.hashSalt)
+	mac.Write([]byte(strings.ToLower(host)))
+	hashed := hex.EncodeToString(mac.Sum(nil)[:16])
+	if port == "" {
+		return hashed
+	}
+	return net.JoinHostPort(hashed, port)
+}
+
+func (l *accessLogger) sampled() bool {
+	if l.sampleRate >= 1 {
+		return true
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.rand.Float64() < l.sampleRate
+}
+
+// Log writes the record of a finished relay. Relays that never got a target
+// are left out, they are counted as handshake failures.
+func (l *accessLogger) Log(e *connEntry) {
+	if l == nil || e.target == "" || !l.sampled() {
+		return
+	}
+	now := time.Now()
+	record := AccessRecord{
+		Time:     now,
+		Proto:    e.Proto,
+		UserID:   e.UserID,
+		ClientIP: e.ClientAddr,
+		Target:   e.target,
+		BytesIn:  e.counter.BytesIn(),
+		BytesOut: e.counter.BytesOut(),
+		Duration: now.Sub(e.Start).Seconds(),
+		Reason:   e.reason,
+	}
+	if host, _, err := net.SplitHostPort(e.ClientAddr); err == nil {
+		record.ClientIP = host
+	}
+	if l.hashSalt != nil {
+		record.Target = l.hashHost(record.Target)
+	}
+	line, err := json.Marshal(record)
+	if err != nil {
+		serverLog.Error("cannot encode access log record", "err", err)
+		return
+	}
+	if err = l.sink.WriteRecord(line); err != nil {
+		serverLog.Error("cannot write access log", "err", err)
+	}
+}
+
+// closeReason tells why a relay ended from the error that ended it.
+func closeReason(err error) string {
+	switch err {
+	case nil:
+		return closeClient
+	case ss.ErrNATEvicted:
+		return closeEvicted
+	case ss.ErrNATClosed:
+		return closeShutdown
+	}
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		return closeIdle
+	}
+	return closeError
+}
+
+// relayCloseReason tells why a TCP relay ended from the errors of its two
+// pipes. The side that reached EOF closed the relay, the other pipe then
+// fails on the closed connection.
+func relayCloseReason(clientErr, remoteErr error) string {
+	switch {
+	case clientErr == nil:
+		return closeClient
+	case remoteErr == nil:
+		return closeRemote
+	}
+	if reason := closeReason(clientErr); reason == closeIdle {
+		return reason
+	}
+	return closeReason(remoteErr)
+}
+
+// rotatingFile is a JSON lines file that is rotated to name.1, name.2 and so
+// on when it grows past maxSize.
+type rotatingFile struct {
+	lock       sync.Mutex
+	name       string
+	maxSize    int64
+	maxBackups int
+	file       *os.File
+	size       int64
+}
+
+func newRotatingFile(name string, maxSize int64, maxBackups int) (*rotatingFile, error) {
+	f := &rotatingFile{name: name, maxSize: maxSize, maxBackups: maxBackups}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *rotatingFile) open() error {
+	file, err := os.OpenFile(f.name, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.file = file
+	f.size = info.Size()
+	return nil
+}
+
+func (f *rotatingFile) rotate() error {
+	if err := f.file.Close(); err != nil {
+		return err
+	}
+	for i := f.maxBackups - 1; i > 0; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", f.name, i), fmt.Sprintf("%s.%d", f.name, i+1))
+	}
+	if err := os.Rename(f.name, f.name+".1"); err != nil {
+		return err
+	}
+	return f.open()
+}
+
+func (f *rotatingFile) WriteRecord(line []byte) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.file == nil {
+		// A failed rotation left no file open, try again.
+		if err := f.open(); err != nil {
+			return err
+		}
+	}
+	if f.size > 0 && f.size+int64(len(line))+1 > f.maxSize {
+		if err := f.rotate(); err != nil {
+			f.file = nil
+			return err
+		}
+	}
+	n, err := f.file.Write(append(line, '\n'))
+	f.size += int64(n)
+	return err
+}
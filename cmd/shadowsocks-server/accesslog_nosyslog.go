@@ -0,0 +1,10 @@
+//go:build windows || plan9
+// +build windows plan9
+
+package main
+
+import "errors"
+
+func newSyslogSink() (accessLogSink, error) {
+	return nil, errors.New("syslog is not supported on this platform")
+}
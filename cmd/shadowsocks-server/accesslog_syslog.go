@@ -0,0 +1,22 @@
+//go:build !windows && !plan9
+// +build !windows,!plan9
+
+package main
+
+import "log/syslog"
+
+type syslogSink struct {
+	writer *syslog.Writer
+}
+
+func newSyslogSink() (accessLogSink, error) {
+	writer, err := syslog.New(syslog.LOG_INFO|syslog.LOG_DAEMON, "shadowsocks-access")
+	if err != nil {
+		return nil, err
+	}
+	return &syslogSink{writer}, nil
+}
+
+func (s *syslogSink) WriteRecord(line []byte) error {
+	return s.writer.Info(string(line))
+}
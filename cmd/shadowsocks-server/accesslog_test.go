@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	ss "github.com/shadowsocks/shadowsocks-go/shadowsocks"
+)
+
+// recordSink keeps the access log records written to it.
+type recordSink struct {
+	lock    sync.Mutex
+	records []AccessRecord
+}
+
+func (s *recordSink) WriteRecord(line []byte) error {
+	var record AccessRecord
+	if err := json.Unmarshal(line, &record); err != nil {
+		return err
+	}
+	s.lock.Lock()
+	s.records = append(s.records, record)
+	s.lock.Unlock()
+	return nil
+}
+
+func (s *recordSink) Records() []AccessRecord {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return append([]AccessRecord(nil), s.records...)
+}
+
+func TestUoTFlowAccessRecord(t *testing.T) {
+	echo, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		buf := make([]byte, 64)
+		for {
+			n, addr, err := echo.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			echo.WriteToUDP(buf[:n], addr)
+		}
+	}()
+
+	config = &ss.Config{AllowPrivateDestinations: true}
+	natTable = ss.NewNATTable(ss.NATAddressRestricted, time.Minute, 0)
+	limiter = &ConnLimiter{users: make(map[int]*userUsage), udpTimeout: time.Minute}
+	sink := &recordSink{}
+	accessLog = &accessLogger{sink: sink, sampleRate: 1}
+	defer func() {
+		natTable.Close()
+		natTable, limiter, accessLog = nil, nil, nil
+	}()
+
+	client, server := net.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		done <- uotRelay(&SSUser{UserID: 1}, nil, server.RemoteAddr()).ServeUDPOverTCP(server)
+	}()
+	header, _ := ss.ParseHeader(echo.LocalAddr())
+	if err := ss.WriteUoTFrame(client, header, []byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := bufio.NewReader(client).Peek(2); err != nil {
+		t.Fatal(err)
+	}
+	if infos := conns.List(1); len(infos) != 1 || infos[0].Proto != "udp" || infos[0].Target != echo.LocalAddr().String() {
+		t.Errorf("got %+v, want the flow in the registry", infos)
+	}
+	client.Close()
+	<-done
+
+	deadline := time.Now().Add(5 * time.Second)
+	for len(sink.Records()) == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	records := sink.Records()
+	if len(records) != 1 {
+		t.Fatalf("got %d records, want the one of the flow", len(records))
+	}
+	if r := records[0]; r.Proto != "udp" || r.UserID != 1 || r.Target != echo.LocalAddr().String() || r.BytesIn != 4 || r.BytesOut != 4 {
+		t.Errorf("got %+v", r)
+	}
+}
+
+func TestRotatingFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "accesslog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	name := filepath.Join(dir, "access.log")
+	// Two records of 40 bytes and their newlines fit in a file.
+	f, err := newRotatingFile(name, 100, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= 7; i++ {
+		line := fmt.Sprintf("%-40d", i)
+		if err := f.WriteRecord([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	f.file.Close()
+
+	records := func(name string) []string {
+		data, err := ioutil.ReadFile(name)
+		if err != nil {
+			t.Errorf("%s: %v", filepath.Base(name), err)
+			return nil
+		}
+		return strings.Fields(string(data))
+	}
+	for suffix, want := range map[string]string{"": "7", ".1": "5 6", ".2": "3 4"} {
+		if got := strings.Join(records(name+suffix), " "); got != want {
+			t.Errorf("access.log%s has records %q, want %q", suffix, got, want)
+		}
+	}
+	if _, err := os.Stat(name + ".3"); !os.IsNotExist(err) {
+		t.Error("only max backups should be kept")
+	}
+}
+
+func TestAccessLogSampled(t *testing.T) {
+	l := &accessLogger{sampleRate: 1}
+	for i := 0; i < 100; i++ {
+		if !l.sampled() {
+			t.Fatal("all records should be written at sample rate 1")
+		}
+	}
+	l = &accessLogger{sampleRate: 0.25, rand: rand.New(rand.NewSource(1))}
+	n := 0
+	for i := 0; i < 10000; i++ {
+		if l.sampled() {
+			n++
+		}
+	}
+	if n < 2000 || n > 3000 {
+		t.Errorf("%d of 10000 records written at sample rate 0.25", n)
+	}
+}
+
+// fixedCounter is the traffic of a finished relay.
+type fixedCounter struct{ in, out uint64 }
+
+func (c fixedCounter) BytesIn() uint64  { return c.in }
+func (c fixedCounter) BytesOut() uint64 { return c.out }
+
+func TestAccessLogHashTargets(t *testing.T) {
+	l := &accessLogger{hashSalt: []byte("salt")}
+	tests := []struct {
+		target, host, port string
+	}{
+		{"www.example.com:443", "www.example.com", "443"},
+		{"192.0.2.1:53", "192.0.2.1", "53"},
+		{"[2001:db8::1]:53", "2001:db8::1", "53"},
+	}
+	for _, test := range tests {
+		hashed := l.hashHost(test.target)
+		host, port, err := net.SplitHostPort(hashed)
+		if err != nil || port != test.port {
+			t.Errorf("%s: got %s, want port %s kept", test.target, hashed, test.port)
+		}
+		if strings.Contains(hashed, test.host) || host == test.host {
+			t.Errorf("%s: got %s with the host in it", test.target, hashed)
+		}
+	}
+	if l.hashHost("WWW.Example.com:443") != l.hashHost("www.example.com:443") {
+		t.Error("the hash should not depend on the case of the domain")
+	}
+	other := &accessLogger{hashSalt: []byte("other")}
+	if other.hashHost("www.example.com:443") == l.hashHost("www.example.com:443") {
+		t.Error("the hash should depend on the salt")
+	}
+
+	sink := &recordSink{}
+	l = &accessLogger{sink: sink, sampleRate: 1, hashSalt: []byte("salt")}
+	l.Log(&connEntry{Proto: "tcp", UserID: 1, ClientAddr: "198.51.100.1:5000", Start: time.Now(),
+		target: "secret.example.com:8443", counter: fixedCounter{1, 2}, reason: closeClient})
+	records := sink.Records()
+	if len(records) != 1 {
+		t.Fatalf("got %d records", len(records))
+	}
+	r := records[0]
+	if strings.Contains(r.Target, "example") || !strings.HasSuffix(r.Target, ":8443") {
+		t.Errorf("got target %s, want the host hashed and the port kept", r.Target)
+	}
+	if r.ClientIP != "198.51.100.1" || r.BytesIn != 1 || r.BytesOut != 2 || r.Reason != closeClient {
+		t.Errorf("got %+v", r)
+	}
+}
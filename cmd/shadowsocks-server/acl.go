@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	ss "github.com/shadowsocks/shadowsocks-go/shadowsocks"
+)
+
+// aclPolicy is an ss.ACLPolicy ready for matching.
+type aclPolicy struct {
+	name string
+	// allow holds the allowed destinations as rules, a matching rule means
+	// allowed. nil allows everything not denied.
+	allow        *ss.RuleSet
+	deny         *ss.RuleSet
+	tcp          bool
+	udp          bool
+	blockPrivate bool
+}
+
+var aclPolicies map[string]*aclPolicy
+
+func newRuleSet(lines []string) (*ss.RuleSet, error) {
+	s := ss.NewRuleSet()
+	for _, line := range lines {
+		r, err := ss.ParseRule(line)
+		if err != nil {
+			return nil, err
+		}
+		s.Add(r)
+	}
+	return s, nil
+}
+
+func newACLPolicy(name string, cfg ss.ACLPolicy) (*aclPolicy, error) {
+	p := &aclPolicy{name: name, blockPrivate: cfg.BlockPrivate}
+	var err error
+	if len(cfg.Allow) > 0 {
+		if p.allow, err = newRuleSet(cfg.Allow); err != nil {
+			return nil, err
+		}
+	}
+	if p.deny, err = newRuleSet(cfg.Deny); err != nil {
+		return nil, err
+	}
+	if len(cfg.Protocols) == 0 {
+		p.tcp, p.udp = true, true
+	}
+	for _, proto := range cfg.Protocols {
+		switch strings.ToLower(proto) {
+		case "tcp":
+			p.tcp = true
+		case "udp":
+			p.udp = true
+		default:
+			return nil, fmt.Errorf("unknown protocol %s", proto)
+		}
+	}
+	return p, nil
+}
+
+func initACL() error {
+	aclPolicies = make(map[string]*aclPolicy)
+	for name, cfg := range config.ACLPolicies {
+		p, err := newACLPolicy(name, cfg)
+		if err != nil {
+			return fmt.Errorf("acl policy %s: %v", name, err)
+		}
+		aclPolicies[name] = p
+	}
+	if config.DefaultACL != "" && aclPolicies[config.DefaultACL] == nil {
+		return fmt.Errorf("default_acl %s is not in acl_policies", config.DefaultACL)
+	}
+	for group, name := range config.GroupACLs {
+		if aclPolicies[name] == nil {
+			return fmt.Errorf("acl %s of group %s is not in acl_policies", name, group)
+		}
+	}
+	return nil
+}
+
+// getUserPolicy returns the policy of user, nil if there is none. The policy
+// of the user wins over the one of its group, then comes default_acl. An
+// unknown policy name is an error, the user is rejected rather than let
+// through without restrictions.
+func getUserPolicy(user *SSUser) (*aclPolicy, error) {
+	name := user.ACL
+	if name == "" {
+		name = config.GroupACLs[user.Group]
+	}
+	if name == "" {
+		name = config.DefaultACL
+	}
+	if name == "" {
+		return nil, nil
+	}
+	p, have := aclPolicies[name]
+	if !have {
+		return nil, fmt.Errorf("unknown acl policy %s", name)
+	}
+	return p, nil
+}
+
+func (p *aclPolicy) allowProto(proto string) bool {
+	if p == nil {
+		return true
+	}
+	if proto == "udp" {
+		return p.udp
+	}
+	return p.tcp
+}
+
+// check returns why the destination is not allowed by the policy, or "".
+func (p *aclPolicy) check(host string, ip net.IP, port int) string {
+	if p == nil {
+		return ""
+	}
+	if literal := net.ParseIP(host); literal != nil {
+		ip = literal
+	}
+	if p.blockPrivate && ip != nil && ss.IsPrivateIP(ip) {
+		return "private network"
+	}
+	if rule := p.deny.Match(host, ip, port); rule != nil {
+		return "rule " + rule.Text
+	}
+	if p.allow != nil && p.allow.Match(host, ip, port) == nil {
+		return "not in allow list"
+	}
+	return ""
+}
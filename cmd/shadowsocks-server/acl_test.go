@@ -0,0 +1,113 @@
+package main
+
+import (
+	"net"
+	"testing"
+
+	ss "github.com/shadowsocks/shadowsocks-go/shadowsocks"
+)
+
+func TestNewACLPolicy(t *testing.T) {
+	tests := []struct {
+		cfg      ss.ACLPolicy
+		tcp, udp bool
+		ok       bool
+	}{
+		{ss.ACLPolicy{}, true, true, true},
+		{ss.ACLPolicy{Protocols: []string{"TCP"}}, true, false, true},
+		{ss.ACLPolicy{Protocols: []string{"udp"}}, false, true, true},
+		{ss.ACLPolicy{Protocols: []string{"tcp", "udp"}}, true, true, true},
+		{ss.ACLPolicy{Protocols: []string{"sctp"}}, false, false, false},
+		{ss.ACLPolicy{Deny: []string{"port:25"}, Allow: []string{"domain:corp.example.com"}}, true, true, true},
+		{ss.ACLPolicy{Deny: []string{"bogus:25"}}, false, false, false},
+		{ss.ACLPolicy{Allow: []string{"port:x"}}, false, false, false},
+	}
+	for i, test := range tests {
+		p, err := newACLPolicy("test", test.cfg)
+		if (err == nil) != test.ok {
+			t.Errorf("%d: got error %v", i, err)
+			continue
+		}
+		if err == nil && (p.allowProto("tcp") != test.tcp || p.allowProto("udp") != test.udp) {
+			t.Errorf("%d: tcp %v udp %v, want %v and %v", i, p.tcp, p.udp, test.tcp, test.udp)
+		}
+	}
+}
+
+func TestACLPolicyCheck(t *testing.T) {
+	p, err := newACLPolicy("corp", ss.ACLPolicy{
+		Allow:        []string{"domain:corp.example.com", "10.1.0.0/16"},
+		Deny:         []string{"port:25", "domain:secret.corp.example.com"},
+		BlockPrivate: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	open, err := newACLPolicy("open", ss.ACLPolicy{Deny: []string{"port:25"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		policy *aclPolicy
+		host   string
+		ip     net.IP
+		port   int
+		want   string
+	}{
+		{p, "www.corp.example.com", nil, 443, ""},
+		// deny goes first, even for allowed destinations
+		{p, "mail.corp.example.com", nil, 25, "rule port:25"},
+		{p, "secret.corp.example.com", nil, 443, "rule domain:secret.corp.example.com"},
+		{p, "www.example.com", nil, 443, "not in allow list"},
+		{p, "10.1.2.3", nil, 443, "private network"},
+		// the resolved address counts
+		{p, "intranet.corp.example.com", net.ParseIP("192.168.1.1"), 443, "private network"},
+		{open, "www.example.com", nil, 443, ""},
+		{open, "10.1.2.3", nil, 443, ""},
+		{open, "smtp.example.com", nil, 25, "rule port:25"},
+		{nil, "smtp.example.com", nil, 25, ""},
+	}
+	for _, test := range tests {
+		if got := test.policy.check(test.host, test.ip, test.port); got != test.want {
+			t.Errorf("%s:%d %v: got %q, want %q", test.host, test.port, test.ip, got, test.want)
+		}
+	}
+}
+
+func TestGetUserPolicy(t *testing.T) {
+	config = &ss.Config{
+		ACLPolicies: map[string]ss.ACLPolicy{
+			"corp":    {Protocols: []string{"tcp"}},
+			"no_smtp": {Deny: []string{"port:25"}},
+			"public":  {BlockPrivate: true},
+		},
+		GroupACLs:  map[string]string{"vpn": "corp"},
+		DefaultACL: "no_smtp",
+	}
+	if err := initACL(); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		user *SSUser
+		want string
+	}{
+		{&SSUser{ACL: "public", Group: "vpn"}, "public"},
+		{&SSUser{Group: "vpn"}, "corp"},
+		{&SSUser{Group: "other"}, "no_smtp"},
+		{&SSUser{}, "no_smtp"},
+	}
+	for _, test := range tests {
+		p, err := getUserPolicy(test.user)
+		if err != nil || p.name != test.want {
+			t.Errorf("%+v: got %v %v, want %s", test.user, p, err, test.want)
+		}
+	}
+	if _, err := getUserPolicy(&SSUser{ACL: "unknown"}); err == nil {
+		t.Error("unknown policy should be an error")
+	}
+
+	config.GroupACLs["vpn"] = "unknown"
+	if err := initACL(); err == nil {
+		t.Error("unknown policy of a group should be an error")
+	}
+}
@@ -0,0 +1,302 @@
+package main
+
+// Admin API, a small REST API for operating a running server:
+//
+//   GET    /api/connections[?user=ID]     list active connections
+//   DELETE /api/connections/ID            kick a connection
+//   DELETE /api/users/ID/connections      kick all connections of a user
+//   PUT    /api/users/ID/bandwidth        set the bandwidth of a user, {"bandwidth": Mbps}
+//   DELETE /api/users/ID/bandwidth        go back to the bandwidth from the user store
+//   POST   /api/blacklist/reload          reload the black list file
+//   GET    /api/license                   license status
+//
+// Requests are authenticated with "Authorization: Bearer <admin_token>",
+// client certificates signed by admin_client_ca, or both.
+import (
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// bandwidthOverride is the bandwidth of a user set through the admin API, in
+// Mbps. Upload and Download are optional, 0 means Bandwidth.
+type bandwidthOverride struct {
+	Bandwidth *int `json:"bandwidth"`
+	Upload    int  `json:"upload"`
+	Download  int  `json:"download"`
+}
+
+var bandwidthOverrides = struct {
+	sync.RWMutex
+	m map[int]bandwidthOverride
+}{m: make(map[int]bandwidthOverride)}
+
+// applyBandwidthOverride replaces the bandwidth of user with the one set
+// through the admin API, if any.
+func applyBandwidthOverride(user *SSUser) {
+	bandwidthOverrides.RLock()
+	defer bandwidthOverrides.RUnlock()
+	if o, have := bandwidthOverrides.m[user.UserID]; have {
+		user.Bandwidth = *o.Bandwidth
+		user.UploadBandwidth = o.Upload
+		user.DownloadBandwidth = o.Download
+	}
+}
+
+func hasBandwidthOverride(userID int) bool {
+	bandwidthOverrides.RLock()
+	defer bandwidthOverrides.RUnlock()
+	_, have := bandwidthOverrides.m[userID]
+	return have
+}
+
+type adminServer struct {
+	token            string
+	writeBucketCache *LRU
+	readBucketCache  *LRU
+}
+
+type adminError struct {
+	Error string `json:"error"`
+}
+
+func writeJSON(writer http.ResponseWriter, status int, v interface{}) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		serverLog.Error("cannot encode admin response", "err", err)
+		status = http.StatusInternalServerError
+		data = []byte("{}")
+	}
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(status)
+	writer.Write(data)
+}
+
+func writeError(writer http.ResponseWriter, status int, err error) {
+	writeJSON(writer, status, adminError{err.Error()})
+}
+
+func (a *adminServer) authorized(request *http.Request) bool {
+	if a.token == "" {
+		// Only client certificates are used, verified by the TLS layer.
+		return true
+	}
+	auth := request.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return false
+	}
+	token := strings.TrimPrefix(auth, "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(token), []byte(a.token)) == 1
+}
+
+func (a *adminServer) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	defer request.Body.Close()
+	if !a.authorized(request) {
+		writeError(writer, http.StatusUnauthorized, errors.New("unauthorized"))
+		return
+	}
+	path := strings.Trim(strings.TrimPrefix(request.URL.Path, "/api/"), "/")
+	parts := strings.Split(path, "/")
+	switch {
+	case path == "connections" && request.Method == "GET":
+		a.listConnections(writer, request)
+	case len(parts) == 2 && parts[0] == "connections" && request.Method == "DELETE":
+		a.kickConnection(writer, parts[1])
+	case len(parts) == 3 && parts[0] == "users" && parts[2] == "connections" && request.Method == "DELETE":
+		a.kickUser(writer, parts[1])
+	case len(parts) == 3 && parts[0] == "users" && parts[2] == "bandwidth" && request.Method == "PUT":
+		a.setBandwidth(writer, request, parts[1])
+	case len(parts) == 3 && parts[0] == "users" && parts[2] == "bandwidth" && request.Method == "DELETE":
+		a.resetBandwidth(writer, parts[1])
+	case path == "blacklist/reload" && request.Method == "POST":
+		a.reloadBlackList(writer)
+	case path == "license" && request.Method == "GET":
+		a.license(writer)
+	default:
+		writeError(writer, http.StatusNotFound, fmt.Errorf("no such api: %s %s", request.Method, request.URL.Path))
+	}
+}
+
+func (a *adminServer) listConnections(writer http.ResponseWriter, request *http.Request) {
+	userID := -1
+	if user := request.URL.Query().Get("user"); user != "" {
+		var err error
+		if userID, err = strconv.Atoi(user); err != nil {
+			writeError(writer, http.StatusBadRequest, fmt.Errorf("invalid user %s", user))
+			return
+		}
+	}
+	writeJSON(writer, http.StatusOK, conns.List(userID))
+}
+
+func (a *adminServer) kickConnection(writer http.ResponseWriter, id string) {
+	connID, err := strconv.ParseUint(id, 10, 64)
+	if err != nil {
+		writeError(writer, http.StatusBadRequest, fmt.Errorf("invalid connection id %s", id))
+		return
+	}
+	if !conns.Kick(connID, closeKicked) {
+		writeError(writer, http.StatusNotFound, fmt.Errorf("no connection %d", connID))
+		return
+	}
+	serverLog.Info("admin kicked connection", "id", connID)
+	writeJSON(writer, http.StatusOK, map[string]int{"kicked": 1})
+}
+
+func (a *adminServer) kickUser(writer http.ResponseWriter, id string) {
+	userID, err := strconv.Atoi(id)
+	if err != nil {
+		writeError(writer, http.StatusBadRequest, fmt.Errorf("invalid user id %s", id))
+		return
+	}
+	n := conns.KickUser(userID, closeKicked)
+	serverLog.Info("admin kicked user", "user", userID, "connections", n)
+	writeJSON(writer, http.StatusOK, map[string]int{"kicked": n})
+}
+
+func (a *adminServer) setBandwidth(writer http.ResponseWriter, request *http.Request, id string) {
+	userID, err := strconv.Atoi(id)
+	if err != nil {
+		writeError(writer, http.StatusBadRequest, fmt.Errorf("invalid user id %s", id))
+		return
+	}
+	var body bandwidthOverride
+	data, err := ioutil.ReadAll(request.Body)
+	if err == nil {
+		err = json.Unmarshal(data, &body)
+	}
+	if err != nil || body.Bandwidth == nil {
+		writeError(writer, http.StatusBadRequest, errors.New(`body should be {"bandwidth": Mbps, "upload": Mbps, "download": Mbps}`))
+		return
+	}
+	if *body.Bandwidth < 0 || body.Upload < 0 || body.Download < 0 {
+		writeError(writer, http.StatusBadRequest, errors.New("bandwidth should not be negative, 0 means unlimited"))
+		return
+	}
+	bandwidthOverrides.Lock()
+	bandwidthOverrides.m[userID] = body
+	bandwidthOverrides.Unlock()
+	a.applyBandwidth(userID)
+	serverLog.Info("admin set bandwidth", "user", userID, "bandwidth", *body.Bandwidth,
+		"upload", body.Upload, "download", body.Download)
+	writeJSON(writer, http.StatusOK, map[string]int{"user_id": userID, "bandwidth": *body.Bandwidth,
+		"upload": body.Upload, "download": body.Download})
+}
+
+func (a *adminServer) resetBandwidth(writer http.ResponseWriter, id string) {
+	userID, err := strconv.Atoi(id)
+	if err != nil {
+		writeError(writer, http.StatusBadRequest, fmt.Errorf("invalid user id %s", id))
+		return
+	}
+	bandwidthOverrides.Lock()
+	delete(bandwidthOverrides.m, userID)
+	bandwidthOverrides.Unlock()
+	a.applyBandwidth(userID)
+	serverLog.Info("admin reset bandwidth", "user", userID)
+	writeJSON(writer, http.StatusOK, map[string]int{"user_id": userID})
+}
+
+// applyBandwidth updates the buckets shared by the active connections of
+// userID, so a changed override applies right away.
+func (a *adminServer) applyBandwidth(userID int) {
+	if user := getUser(userID); user != nil {
+		if up, down, ok := quota.Bandwidth(user); ok {
+			applyUserBandwidth(a.writeBucketCache, a.readBucketCache, user, up, down)
+		}
+	}
+}
+
+func (a *adminServer) reloadBlackList(writer http.ResponseWriter) {
+	if err := ReloadBlackList(); err != nil {
+		writeError(writer, http.StatusInternalServerError, err)
+		return
+	}
+	serverLog.Info("admin reloaded black list")
+	writeJSON(writer, http.StatusOK, map[string]bool{"reloaded": true})
+}
+
+func (a *adminServer) license(writer http.ResponseWriter) {
+	lcfg := GetLicenseLimit()
+	writeJSON(writer, http.StatusOK, map[string]interface{}{
+		"expire":                 lcfg.Expire,
+		"expired":                lcfg.IsExpired(),
+		"max_users":              lcfg.MaxUsers,
+		"max_servers":            lcfg.MaxServers,
+		"max_bandwidth":          lcfg.MaxBandwidth,
+		"max_upload_bandwidth":   lcfg.MaxUploadBandwidth,
+		"max_download_bandwidth": lcfg.MaxDownloadBandwidth,
+	})
+}
+
+// checkAdminConfig tells whether the admin API can be served as configured.
+// The API can kick users and change their bandwidth, so the token is only
+// sent in the clear to a loopback address.
+func checkAdminConfig() error {
+	if config.AdminToken == "" && config.AdminClientCA == "" {
+		return errors.New("admin API requires admin_token or admin_client_ca")
+	}
+	if config.AdminClientCA != "" && config.AdminTLSCert == "" {
+		return errors.New("admin_client_ca requires admin_tls_cert and admin_tls_key")
+	}
+	if config.AdminTLSCert == "" && !isLoopbackAddr(config.AdminAddr) {
+		return fmt.Errorf("admin_addr %s is not a loopback address, it requires admin_tls_cert and admin_tls_key", config.AdminAddr)
+	}
+	return nil
+}
+
+// StartAdminServer serves the admin API on admin_addr. It is served over TLS
+// when admin_tls_cert is set, and asks for client certificates when
+// admin_client_ca is set.
+func StartAdminServer(writeBucketCache, readBucketCache *LRU) error {
+	if err := checkAdminConfig(); err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/api/", &adminServer{
+		token:            config.AdminToken,
+		writeBucketCache: writeBucketCache,
+		readBucketCache:  readBucketCache,
+	})
+	server := &http.Server{
+		Addr:           config.AdminAddr,
+		Handler:        mux,
+		ReadTimeout:    30 * time.Second,
+		WriteTimeout:   30 * time.Second,
+		MaxHeaderBytes: 1 << 20,
+	}
+	if config.AdminClientCA != "" {
+		pem, err := ioutil.ReadFile(config.AdminClientCA)
+		if err != nil {
+			return err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificate in %s", config.AdminClientCA)
+		}
+		server.TLSConfig = &tls.Config{
+			ClientCAs:  pool,
+			ClientAuth: tls.RequireAndVerifyClientCert,
+		}
+	}
+	go func() {
+		var err error
+		serverLog.Info("start admin http server", "addr", config.AdminAddr)
+		if config.AdminTLSCert != "" {
+			err = server.ListenAndServeTLS(config.AdminTLSCert, config.AdminTLSKey)
+		} else {
+			err = server.ListenAndServe()
+		}
+		serverLog.Error("admin http server stopped", "err", err)
+	}()
+	return nil
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	ss "github.com/shadowsocks/shadowsocks-go/shadowsocks"
+)
+
+func TestAdminBandwidth(t *testing.T) {
+	dir, err := ioutil.TempDir("", "admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	quota = newTestQuota(t, dir, ss.NewUserStatisticService())
+	defer func() { quota = nil }()
+	config.UserIDPassword = map[string]string{"1": "password"}
+	a := &adminServer{writeBucketCache: quota.writeBucketCache, readBucketCache: quota.readBucketCache}
+	call := func(method, body string) int {
+		recorder := httptest.NewRecorder()
+		request := httptest.NewRequest(method, "/api/users/1/bandwidth", strings.NewReader(body))
+		a.ServeHTTP(recorder, request)
+		return recorder.Code
+	}
+
+	for _, body := range []string{`{"bandwidth": -1}`, `{"bandwidth": 5, "upload": -1}`, `{"bandwidth": 5, "download": -2}`, `{}`} {
+		if code := call("PUT", body); code != http.StatusBadRequest {
+			t.Errorf("%s: got status %d, want 400", body, code)
+		}
+	}
+	if hasBandwidthOverride(1) {
+		t.Fatal("rejected bandwidth should not be set")
+	}
+
+	if code := call("PUT", `{"bandwidth": 5}`); code != http.StatusOK {
+		t.Fatalf("got status %d", code)
+	}
+	if rate := bucketRate(a.writeBucketCache, 1); rate != 5 {
+		t.Errorf("override gives bandwidth %d, want 5", rate)
+	}
+	if code := call("DELETE", ""); code != http.StatusOK {
+		t.Fatalf("got status %d", code)
+	}
+	if hasBandwidthOverride(1) {
+		t.Error("override should be removed")
+	}
+}
+
+func TestAdminListConnections(t *testing.T) {
+	a := &adminServer{token: "secret"}
+	cipher, err := ss.NewCipher("aes-128-cfb", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, userID := range []int{1, 2} {
+		client, server := net.Pipe()
+		defer client.Close()
+		entry := conns.Add(userID, ss.NewConn(server, cipher.Copy()))
+		defer conns.Remove(entry)
+	}
+	list := func(query, token string) (int, []ConnInfo) {
+		recorder := httptest.NewRecorder()
+		request := httptest.NewRequest("GET", "/api/connections"+query, nil)
+		if token != "" {
+			request.Header.Set("Authorization", "Bearer "+token)
+		}
+		a.ServeHTTP(recorder, request)
+		var infos []ConnInfo
+		if recorder.Code == http.StatusOK {
+			if err := json.Unmarshal(recorder.Body.Bytes(), &infos); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return recorder.Code, infos
+	}
+
+	for _, token := range []string{"", "wrong"} {
+		if code, _ := list("?user=1", token); code != http.StatusUnauthorized {
+			t.Errorf("token %q: got status %d, want 401", token, code)
+		}
+	}
+	if code, _ := list("?user=x", "secret"); code != http.StatusBadRequest {
+		t.Errorf("invalid user: got status %d, want 400", code)
+	}
+	code, infos := list("?user=1", "secret")
+	if code != http.StatusOK || len(infos) != 1 || infos[0].UserID != 1 {
+		t.Errorf("got status %d and %+v, want the connection of user 1", code, infos)
+	}
+	if code, infos := list("", "secret"); code != http.StatusOK || len(infos) != 2 {
+		t.Errorf("got status %d and %d connections, want 2", code, len(infos))
+	}
+}
+
+func TestCheckAdminConfig(t *testing.T) {
+	tests := []struct {
+		cfg ss.Config
+		ok  bool
+	}{
+		{ss.Config{AdminAddr: "127.0.0.1:8081", AdminToken: "secret"}, true},
+		{ss.Config{AdminAddr: "[::1]:8081", AdminToken: "secret"}, true},
+		{ss.Config{AdminAddr: "127.0.0.1:8081"}, false},
+		// the token would go over the network in the clear
+		{ss.Config{AdminAddr: ":8081", AdminToken: "secret"}, false},
+		{ss.Config{AdminAddr: "192.0.2.1:8081", AdminToken: "secret"}, false},
+		{ss.Config{AdminAddr: ":8081", AdminToken: "secret", AdminTLSCert: "cert.pem", AdminTLSKey: "key.pem"}, true},
+		{ss.Config{AdminAddr: ":8081", AdminClientCA: "ca.pem"}, false},
+		{ss.Config{AdminAddr: ":8081", AdminClientCA: "ca.pem", AdminTLSCert: "cert.pem", AdminTLSKey: "key.pem"}, true},
+	}
+	for _, test := range tests {
+		cfg := test.cfg
+		config = &cfg
+		if err := checkAdminConfig(); (err == nil) != test.ok {
+			t.Errorf("%+v: got error %v", test.cfg, err)
+		}
+	}
+}
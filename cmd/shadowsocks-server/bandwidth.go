@@ -0,0 +1,234 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+
+	ss "github.com/shadowsocks/shadowsocks-go/shadowsocks"
+)
+
+const (
+	defaultBurstDuration = 100 // in ms
+	// minBurst lets a full relay buffer through without waiting.
+	minBurst = 16 * 1024
+)
+
+// Server wide buckets, nil when there is no aggregate limit. Upload is the
+// traffic read from clients, download the traffic written to them.
+var serverUploadBucket, serverDownloadBucket *ss.Bucket
+
+// bandwidthGroup is an ss.BandwidthGroup ready for use, the buckets are nil
+// without a limit.
+type bandwidthGroup struct {
+	weight                       float64
+	uploadBucket, downloadBucket *ss.Bucket
+}
+
+var bandwidthGroups map[string]*bandwidthGroup
+
+// The schedulers share the bandwidth of the server, the groups and the
+// users fairly between the TCP connections, see ss.Scheduler.
+var uploadScheduler, downloadScheduler *ss.Scheduler
+
+func initBandwidth() error {
+	if rate := config.MaxUploadBandwidth; rate > 0 {
+		serverUploadBucket = newBandwidthBucket(rate, burstBytes(0, rate))
+	}
+	if rate := config.MaxDownloadBandwidth; rate > 0 {
+		serverDownloadBucket = newBandwidthBucket(rate, burstBytes(0, rate))
+	}
+	bandwidthGroups = make(map[string]*bandwidthGroup)
+	for name, cfg := range config.BandwidthGroups {
+		if cfg.Weight < 0 {
+			return fmt.Errorf("bandwidth group %s: negative weight", name)
+		}
+		group := &bandwidthGroup{weight: cfg.Weight}
+		if rate := cfg.MaxUploadBandwidth; rate > 0 {
+			group.uploadBucket = newBandwidthBucket(rate, burstBytes(0, rate))
+			group.uploadBucket.Parent = serverUploadBucket
+		}
+		if rate := cfg.MaxDownloadBandwidth; rate > 0 {
+			group.downloadBucket = newBandwidthBucket(rate, burstBytes(0, rate))
+			group.downloadBucket.Parent = serverDownloadBucket
+		}
+		bandwidthGroups[name] = group
+	}
+	uploadScheduler = ss.NewScheduler(serverUploadBucket)
+	downloadScheduler = ss.NewScheduler(serverDownloadBucket)
+	return nil
+}
+
+// getBandwidthGroup returns the group of user, users in unknown groups
+// share a group with weight 1 and no limits.
+func getBandwidthGroup(user *SSUser) *bandwidthGroup {
+	if group, have := bandwidthGroups[user.Group]; have {
+		return group
+	}
+	return &bandwidthGroup{weight: 1}
+}
+
+// bytesPerSecond converts a bandwidth in Mbps.
+func bytesPerSecond(bandwidth int) int64 {
+	return int64(bandwidth) * 1000 * 1000 / 8
+}
+
+func newBandwidthBucket(bandwidth int, burst int64) *ss.Bucket {
+	return ss.NewBucketWithRate(float64(bytesPerSecond(bandwidth)), burst, int64(bandwidth))
+}
+
+// burstBytes returns the bucket capacity for a bandwidth, burstKB if set,
+// else bandwidth_burst_ms worth of traffic.
+func burstBytes(burstKB int, bandwidth int) int64 {
+	if burstKB > 0 {
+		return int64(burstKB) * 1024
+	}
+	ms := config.BandwidthBurstMS
+	if ms <= 0 {
+		ms = defaultBurstDuration
+	}
+	burst := bytesPerSecond(bandwidth) * int64(ms) / 1000
+	if burst < minBurst {
+		burst = minBurst
+	}
+	return burst
+}
+
+// uploadBandwidth returns the upload bandwidth of user in Mbps, not positive
+// means unlimited.
+func (user *SSUser) uploadBandwidth() int {
+	if user.UploadBandwidth != 0 {
+		return user.UploadBandwidth
+	}
+	return user.Bandwidth
+}
+
+// downloadBandwidth returns the download bandwidth of user in Mbps, not
+// positive means unlimited.
+func (user *SSUser) downloadBandwidth() int {
+	if user.DownloadBandwidth != 0 {
+		return user.DownloadBandwidth
+	}
+	return user.Bandwidth
+}
+
+// capBandwidth limits a user bandwidth to the license, unlimited users get
+// the license maximum.
+func capBandwidth(bandwidth, max int) int {
+	if max > 0 && (bandwidth <= 0 || bandwidth > max) {
+		return max
+	}
+	return bandwidth
+}
+
+// userBuckets returns the read (upload) and write (download) buckets of
+// user, shared by all the connections of the user. up and down are the
+// bandwidths the user should get now, see QuotaManager.Bandwidth. A bucket
+// is nil when the user has no limit of its own in that direction.
+func userBuckets(writeBucketCache, readBucketCache *LRU, user *SSUser, up, down int) (write, read *ss.Bucket) {
+	lcfg := GetLicenseLimit()
+	maxUp, maxDown := lcfg.MaxBandwidth, lcfg.MaxBandwidth
+	if lcfg.MaxUploadBandwidth > 0 {
+		maxUp = lcfg.MaxUploadBandwidth
+	}
+	if lcfg.MaxDownloadBandwidth > 0 {
+		maxDown = lcfg.MaxDownloadBandwidth
+	}
+	up, down = capBandwidth(up, maxUp), capBandwidth(down, maxDown)
+	downloadParent, uploadParent := parentBuckets(user)
+	write = getOrCreateBucket(writeBucketCache, user.UserID, down, burstBytes(user.BurstKB, down), downloadParent)
+	read = getOrCreateBucket(readBucketCache, user.UserID, up, burstBytes(user.BurstKB, up), uploadParent)
+	return
+}
+
+// parentBuckets returns the buckets user shares with others, those of its
+// group or else those of the server. They may be nil.
+func parentBuckets(user *SSUser) (download, upload *ss.Bucket) {
+	group := getBandwidthGroup(user)
+	download, upload = serverDownloadBucket, serverUploadBucket
+	if group.downloadBucket != nil {
+		download = group.downloadBucket
+	}
+	if group.uploadBucket != nil {
+		upload = group.uploadBucket
+	}
+	return
+}
+
+// udpBuckets is userBuckets for UDP, which doesn't go through the
+// schedulers: users without a limit of their own get the buckets they share,
+// the Parent of a bucket takes care of the rest of the limits.
+func udpBuckets(writeBucketCache, readBucketCache *LRU, user *SSUser, up, down int) (write, read *ss.Bucket) {
+	write, read = userBuckets(writeBucketCache, readBucketCache, user, up, down)
+	downloadParent, uploadParent := parentBuckets(user)
+	if write == nil {
+		write = downloadParent
+	}
+	if read == nil {
+		read = uploadParent
+	}
+	return
+}
+
+// schedPaths returns the scheduler classes of user, write and read are the
+// buckets of the user.
+func schedPaths(user *SSUser, write, read *ss.Bucket) (down, up []ss.SchedClass) {
+	group := getBandwidthGroup(user)
+	userKey := strconv.Itoa(user.UserID)
+	down = []ss.SchedClass{
+		{Key: user.Group, Weight: group.weight, Bucket: group.downloadBucket},
+		{Key: userKey, Weight: float64(user.Weight), Bucket: write},
+	}
+	up = []ss.SchedClass{
+		{Key: user.Group, Weight: group.weight, Bucket: group.uploadBucket},
+		{Key: userKey, Weight: float64(user.Weight), Bucket: read},
+	}
+	return
+}
+
+// connLimiters adds a TCP connection of user to the schedulers, write and
+// read are the buckets of the user. The leaves must be released when the
+// connection is closed.
+func connLimiters(user *SSUser, write, read *ss.Bucket) (writeLeaf, readLeaf *ss.SchedNode) {
+	down, up := schedPaths(user, write, read)
+	writeLeaf = downloadScheduler.NewLeaf(0, down...)
+	readLeaf = uploadScheduler.NewLeaf(0, up...)
+	return
+}
+
+// applyUserBandwidth gives user the upload and download bandwidth up and
+// down. The TCP connections of the user get it right away, even when going
+// from limited to unlimited and back.
+func applyUserBandwidth(writeBucketCache, readBucketCache *LRU, user *SSUser, up, down int) {
+	write, read := userBuckets(writeBucketCache, readBucketCache, user, up, down)
+	downPath, upPath := schedPaths(user, write, read)
+	downloadScheduler.Update(downPath...)
+	uploadScheduler.Update(upPath...)
+}
+
+// getOrCreateBucket returns the bucket of userID in cache, updating its rate
+// and burst. Without a bandwidth it returns nil, the user is only limited by
+// the buckets it shares, and the bucket of a former limit is dropped.
+func getOrCreateBucket(cache *LRU, userID int, bandwidth int, burst int64, parent *ss.Bucket) *ss.Bucket {
+	if bandwidth <= 0 {
+		cache.Remove(userID)
+		return nil
+	}
+	var bucket *ss.Bucket
+	cbucket, have := cache.Get(userID)
+	if !have {
+		// we should create a bucket
+		bucket = newBandwidthBucket(bandwidth, burst)
+		bucket.Parent = parent
+		cache.Add(userID, bucket)
+	} else {
+		bucket = cbucket.(*ss.Bucket)
+		if bucket.OriginRate != int64(bandwidth) {
+			// For now we just update the rate for TokenBucket is OK
+			bucket.UpdateRate(float64(bytesPerSecond(bandwidth)), int64(bandwidth))
+		}
+		if bucket.Capacity() != burst {
+			bucket.SetCapacity(burst)
+		}
+	}
+	return bucket
+}
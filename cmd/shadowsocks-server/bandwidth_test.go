@@ -0,0 +1,116 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	ss "github.com/shadowsocks/shadowsocks-go/shadowsocks"
+)
+
+// setupBandwidth sets up the server wide limits of cfg without a license,
+// and returns empty bucket caches.
+func setupBandwidth(t *testing.T, cfg *ss.Config) (write, read *LRU) {
+	config = cfg
+	LicenseLimit = &LicenseConfig{}
+	serverUploadBucket, serverDownloadBucket = nil, nil
+	if err := initBandwidth(); err != nil {
+		t.Fatal(err)
+	}
+	var err error
+	if write, err = NewLRU(100, nil); err != nil {
+		t.Fatal(err)
+	}
+	if read, err = NewLRU(100, nil); err != nil {
+		t.Fatal(err)
+	}
+	return
+}
+
+func TestUnlimitedUserChargedOnce(t *testing.T) {
+	writeCache, readCache := setupBandwidth(t, &ss.Config{MaxDownloadBandwidth: 8})
+	user := &SSUser{UserID: 1}
+	write, read := userBuckets(writeCache, readCache, user, 0, 0)
+	if write != nil || read != nil {
+		t.Fatal("a user without a limit should have no bucket of its own")
+	}
+	writeLeaf, readLeaf := connLimiters(user, write, read)
+	defer writeLeaf.Release()
+	defer readLeaf.Release()
+
+	before := serverDownloadBucket.Available()
+	if err := writeLeaf.WaitReady(time.Time{}, nil); err != nil {
+		t.Fatal(err)
+	}
+	writeLeaf.Account(10000)
+	// The bucket fills at 1MB/s meanwhile, a double charge takes 20000.
+	if charged := before - serverDownloadBucket.Available(); charged < 9000 || charged > 10000 {
+		t.Errorf("server bucket charged %d for 10000 bytes", charged)
+	}
+
+	udpWrite, udpRead := udpBuckets(writeCache, readCache, user, 0, 0)
+	if udpWrite != serverDownloadBucket || udpRead != nil {
+		t.Error("UDP of a user without a limit should get the server buckets")
+	}
+}
+
+func TestCapBandwidth(t *testing.T) {
+	tests := []struct{ bandwidth, max, want int }{
+		{10, 0, 10},
+		{0, 0, 0},
+		{-1, 0, -1},
+		{10, 20, 10},
+		{30, 20, 20},
+		{0, 20, 20},
+		{-1, 20, 20},
+	}
+	for _, test := range tests {
+		if got := capBandwidth(test.bandwidth, test.max); got != test.want {
+			t.Errorf("%d capped to %d: got %d, want %d", test.bandwidth, test.max, got, test.want)
+		}
+	}
+}
+
+func TestBurstBytes(t *testing.T) {
+	config = &ss.Config{}
+	tests := []struct {
+		burstKB, bandwidth, burstMS int
+		want                        int64
+	}{
+		{64, 100, 0, 64 * 1024},
+		// 100 ms of 100Mbps
+		{0, 100, 0, 1250000},
+		{0, 100, 20, 250000},
+		{0, 1, 0, minBurst},
+	}
+	for _, test := range tests {
+		config.BandwidthBurstMS = test.burstMS
+		if got := burstBytes(test.burstKB, test.bandwidth); got != test.want {
+			t.Errorf("%dKB at %dMbps over %dms: got %d, want %d", test.burstKB, test.bandwidth, test.burstMS, got, test.want)
+		}
+	}
+}
+
+func TestGetOrCreateBucket(t *testing.T) {
+	cache, _ := setupBandwidth(t, &ss.Config{})
+	bucket := getOrCreateBucket(cache, 1, 10, minBurst, nil)
+	if bucket == nil || bucket.OriginRate != 10 {
+		t.Fatalf("got %+v", bucket)
+	}
+	if again := getOrCreateBucket(cache, 1, 20, 2*minBurst, nil); again != bucket {
+		t.Error("the bucket of a user should be shared")
+	}
+	if bucket.OriginRate != 20 || bucket.Capacity() != 2*minBurst {
+		t.Errorf("bucket not updated, rate %d capacity %d", bucket.OriginRate, bucket.Capacity())
+	}
+
+	// Going unlimited drops the bucket, a new limit starts afresh.
+	if getOrCreateBucket(cache, 1, 0, minBurst, nil) != nil {
+		t.Error("unlimited user should have no bucket")
+	}
+	if cache.Contains(1) {
+		t.Error("the bucket of a former limit should be dropped")
+	}
+	if again := getOrCreateBucket(cache, 1, 5, minBurst, nil); again == bucket || again.OriginRate != 5 {
+		t.Errorf("got %+v", again)
+	}
+}
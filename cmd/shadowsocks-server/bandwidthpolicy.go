@@ -0,0 +1,253 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	ss "github.com/shadowsocks/shadowsocks-go/shadowsocks"
+)
+
+const policyCheckInterval = 10 * time.Second
+
+// bandwidthPolicy is an ss.BandwidthPolicy ready for use.
+type bandwidthPolicy struct {
+	name            string
+	windows         []policyWindow
+	creditBytes     int64
+	refill          float64 // credit bytes per second
+	creditBandwidth int
+}
+
+type policyWindow struct {
+	*ss.TimeWindow
+	up, down int
+}
+
+func newBandwidthPolicy(name string, cfg ss.BandwidthPolicy) (*bandwidthPolicy, error) {
+	loc := time.Local
+	if cfg.TimeZone != "" {
+		var err error
+		if loc, err = time.LoadLocation(cfg.TimeZone); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.CreditMB < 0 || cfg.CreditRefillMB < 0 {
+		return nil, fmt.Errorf("negative burst credit")
+	}
+	p := &bandwidthPolicy{
+		name:            name,
+		creditBytes:     cfg.CreditMB * 1024 * 1024,
+		refill:          float64(cfg.CreditRefillMB*1024*1024) / 3600,
+		creditBandwidth: cfg.CreditBandwidth,
+	}
+	for _, wcfg := range cfg.Windows {
+		tw, err := ss.ParseTimeWindow(wcfg.Days, wcfg.From, wcfg.To, loc)
+		if err != nil {
+			return nil, err
+		}
+		w := policyWindow{TimeWindow: tw, up: wcfg.Bandwidth, down: wcfg.Bandwidth}
+		if wcfg.Upload != 0 {
+			w.up = wcfg.Upload
+		}
+		if wcfg.Download != 0 {
+			w.down = wcfg.Download
+		}
+		p.windows = append(p.windows, w)
+	}
+	return p, nil
+}
+
+// userCredit is the burst credit of a user under a policy, it starts over
+// when the user switches policies.
+type userCredit struct {
+	policy string
+	*ss.BurstCredit
+}
+
+// PolicyEngine evaluates the bandwidth policies of the users. The credits
+// are charged with the traffic counted by UserStatisticService, and the
+// users with active connections are evaluated again periodically, so window
+// changes and used up credits apply to existing connections too.
+type PolicyEngine struct {
+	lock      sync.Mutex
+	policies  map[string]*bandwidthPolicy
+	credits   map[int]*userCredit
+	users     map[int]*SSUser
+	applied   map[int][2]int // last up and down bandwidth applied by refresh
+	collector *ss.StatisticCollector
+
+	writeBucketCache *LRU
+	readBucketCache  *LRU
+}
+
+var policies *PolicyEngine
+
+func initBandwidthPolicies(writeBucketCache, readBucketCache *LRU) error {
+	policies = &PolicyEngine{
+		policies:         make(map[string]*bandwidthPolicy),
+		credits:          make(map[int]*userCredit),
+		users:            make(map[int]*SSUser),
+		applied:          make(map[int][2]int),
+		collector:        ss.GetUserStatisticService().NewCollector(),
+		writeBucketCache: writeBucketCache,
+		readBucketCache:  readBucketCache,
+	}
+	for name, cfg := range config.BandwidthPolicies {
+		p, err := newBandwidthPolicy(name, cfg)
+		if err != nil {
+			return fmt.Errorf("bandwidth policy %s: %v", name, err)
+		}
+		policies.policies[name] = p
+	}
+	if name := config.DefaultBandwidthPolicy; name != "" && policies.policies[name] == nil {
+		return fmt.Errorf("default_bandwidth_policy %s is not in bandwidth_policies", name)
+	}
+	if len(policies.policies) > 0 {
+		go policies.run()
+	}
+	return nil
+}
+
+// policyOf returns the policy of user, nil if there is none. Unlike ACLs an
+// unknown policy is no reason to reject the user, it just gets its plain
+// bandwidth.
+func (e *PolicyEngine) policyOf(user *SSUser) *bandwidthPolicy {
+	name := user.BandwidthPolicy
+	if name == "" {
+		name = config.DefaultBandwidthPolicy
+	}
+	if name == "" {
+		return nil
+	}
+	p, have := e.policies[name]
+	if !have {
+		serverLog.Warn("unknown bandwidth policy", "user", user.UserID, "policy", name)
+	}
+	return p
+}
+
+// creditOf returns the burst credit of user under p. Must be called with
+// lock held.
+func (e *PolicyEngine) creditOf(user *SSUser, p *bandwidthPolicy, now time.Time) *userCredit {
+	credit, have := e.credits[user.UserID]
+	if !have || credit.policy != p.name {
+		credit = &userCredit{p.name, ss.NewBurstCredit(p.creditBytes, p.refill, now)}
+		e.credits[user.UserID] = credit
+	}
+	return credit
+}
+
+// Adjust returns the bandwidth user gets under its policy at now, up and
+// down are the bandwidth of the user otherwise. The first window containing
+// now wins, then the burst credit. A bandwidth set through the admin API
+// overrides the policy.
+func (e *PolicyEngine) Adjust(user *SSUser, up, down int, now time.Time) (int, int) {
+	if e == nil {
+		return up, down
+	}
+	p := e.policyOf(user)
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	if p == nil {
+		delete(e.users, user.UserID)
+		delete(e.credits, user.UserID)
+		delete(e.applied, user.UserID)
+		return up, down
+	}
+	e.users[user.UserID] = user
+	if hasBandwidthOverride(user.UserID) {
+		return up, down
+	}
+	// The credit is charged all the traffic of the user, in windows too.
+	var credit *userCredit
+	if p.creditBytes > 0 {
+		credit = e.creditOf(user, p, now)
+	}
+	for _, w := range p.windows {
+		if w.Contains(now) {
+			return w.up, w.down
+		}
+	}
+	if credit != nil && credit.Available(now) > 0 {
+		return p.creditBandwidth, p.creditBandwidth
+	}
+	return up, down
+}
+
+func (e *PolicyEngine) run() {
+	for {
+		time.Sleep(policyCheckInterval)
+		e.account()
+		e.refresh()
+	}
+}
+
+// account charges the traffic since the last run to the burst credits.
+func (e *PolicyEngine) account() {
+	deltas := e.collector.Collect()
+	now := time.Now()
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	for userID, delta := range deltas {
+		if credit, have := e.credits[int(userID)]; have {
+			credit.Use(now, int64(delta.BytesIn+delta.BytesOut))
+		}
+	}
+}
+
+// refresh evaluates the policies of the users with active connections and
+// applies the bandwidth that changed. The users are read from the store
+// again, a user whose policy was removed gets its plain bandwidth back and
+// is forgotten. Users without connections are forgotten, their credits are
+// kept.
+func (e *PolicyEngine) refresh() {
+	active := make(map[int]bool)
+	for _, info := range conns.List(-1) {
+		active[info.UserID] = true
+	}
+	type appliedUser struct {
+		*SSUser
+		last [2]int
+		have bool // whether last was applied
+	}
+	e.lock.Lock()
+	var users []appliedUser
+	for userID, user := range e.users {
+		if active[userID] {
+			last, have := e.applied[userID]
+			users = append(users, appliedUser{user, last, have})
+		} else {
+			delete(e.users, userID)
+			delete(e.applied, userID)
+		}
+	}
+	e.lock.Unlock()
+
+	for _, u := range users {
+		user := u.SSUser
+		if fresh := getUser(user.UserID); fresh != nil {
+			user = fresh
+		}
+		// Adjust forgets the user when it has no policy anymore.
+		up, down, ok := quota.Bandwidth(user)
+		if !ok {
+			continue
+		}
+		e.lock.Lock()
+		_, tracked := e.users[user.UserID]
+		if tracked {
+			e.applied[user.UserID] = [2]int{up, down}
+		}
+		e.lock.Unlock()
+		if tracked && u.have && u.last == [2]int{up, down} {
+			continue
+		}
+		if !tracked {
+			serverLog.Info("bandwidth policy removed", "user", user.UserID, "upload", up, "download", down)
+		} else if u.have {
+			serverLog.Info("bandwidth policy changed", "user", user.UserID, "upload", up, "download", down)
+		}
+		applyUserBandwidth(e.writeBucketCache, e.readBucketCache, user, up, down)
+	}
+}
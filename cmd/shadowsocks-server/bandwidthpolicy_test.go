@@ -0,0 +1,131 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	ss "github.com/shadowsocks/shadowsocks-go/shadowsocks"
+)
+
+// newTestPolicies returns a PolicyEngine with the policies of cfgs, charging
+// the traffic of service. It is not running, tests call account and refresh.
+func newTestPolicies(t *testing.T, service *ss.UserStatisticService, cfgs map[string]ss.BandwidthPolicy) *PolicyEngine {
+	writeCache, readCache := setupBandwidth(t, &ss.Config{BandwidthPolicies: cfgs})
+	e := &PolicyEngine{
+		policies:         make(map[string]*bandwidthPolicy),
+		credits:          make(map[int]*userCredit),
+		users:            make(map[int]*SSUser),
+		applied:          make(map[int][2]int),
+		collector:        service.NewCollector(),
+		writeBucketCache: writeCache,
+		readBucketCache:  readCache,
+	}
+	for name, cfg := range cfgs {
+		p, err := newBandwidthPolicy(name, cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		e.policies[name] = p
+	}
+	return e
+}
+
+var testPolicies = map[string]ss.BandwidthPolicy{
+	// all day long
+	"night": {Windows: []ss.BandwidthWindow{{From: "00:00", To: "00:00", Bandwidth: 100, Upload: 10}}},
+	"burst": {CreditMB: 1, CreditBandwidth: 50},
+}
+
+func TestPolicyAdjust(t *testing.T) {
+	service := ss.NewUserStatisticService()
+	e := newTestPolicies(t, service, testPolicies)
+	now := time.Now()
+	adjust := func(user *SSUser, wantUp, wantDown int) {
+		if up, down := e.Adjust(user, 2, 4, now); up != wantUp || down != wantDown {
+			t.Errorf("user %d with policy %q: got %d and %d, want %d and %d",
+				user.UserID, user.BandwidthPolicy, up, down, wantUp, wantDown)
+		}
+	}
+
+	plain := &SSUser{UserID: 1}
+	adjust(plain, 2, 4)
+	adjust(&SSUser{UserID: 1, BandwidthPolicy: "unknown"}, 2, 4)
+	if _, have := e.users[1]; have {
+		t.Error("users without a policy should not be tracked")
+	}
+
+	night := &SSUser{UserID: 2, BandwidthPolicy: "night"}
+	adjust(night, 10, 100)
+	bandwidthOverrides.Lock()
+	bandwidthOverrides.m[2] = bandwidthOverride{}
+	bandwidthOverrides.Unlock()
+	adjust(night, 2, 4)
+	bandwidthOverrides.Lock()
+	delete(bandwidthOverrides.m, 2)
+	bandwidthOverrides.Unlock()
+
+	burst := &SSUser{UserID: 3, BandwidthPolicy: "burst"}
+	adjust(burst, 50, 50)
+	service.IncInBytes(3, 1024*1024)
+	service.IncOutBytes(3, 1024)
+	e.account()
+	adjust(burst, 2, 4)
+}
+
+func TestPolicyRefresh(t *testing.T) {
+	dir, err := ioutil.TempDir("", "policy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	service := ss.NewUserStatisticService()
+	quota = newTestQuota(t, dir, service)
+	policies = newTestPolicies(t, service, testPolicies)
+	defer func() { quota, policies = nil, nil }()
+	config.UserIDPassword = map[string]string{"1": "password"}
+	config.DefaultBandwidthPolicy = "night"
+
+	client, server := net.Pipe()
+	defer client.Close()
+	cipher, err := ss.NewCipher("aes-128-cfb", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry := conns.Add(1, ss.NewConn(server, cipher))
+	defer conns.Remove(entry)
+	user := getUser(1)
+	up, down, _ := quota.Bandwidth(user)
+	write, read := userBuckets(policies.writeBucketCache, policies.readBucketCache, user, up, down)
+	writeLeaf, readLeaf := connLimiters(user, write, read)
+	defer writeLeaf.Release()
+	defer readLeaf.Release()
+
+	policies.refresh()
+	if rate := bucketRate(policies.writeBucketCache, 1); rate != 100 {
+		t.Errorf("policy gives bandwidth %d, want 100", rate)
+	}
+	if policies.applied[1] != [2]int{10, 100} {
+		t.Errorf("applied %v", policies.applied[1])
+	}
+
+	// The user store drops the policy, the user is unlimited again.
+	config.DefaultBandwidthPolicy = ""
+	policies.refresh()
+	if _, have := policies.users[1]; have {
+		t.Error("user without a policy should be forgotten")
+	}
+	if _, have := policies.applied[1]; have {
+		t.Error("bandwidth applied to a user without a policy should be forgotten")
+	}
+	// 10MB would take most of a second at 100Mbps.
+	if err := writeLeaf.WaitReady(time.Time{}, nil); err != nil {
+		t.Fatal(err)
+	}
+	writeLeaf.Account(10 * 1024 * 1024)
+	if err := writeLeaf.WaitReady(time.Now().Add(100*time.Millisecond), nil); err != nil {
+		t.Errorf("connections of the user should not be limited anymore: %v", err)
+	}
+}
@@ -1,33 +1,50 @@
 package main
 
 import (
-	"bufio"
-	"os"
-)
+	"net"
+	"sync"
 
-var blackList map[string]bool
+	ss "github.com/shadowsocks/shadowsocks-go/shadowsocks"
+)
 
-func init() {
-	blackList = make(map[string]bool)
-}
+var blackList *ss.RuleSet
+var blackListPath string
+var blackListLock sync.RWMutex
 
+// LoadBlackList reads the black list rules, see ss.ParseRule for the format.
 func LoadBlackList(fname string) error {
-	fp, err := os.Open(fname)
+	blackListLock.Lock()
+	blackListPath = fname
+	blackListLock.Unlock()
+	list, err := ss.LoadRules(fname)
 	if err != nil {
 		return err
 	}
-	reader := bufio.NewReader(fp)
-	for {
-		line, _, _ := reader.ReadLine()
-		if len(line) == 0 {
-			break
-		}
-		blackList[string(line)] = true
-	}
+	blackListLock.Lock()
+	blackList = list
+	blackListLock.Unlock()
 	return nil
 }
 
-func CheckBlackList(host string) bool {
-	_, have := blackList[host]
-	return have
+// ReloadBlackList reads the black list file given on the command line again.
+func ReloadBlackList() error {
+	blackListLock.RLock()
+	fname := blackListPath
+	blackListLock.RUnlock()
+	if fname == "" {
+		return nil
+	}
+	return LoadBlackList(fname)
+}
+
+func getBlackList() *ss.RuleSet {
+	blackListLock.RLock()
+	defer blackListLock.RUnlock()
+	return blackList
+}
+
+// CheckBlackList returns the rule blocking the destination, or nil. ip is the
+// address host resolved to, or nil.
+func CheckBlackList(host string, ip net.IP, port int) *ss.Rule {
+	return getBlackList().Match(host, ip, port)
 }
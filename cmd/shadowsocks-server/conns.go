@@ -0,0 +1,211 @@
+package main
+
+import (
+	"io"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	ss "github.com/shadowsocks/shadowsocks-go/shadowsocks"
+)
+
+// byteCounter is the live traffic of a relay.
+type byteCounter interface {
+	BytesIn() uint64
+	BytesOut() uint64
+}
+
+// connEntry is an active TCP relay or UDP NAT mapping.
+type connEntry struct {
+	ID         uint64
+	Proto      string
+	UserID     int
+	ClientAddr string
+	Start      time.Time
+
+	target  string
+	reason  string // why the relay ended, the first reason set wins
+	counter byteCounter
+	// closer ends the relay. For TCP it aborts the ss.Conn, that is the safe
+	// way to kick a connection from another goroutine, conn.Close would
+	// return its buffers while the relay may still use them. For UDP it is
+	// the socket of the mapping.
+	closer io.Closer
+}
+
+// ConnInfo is what the admin API and the statistic server report for a
+// connection.
+type ConnInfo struct {
+	ID         uint64    `json:"id"`
+	Proto      string    `json:"proto"`
+	UserID     int       `json:"user_id"`
+	ClientAddr string    `json:"client_addr"`
+	Target     string    `json:"target"`
+	BytesIn    uint64    `json:"bytes_in"`
+	BytesOut   uint64    `json:"bytes_out"`
+	Start      time.Time `json:"start"`
+	Age        float64   `json:"age"` // in seconds
+}
+
+type connInfoByID []ConnInfo
+
+func (a connInfoByID) Len() int           { return len(a) }
+func (a connInfoByID) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a connInfoByID) Less(i, j int) bool { return a[i].ID < a[j].ID }
+
+// connRegistry records the active TCP relays and UDP NAT mappings. It is
+// also the ss.NATObserver of the UDP relays.
+type connRegistry struct {
+	lock   sync.RWMutex
+	nextID uint64
+	conns  map[uint64]*connEntry
+	nat    map[*ss.CachedUDPConn]*connEntry
+}
+
+var conns = &connRegistry{
+	conns: make(map[uint64]*connEntry),
+	nat:   make(map[*ss.CachedUDPConn]*connEntry),
+}
+
+func (r *connRegistry) add(e *connEntry) *connEntry {
+	r.nextID++
+	e.ID = r.nextID
+	e.Start = time.Now()
+	r.conns[e.ID] = e
+	return e
+}
+
+// closerFunc turns a function into an io.Closer.
+type closerFunc func() error
+
+func (f closerFunc) Close() error {
+	return f()
+}
+
+// Add records a TCP relay.
+func (r *connRegistry) Add(userID int, conn *ss.Conn) *connEntry {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.add(&connEntry{
+		Proto:      "tcp",
+		UserID:     userID,
+		ClientAddr: conn.RemoteAddr().String(),
+		counter:    conn,
+		closer:     closerFunc(conn.Abort),
+	})
+}
+
+func (r *connRegistry) NATOpened(userID uint32, src net.Addr, dst *net.UDPAddr, remote *ss.CachedUDPConn) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.nat[remote] = r.add(&connEntry{
+		Proto:      "udp",
+		UserID:     int(userID),
+		ClientAddr: src.String(),
+		target:     dst.String(),
+		counter:    remote,
+		closer:     remote,
+	})
+}
+
+func (r *connRegistry) NATClosed(remote *ss.CachedUDPConn, err error) {
+	r.lock.Lock()
+	e, have := r.nat[remote]
+	if have {
+		delete(r.nat, remote)
+		delete(r.conns, e.ID)
+		if e.reason == "" {
+			e.reason = closeReason(err)
+		}
+	}
+	r.lock.Unlock()
+	if have {
+		accessLog.Log(e)
+	}
+}
+
+// Remove forgets a TCP relay and writes its access log record.
+func (r *connRegistry) Remove(e *connEntry) {
+	r.lock.Lock()
+	delete(r.conns, e.ID)
+	r.lock.Unlock()
+	accessLog.Log(e)
+}
+
+// SetCloseReason records why the relay ended, unless a reason is already
+// recorded.
+func (r *connRegistry) SetCloseReason(e *connEntry, reason string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if e.reason == "" {
+		e.reason = reason
+	}
+}
+
+func (r *connRegistry) SetTarget(e *connEntry, target string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	e.target = target
+}
+
+// List returns the active connections ordered by ID, userID < 0 means all
+// users.
+func (r *connRegistry) List(userID int) []ConnInfo {
+	now := time.Now()
+	r.lock.RLock()
+	list := make([]ConnInfo, 0, len(r.conns))
+	for _, e := range r.conns {
+		if userID >= 0 && e.UserID != userID {
+			continue
+		}
+		list = append(list, ConnInfo{
+			ID:         e.ID,
+			Proto:      e.Proto,
+			UserID:     e.UserID,
+			ClientAddr: e.ClientAddr,
+			Target:     e.target,
+			BytesIn:    e.counter.BytesIn(),
+			BytesOut:   e.counter.BytesOut(),
+			Start:      e.Start,
+			Age:        now.Sub(e.Start).Seconds(),
+		})
+	}
+	r.lock.RUnlock()
+	sort.Sort(connInfoByID(list))
+	return list
+}
+
+// Kick closes the connection with id for reason, it reports whether there is
+// one.
+func (r *connRegistry) Kick(id uint64, reason string) bool {
+	r.lock.Lock()
+	e, have := r.conns[id]
+	if have && e.reason == "" {
+		e.reason = reason
+	}
+	r.lock.Unlock()
+	if have {
+		e.closer.Close()
+	}
+	return have
+}
+
+// KickUser closes all connections of userID for reason and returns how many.
+func (r *connRegistry) KickUser(userID int, reason string) int {
+	var kicked []io.Closer
+	r.lock.Lock()
+	for _, e := range r.conns {
+		if e.UserID == userID {
+			if e.reason == "" {
+				e.reason = reason
+			}
+			kicked = append(kicked, e.closer)
+		}
+	}
+	r.lock.Unlock()
+	for _, c := range kicked {
+		c.Close()
+	}
+	return len(kicked)
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"testing"
+	"time"
+
+	ss "github.com/shadowsocks/shadowsocks-go/shadowsocks"
+)
+
+func newTestRegistry() *connRegistry {
+	return &connRegistry{
+		conns: make(map[uint64]*connEntry),
+		nat:   make(map[*ss.CachedUDPConn]*connEntry),
+	}
+}
+
+// testConn returns a relayed ss.Conn, closed with the returned function.
+func testConn(t *testing.T) (*ss.Conn, func()) {
+	cipher, err := ss.NewCipher("aes-128-cfb", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, server := net.Pipe()
+	conn := ss.NewConn(server, cipher)
+	return conn, func() {
+		client.Close()
+		conn.Close()
+	}
+}
+
+// waitRecords waits for n access log records in sink.
+func waitRecords(t *testing.T, sink *recordSink, n int) []AccessRecord {
+	deadline := time.Now().Add(5 * time.Second)
+	for len(sink.Records()) < n && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	records := sink.Records()
+	if len(records) != n {
+		t.Fatalf("got %d access log records, want %d", len(records), n)
+	}
+	return records
+}
+
+func TestConnRegistryList(t *testing.T) {
+	r := newTestRegistry()
+	var entries []*connEntry
+	for _, userID := range []int{1, 2, 1} {
+		conn, done := testConn(t)
+		defer done()
+		entries = append(entries, r.Add(userID, conn))
+	}
+	r.SetTarget(entries[0], "www.example.com:443")
+
+	all := r.List(-1)
+	if len(all) != 3 || all[0].ID >= all[1].ID || all[1].ID >= all[2].ID {
+		t.Fatalf("got %+v, want 3 connections ordered by id", all)
+	}
+	if all[0].Proto != "tcp" || all[0].Target != "www.example.com:443" {
+		t.Errorf("got %+v", all[0])
+	}
+	tests := []struct {
+		userID int
+		want   int
+	}{
+		{1, 2},
+		{2, 1},
+		{3, 0},
+	}
+	for _, test := range tests {
+		list := r.List(test.userID)
+		if len(list) != test.want {
+			t.Errorf("user %d: got %d connections, want %d", test.userID, len(list), test.want)
+		}
+		for _, info := range list {
+			if info.UserID != test.userID {
+				t.Errorf("user %d: got a connection of user %d", test.userID, info.UserID)
+			}
+		}
+	}
+
+	r.Remove(entries[0])
+	if list := r.List(1); len(list) != 1 || list[0].ID != entries[2].ID {
+		t.Errorf("got %+v after remove", list)
+	}
+}
+
+func TestConnRegistryNAT(t *testing.T) {
+	echo, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		buf := make([]byte, 64)
+		for {
+			n, addr, err := echo.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			echo.WriteToUDP(buf[:n], addr)
+		}
+	}()
+	sink := &recordSink{}
+	accessLog = &accessLogger{sink: sink, sampleRate: 1}
+	defer func() { accessLog = nil }()
+
+	r := newTestRegistry()
+	table := ss.NewNATTable(ss.NATAddressRestricted, time.Minute, 0)
+	defer table.Close()
+	client, server := net.Pipe()
+	defer client.Close()
+	relay := &ss.UDPConn{UserID: 7, NAT: table, NATObserver: r}
+	go relay.ServeUDPOverTCP(server)
+	header, _ := ss.ParseHeader(echo.LocalAddr())
+	if err := ss.WriteUoTFrame(client, header, []byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := ss.ReadUoTFrame(bufio.NewReader(client), make([]byte, 65535)); err != nil {
+		t.Fatal(err)
+	}
+
+	list := r.List(7)
+	if len(list) != 1 || list[0].Proto != "udp" || list[0].Target != echo.LocalAddr().String() {
+		t.Fatalf("got %+v, want the mapping", list)
+	}
+	if list[0].BytesIn != 4 || list[0].BytesOut != 4 {
+		t.Errorf("got %d bytes in and %d out, want 4 and 4", list[0].BytesIn, list[0].BytesOut)
+	}
+
+	// Kicking the user closes the mapping.
+	if n := r.KickUser(7, closeKicked); n != 1 {
+		t.Errorf("kicked %d, want 1", n)
+	}
+	records := waitRecords(t, sink, 1)
+	if records[0].Proto != "udp" || records[0].Reason != closeKicked {
+		t.Errorf("got %+v", records[0])
+	}
+	if list := r.List(-1); len(list) != 0 {
+		t.Errorf("closed mapping still listed: %+v", list)
+	}
+	if len(r.nat) != 0 {
+		t.Errorf("%d mappings left", len(r.nat))
+	}
+}
+
+func TestConnRegistryKick(t *testing.T) {
+	sink := &recordSink{}
+	accessLog = &accessLogger{sink: sink, sampleRate: 1}
+	defer func() { accessLog = nil }()
+	r := newTestRegistry()
+	conn, done := testConn(t)
+	defer done()
+	entry := r.Add(1, conn)
+	r.SetTarget(entry, "www.example.com:443")
+
+	// The relay is blocked reading from the client.
+	relayErr := make(chan error, 1)
+	go func() {
+		_, err := conn.Read(make([]byte, 16))
+		relayErr <- err
+	}()
+	if !r.Kick(entry.ID, closeKicked) {
+		t.Fatal("the connection should be found")
+	}
+	select {
+	case err := <-relayErr:
+		if err == nil {
+			t.Error("kicked relay should fail")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("kicked relay should end")
+	}
+	// The relay ending records its own reason, the kick comes first.
+	r.SetCloseReason(entry, closeError)
+	r.Remove(entry)
+	records := waitRecords(t, sink, 1)
+	if records[0].Reason != closeKicked {
+		t.Errorf("got reason %s, want %s", records[0].Reason, closeKicked)
+	}
+	if r.Kick(entry.ID, closeKicked) {
+		t.Error("removed connection should not be found")
+	}
+}
@@ -2,12 +2,14 @@ package main
 
 import (
 	"database/sql"
+	"encoding/json"
 	"fmt"
 	"github.com/garyburd/redigo/redis"
 	_ "github.com/go-sql-driver/mysql"
-	"strconv"
 	"strings"
 	"time"
+
+	ss "github.com/shadowsocks/shadowsocks-go/shadowsocks"
 )
 
 var db *sql.DB
@@ -44,21 +46,21 @@ func initRedis(server string) error {
 	return err
 }
 
-func unpackCachedData(value string) (password string, bandwidth int, err error) {
-	pair := strings.Split(value, "|")
-	password = pair[0]
-	bandwidth, err = strconv.Atoi(pair[1])
-	return
+func unpackCachedData(value string) (*SSUser, error) {
+	user := new(SSUser)
+	if err := json.Unmarshal([]byte(value), user); err != nil {
+		return nil, err
+	}
+	return user, nil
 }
 
-func packCachedData(password string, bandwidth int) string {
-	return fmt.Sprintf("%s|%d", password, bandwidth)
+func packCachedData(user *SSUser) string {
+	data, _ := json.Marshal(user)
+	return string(data)
 }
 
-func getFromRedis(userID int) (have bool, password string, bandwidth int) {
+func getFromRedis(userID int) (have bool, user *SSUser) {
 	have = false
-	password = ""
-	bandwidth = 0
 	key := fmt.Sprintf("%d", userID)
 	conn := redisPool.Get()
 	defer conn.Close()
@@ -66,7 +68,7 @@ func getFromRedis(userID int) (have bool, password string, bandwidth int) {
 	if err != nil {
 		return
 	}
-	password, bandwidth, err = unpackCachedData(value)
+	user, err = unpackCachedData(value)
 	if err != nil {
 		return
 	}
@@ -74,14 +76,13 @@ func getFromRedis(userID int) (have bool, password string, bandwidth int) {
 	return
 }
 
-func saveToRedis(userID int, password string, bandwidth int) {
-	key := fmt.Sprintf("%d", userID)
-	value := packCachedData(password, bandwidth)
+func saveToRedis(user *SSUser) {
+	key := fmt.Sprintf("%d", user.UserID)
+	value := packCachedData(user)
 	conn := redisPool.Get()
 	defer conn.Close()
-	status, err := conn.Do("SET", key, value, "EX", "3600")
-	if debug {
-		debug.Printf("%v, %v\n", status, err)
+	if _, err := conn.Do("SET", key, value, "EX", "3600"); err != nil {
+		ss.DBLog.Warn("cannot cache user in redis", "user", user.UserID, "err", err)
 	}
 }
 
@@ -91,34 +92,45 @@ func saveToRedis(userID int, password string, bandwidth int) {
 //    password varchar(255)
 //    status varchar(20)
 //    bandwidth int
+//    quota_bytes bigint
+//    quota_period varchar(20)
+//    quota_anchor int
+//    over_quota_bandwidth int
+//    max_connections int
+//    max_udp_sessions int
+//    max_ips int
+//    acl varchar(64)
+//    upload_bandwidth int
+//    download_bandwidth int
+//    burst_kb int
+//    bandwidth_group varchar(64)
+//    weight int
+//    bandwidth_policy varchar(64)
 // )
 // Status: Enabled, Disabled
+// Quota Period: daily, monthly or empty for no quota
 //
-func getPasswordAndBandwidthFromDatabase(userID int) (string, int) {
+func getUserFromDatabase(userID int) *SSUser {
 	if useRedis {
-		have, password, bandwidth := getFromRedis(userID)
+		have, user := getFromRedis(userID)
 		if have {
-			if debug {
-				debug.Printf("Cache Hit for Customer: %d\n", userID)
-			}
-			return password, bandwidth
-		}
-		if debug {
-			debug.Printf("Cache Miss for Customer: %d\n", userID)
+			ss.DBLog.Debug("cache hit", "user", userID)
+			return user
 		}
+		ss.DBLog.Debug("cache miss", "user", userID)
 	}
 	ssuser, err := queryDatabase(userID)
 	if err != nil {
-		fmt.Printf("Error: %v", err)
-		return "", -1
+		ss.DBLog.Error("cannot query user", "user", userID, "err", err)
+		return nil
 	}
 	if ssuser == nil {
-		return "", -1
+		return nil
 	}
 	if useRedis {
-		saveToRedis(userID, ssuser.Password, ssuser.Bandwidth)
+		saveToRedis(ssuser)
 	}
-	return ssuser.Password, ssuser.Bandwidth
+	return ssuser
 }
 
 type SSUser struct {
@@ -126,10 +138,38 @@ type SSUser struct {
 	Password  string
 	Status    string
 	Bandwidth int
+	// Per direction bandwidth in Mbps, 0 means Bandwidth. Upload is what the
+	// client sends. BurstKB is the bucket capacity, 0 derives it from the
+	// rate.
+	UploadBandwidth   int
+	DownloadBandwidth int
+	BurstKB           int
+	// Bandwidth group in bandwidth_groups and the share of the user in it
+	// under contention, 0 means 1.
+	Group  string
+	Weight int
+	// Transfer quota in bytes per QuotaPeriod. QuotaAnchor is the hour of
+	// day (daily) or day of month (monthly) the usage is reset at. Once the
+	// quota is used up the user is limited to OverQuotaBandwidth, or blocked
+	// if it is not positive.
+	QuotaBytes         int64
+	QuotaPeriod        string
+	QuotaAnchor        int
+	OverQuotaBandwidth int
+	// Concurrency limits, 0 means using the server wide default.
+	MaxConnections int
+	MaxUDPSessions int
+	MaxIPs         int
+	// Name of the ACL policy in acl_policies, empty means the one of Group in
+	// group_acls, then default_acl.
+	ACL string
+	// Name of the policy in bandwidth_policies, empty means
+	// default_bandwidth_policy.
+	BandwidthPolicy string
 }
 
 func queryDatabase(userID int) (*SSUser, error) {
-	sql := fmt.Sprintf("SELECT userid, password, status, bandwidth FROM user WHERE userid='%d' AND status='Enabled';", userID)
+	sql := fmt.Sprintf("SELECT userid, password, status, bandwidth, IFNULL(quota_bytes, 0), IFNULL(quota_period, ''), IFNULL(quota_anchor, 0), IFNULL(over_quota_bandwidth, 0), IFNULL(max_connections, 0), IFNULL(max_udp_sessions, 0), IFNULL(max_ips, 0), IFNULL(acl, ''), IFNULL(upload_bandwidth, 0), IFNULL(download_bandwidth, 0), IFNULL(burst_kb, 0), IFNULL(bandwidth_group, ''), IFNULL(weight, 0), IFNULL(bandwidth_policy, '') FROM user WHERE userid='%d' AND status='Enabled';", userID)
 	tx, err := db.Begin()
 	if err != nil {
 		return nil, err
@@ -149,7 +189,11 @@ func queryDatabase(userID int) (*SSUser, error) {
 			continue
 		}
 		user := new(SSUser)
-		row_err := rows.Scan(&user.UserID, &user.Password, &user.Status, &user.Bandwidth)
+		row_err := rows.Scan(&user.UserID, &user.Password, &user.Status, &user.Bandwidth,
+			&user.QuotaBytes, &user.QuotaPeriod, &user.QuotaAnchor, &user.OverQuotaBandwidth,
+			&user.MaxConnections, &user.MaxUDPSessions, &user.MaxIPs, &user.ACL,
+			&user.UploadBandwidth, &user.DownloadBandwidth, &user.BurstKB, &user.Group, &user.Weight,
+			&user.BandwidthPolicy)
 		if row_err != nil {
 			return nil, err
 		}
@@ -158,9 +202,40 @@ func queryDatabase(userID int) (*SSUser, error) {
 	return ret, nil
 }
 
+// Statistic Table Format:
+// table user_statistic (
+//    userid int
+//    bytes_in bigint
+//    bytes_out bigint
+//    connections bigint
+//    created_at datetime
+// )
+//
+func saveStatistics(table string, stats []ss.UserStatistic, at time.Time) error {
+	if len(stats) == 0 {
+		return nil
+	}
+	placeholders := make([]string, len(stats))
+	args := make([]interface{}, 0, len(stats)*5)
+	for i, stat := range stats {
+		placeholders[i] = "(?, ?, ?, ?, ?)"
+		args = append(args, stat.UserID, stat.BytesIn, stat.BytesOut, stat.Connections, at)
+	}
+	sql := fmt.Sprintf("INSERT INTO %s (userid, bytes_in, bytes_out, connections, created_at) VALUES %s;", table, strings.Join(placeholders, ", "))
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	if _, err = tx.Exec(sql, args...); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
 type License struct {
-	FingerPrint string
-	License     string
+	FingerPrint string `json:"fingerprint"`
+	License     string `json:"license"`
 }
 
 func loadLicense() (*License, error) {
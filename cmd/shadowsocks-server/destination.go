@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+
+	ss "github.com/shadowsocks/shadowsocks-go/shadowsocks"
+)
+
+var resolver *ss.Resolver
+
+// privateAllowList holds the private networks clients may reach.
+var privateAllowList []*net.IPNet
+
+func initPrivateAllowList() error {
+	privateAllowList = nil
+	for _, s := range config.PrivateAllowList {
+		_, ipnet, err := net.ParseCIDR(s)
+		if err != nil {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return fmt.Errorf("private_allow_list: invalid network %s", s)
+			}
+			if ip4 := ip.To4(); ip4 != nil {
+				ip = ip4
+			}
+			ipnet = &net.IPNet{IP: ip, Mask: net.CIDRMask(len(ip)*8, len(ip)*8)}
+		}
+		privateAllowList = append(privateAllowList, ipnet)
+	}
+	return nil
+}
+
+// blockPrivate tells whether ip is a private, loopback, link-local or
+// multicast address clients may not reach. Without this a client could reach
+// the statistic server on 127.0.0.1 or the metadata service of the cloud
+// provider.
+func blockPrivate(ip net.IP) bool {
+	if config.AllowPrivateDestinations || !ss.IsPrivateIP(ip) {
+		return false
+	}
+	for _, ipnet := range privateAllowList {
+		if ipnet.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// checkDestination applies the private network check, the black list and
+// the ACL policy of the user to a destination. ip is the address host
+// resolved to, or nil. It returns why the destination is rejected, or "".
+func checkDestination(proto string, policy *aclPolicy, host string, ip net.IP, port int) string {
+	if literal := net.ParseIP(host); literal != nil {
+		ip = literal
+	}
+	if ip != nil && blockPrivate(ip) {
+		privateRejections.Inc(proto)
+		return "private address " + ip.String()
+	}
+	if rule := CheckBlackList(host, ip, port); rule != nil {
+		blackListRejections.Inc(proto)
+		return "black list rule " + rule.Text
+	}
+	if reason := policy.check(host, ip, port); reason != "" {
+		aclRejections.Inc(proto, policy.name)
+		return "acl " + policy.name + ": " + reason
+	}
+	return ""
+}
+
+// checkTCPDestination checks the target of a TCP request and returns the
+// address to connect to, or why the target is rejected. Domains are resolved
+// here and the resolved address is what we connect to, so a domain can't
+// resolve to a blocked address after the check (DNS rebinding).
+func checkTCPDestination(policy *aclPolicy, target string) (addr, reject string, err error) {
+	host, portStr, err := net.SplitHostPort(target)
+	if err != nil {
+		return "", "", err
+	}
+	port, _ := strconv.Atoi(portStr)
+	var ip net.IP
+	if net.ParseIP(host) == nil {
+		if ip, err = resolver.ResolveIP(host); err != nil {
+			return "", "", err
+		}
+	}
+	if reject = checkDestination("tcp", policy, host, ip, port); reject != "" {
+		return "", reject, nil
+	}
+	if ip != nil {
+		return net.JoinHostPort(ip.String(), portStr), "", nil
+	}
+	return target, "", nil
+}
+
+// udpDestinationFilter returns the ss.UDPConn DestinationFilter for a user.
+func udpDestinationFilter(userID int, policy *aclPolicy) func(host string, dst *net.UDPAddr) bool {
+	return func(host string, dst *net.UDPAddr) bool {
+		if reject := checkDestination("udp", policy, host, dst.IP, dst.Port); reject != "" {
+			ss.UDPLog.Debug("target rejected", "user", userID, "target", dst, "reason", reject)
+			return false
+		}
+		return true
+	}
+}
@@ -6,13 +6,19 @@ import (
 	"crypto/sha256"
 	"encoding/asn1"
 	"encoding/base64"
+	"encoding/json"
 	"errors"
+	"flag"
 	"fmt"
+	"io/ioutil"
 	"os"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
 	"time"
+
+	ss "github.com/shadowsocks/shadowsocks-go/shadowsocks"
 )
 
 var LicenseLimit *LicenseConfig
@@ -25,41 +31,141 @@ func GetLicenseLimit() *LicenseConfig {
 }
 
 func UpdateLicenseLimit(license *License) {
-	cfg, err := VerifyLicense(license)
-	if err != nil {
-		cfg = &LicenseConfig{}
+	cfg := &LicenseConfig{}
+	if license != nil {
+		if vcfg, err := VerifyLicense(license); err == nil {
+			cfg = vcfg
+		}
 	}
 	LLock.Lock()
 	LicenseLimit = cfg
 	LLock.Unlock()
 }
 
-func LicenseChecker(initial *License) {
-	var last *License = initial
-	for {
-		time.Sleep(60 * time.Second)
-		license, err := loadLicense()
-		if err != nil {
-			fmt.Println("Cannot Load License Exit!")
-			os.Exit(1)
+const (
+	licenseEnv            = "SS_LICENSE"
+	licenseFingerPrintEnv = "SS_LICENSE_FINGERPRINT"
+	licenseCheckInterval  = 60 * time.Second
+	defaultLicenseGrace   = 24 * time.Hour
+)
+
+type licenseLoader func() (*License, error)
+
+// getLicenseLoader picks the license source. The license_file option wins,
+// then the SS_LICENSE environment variable, then the db_license table.
+func getLicenseLoader() (licenseLoader, error) {
+	if config.LicenseFile != "" {
+		return func() (*License, error) {
+			return loadLicenseFromFile(config.LicenseFile)
+		}, nil
+	}
+	if os.Getenv(licenseEnv) != "" {
+		return loadLicenseFromEnv, nil
+	}
+	if config.UseDatabase {
+		return func() (*License, error) {
+			license, err := loadLicense()
+			if err == nil && license == nil {
+				err = errors.New("no license in db_license table")
+			}
+			return license, err
+		}, nil
+	}
+	return nil, errors.New("no license source, set license_file, " + licenseEnv + " or use_database")
+}
+
+// The license file is a json object with "fingerprint" and "license" keys,
+// the same two columns as the db_license table.
+func loadLicenseFromFile(path string) (*License, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	license := &License{}
+	if err = json.Unmarshal(data, license); err != nil {
+		return nil, fmt.Errorf("parse license file %s: %v", path, err)
+	}
+	if license.License == "" {
+		return nil, fmt.Errorf("license file %s does not have license", path)
+	}
+	return license, nil
+}
+
+func loadLicenseFromEnv() (*License, error) {
+	license := &License{
+		FingerPrint: os.Getenv(licenseFingerPrintEnv),
+		License:     os.Getenv(licenseEnv),
+	}
+	if license.License == "" {
+		return nil, errors.New(licenseEnv + " is empty")
+	}
+	return license, nil
+}
+
+func getLicenseGracePeriod() time.Duration {
+	if config.LicenseGracePeriod > 0 {
+		return time.Duration(config.LicenseGracePeriod) * time.Second
+	}
+	return defaultLicenseGrace
+}
+
+// licenseState is what LicenseChecker keeps between reloads: the license in
+// use and since when the source can't be read.
+type licenseState struct {
+	last        *License
+	failedSince time.Time
+}
+
+// reload loads the license with load at now and applies it. When the source
+// is not reachable the last license is kept for the grace period, after that
+// the server is treated as unlicensed until the source comes back.
+func (s *licenseState) reload(load licenseLoader, now time.Time) {
+	license, err := load()
+	if err != nil {
+		if s.failedSince.IsZero() {
+			s.failedSince = now
 		}
-		if license.License == last.License {
-			continue
+		if now.Sub(s.failedSince) < getLicenseGracePeriod() {
+			ss.LicenseLog.Warn("cannot reload license, keep using the last one", "err", err)
+			return
 		}
-		last = license
-		UpdateLicenseLimit(license)
-		lcfg := GetLicenseLimit()
-		if lcfg.IsExpired() {
-			fmt.Println("License is Expired!")
-		} else {
-			fmt.Println("License is Reloaded,")
+		if s.last != nil {
+			ss.LicenseLog.Error("cannot reload license, grace period is over", "since", s.failedSince, "err", err)
+			s.last = nil
+			UpdateLicenseLimit(nil)
 		}
-		fmt.Printf("Expire: %v, Max Users: %d, Max Servers: %d, Max Bandwidth: %d\n", lcfg.Expire, lcfg.MaxUsers, lcfg.MaxServers, lcfg.MaxBandwidth)
+		return
+	}
+	s.failedSince = time.Time{}
+	if s.last != nil && license.License == s.last.License && license.FingerPrint == s.last.FingerPrint {
+		return
+	}
+	s.last = license
+	UpdateLicenseLimit(license)
+	lcfg := GetLicenseLimit()
+	msg := "license reloaded"
+	if lcfg.IsExpired() {
+		msg = "license is expired"
+	}
+	ss.LicenseLog.Info(msg, "expire", lcfg.Expire, "max_users", lcfg.MaxUsers,
+		"max_servers", lcfg.MaxServers, "max_bandwidth", lcfg.MaxBandwidth)
+}
+
+// LicenseChecker reloads the license periodically.
+func LicenseChecker(load licenseLoader, initial *License) {
+	state := &licenseState{last: initial}
+	for {
+		time.Sleep(licenseCheckInterval)
+		state.reload(load, time.Now())
 	}
 }
 
 func initLicense() error {
-	license, err := loadLicense()
+	load, err := getLicenseLoader()
+	if err != nil {
+		return err
+	}
+	license, err := load()
 	if err != nil {
 		return err
 	}
@@ -68,15 +174,18 @@ func initLicense() error {
 		cfg = &LicenseConfig{}
 	}
 	LicenseLimit = cfg
-	go LicenseChecker(license)
+	go LicenseChecker(load, license)
 	return nil
 }
 
 type LicenseConfig struct {
 	Expire       time.Time
 	MaxBandwidth int
-	MaxUsers     int
-	MaxServers   int
+	// Per direction caps, 0 means MaxBandwidth.
+	MaxUploadBandwidth   int
+	MaxDownloadBandwidth int
+	MaxUsers             int
+	MaxServers           int
 }
 
 func (c *LicenseConfig) IsExpired() bool {
@@ -106,6 +215,20 @@ func createLicenseConfig(data map[string]string) *LicenseConfig {
 			ret.MaxBandwidth = imax_bw
 		}
 	}
+	max_up_bw, have := data["maxupbw"]
+	if have {
+		imax_up_bw, err := strconv.Atoi(max_up_bw)
+		if err == nil {
+			ret.MaxUploadBandwidth = imax_up_bw
+		}
+	}
+	max_down_bw, have := data["maxdownbw"]
+	if have {
+		imax_down_bw, err := strconv.Atoi(max_down_bw)
+		if err == nil {
+			ret.MaxDownloadBandwidth = imax_down_bw
+		}
+	}
 	expire, have := data["expire"]
 	if have {
 		texpire, err := ParseDate(expire)
@@ -140,26 +263,34 @@ func parseConfig(data string) map[string]string {
 	return ret
 }
 
-func VerifyLicense(license *License) (*LicenseConfig, error) {
-	dlicense, err := base64.StdEncoding.DecodeString(license.License)
+// decodeLicense splits a license string into its config and RSA sign.
+func decodeLicense(license string) (string, []byte, error) {
+	dlicense, err := base64.StdEncoding.DecodeString(license)
 	if err != nil {
-		return nil, err
+		return "", nil, err
 	}
 	cscfg := parseConfig(string(dlicense))
 	config, have := cscfg["config"]
 	if !have {
-		return nil, errors.New("Do not have config")
+		return "", nil, errors.New("Do not have config")
 	}
 	dconfig, err := base64.StdEncoding.DecodeString(config)
 	if err != nil {
-		return nil, err
+		return "", nil, err
 	}
-	config = string(dconfig)
 	sign, have := cscfg["sign"]
 	if !have {
-		return nil, errors.New("Do not have sign")
+		return "", nil, errors.New("Do not have sign")
 	}
 	dsign, err := base64.StdEncoding.DecodeString(sign)
+	if err != nil {
+		return "", nil, err
+	}
+	return string(dconfig), dsign, nil
+}
+
+func VerifyLicense(license *License) (*LicenseConfig, error) {
+	config, dsign, err := decodeLicense(license.License)
 	if err != nil {
 		return nil, err
 	}
@@ -200,3 +331,68 @@ LclgkDFsEMY/3Ytfeiiz0mV4nqKdUMsAfQIDAQAB`
 	}
 	return pubKey
 }
+
+// runLicenseCommand implements "shadowsocks-server license", which decodes
+// a license string, prints what it contains and verifies it for the given
+// fingerprint. The fingerprint is not computed here, it is only checked
+// against the sign of the license.
+func runLicenseCommand(args []string) int {
+	var fingerPrint, licenseFile string
+	fs := flag.NewFlagSet("license", flag.ExitOnError)
+	fs.StringVar(&fingerPrint, "fingerprint", os.Getenv(licenseFingerPrintEnv), "fingerprint the license is issued for")
+	fs.StringVar(&licenseFile, "f", "", "read license and fingerprint from license file")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s license [-fingerprint fp] [-f file] [license]\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	license := &License{FingerPrint: fingerPrint}
+	switch {
+	case fs.NArg() > 0:
+		license.License = fs.Arg(0)
+	case licenseFile != "":
+		flicense, err := loadLicenseFromFile(licenseFile)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		license = flicense
+		if fingerPrint != "" {
+			license.FingerPrint = fingerPrint
+		}
+	default:
+		license.License = os.Getenv(licenseEnv)
+	}
+	if license.License == "" {
+		fs.Usage()
+		return 2
+	}
+
+	config, _, err := decodeLicense(license.License)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Cannot decode license: %v\n", err)
+		return 1
+	}
+	fields := parseConfig(config)
+	keys := make([]string, 0, len(fields))
+	for k := range fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Printf("  %s: %s\n", k, fields[k])
+	}
+	lcfg, err := VerifyLicense(license)
+	if err != nil {
+		fmt.Printf("License is Invalid for fingerprint %q: %v\n", license.FingerPrint, err)
+		return 1
+	}
+	if lcfg.IsExpired() {
+		fmt.Printf("License is Expired, issued for fingerprint %q\n", license.FingerPrint)
+	} else {
+		fmt.Printf("License is Valid for fingerprint %q\n", license.FingerPrint)
+	}
+	fmt.Printf("Expire: %v, Max Users: %d, Max Servers: %d, Max Bandwidth: %d\n", lcfg.Expire, lcfg.MaxUsers, lcfg.MaxServers, lcfg.MaxBandwidth)
+	return 0
+}
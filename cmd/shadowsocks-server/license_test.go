@@ -0,0 +1,97 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	ss "github.com/shadowsocks/shadowsocks-go/shadowsocks"
+)
+
+func TestGetLicenseLoader(t *testing.T) {
+	dir, err := ioutil.TempDir("", "license")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "license.json")
+	if err := ioutil.WriteFile(file, []byte(`{"fingerprint": "file-fp", "license": "from-file"}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Unsetenv(licenseEnv)
+	defer os.Unsetenv(licenseFingerPrintEnv)
+
+	tests := []struct {
+		name    string
+		cfg     ss.Config
+		env     string
+		want    string // license loaded, "" for the database
+		wantErr bool
+	}{
+		{"file first", ss.Config{LicenseFile: file, UseDatabase: true}, "from-env", "from-file", false},
+		{"env before database", ss.Config{UseDatabase: true}, "from-env", "from-env", false},
+		{"database", ss.Config{UseDatabase: true}, "", "", false},
+		{"no source", ss.Config{}, "", "", true},
+	}
+	for _, test := range tests {
+		cfg := test.cfg
+		config = &cfg
+		os.Setenv(licenseEnv, test.env)
+		os.Setenv(licenseFingerPrintEnv, "env-fp")
+		load, err := getLicenseLoader()
+		if (err != nil) != test.wantErr {
+			t.Errorf("%s: got error %v", test.name, err)
+			continue
+		}
+		if err != nil || test.want == "" {
+			continue
+		}
+		license, err := load()
+		if err != nil || license.License != test.want {
+			t.Errorf("%s: loaded %+v %v, want %s", test.name, license, err, test.want)
+		}
+	}
+
+	config = &ss.Config{LicenseFile: filepath.Join(dir, "missing.json")}
+	load, err := getLicenseLoader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := load(); err == nil {
+		t.Error("missing license file should fail to load")
+	}
+}
+
+func TestLicenseGracePeriod(t *testing.T) {
+	config = &ss.Config{LicenseGracePeriod: 3600}
+	grace := time.Hour
+	saved := LicenseLimit
+	LicenseLimit = &LicenseConfig{MaxUsers: 5}
+	defer func() { LicenseLimit = saved }()
+	state := &licenseState{last: &License{License: "last"}}
+	failing := func() (*License, error) { return nil, errors.New("unreachable") }
+
+	start := time.Now()
+	state.reload(failing, start)
+	state.reload(failing, start.Add(grace-time.Nanosecond))
+	if state.last == nil || GetLicenseLimit().MaxUsers != 5 {
+		t.Fatal("the last license should be kept within the grace period")
+	}
+	state.reload(failing, start.Add(grace))
+	if state.last != nil || GetLicenseLimit().MaxUsers != 0 {
+		t.Error("the license should be dropped once the grace period is over")
+	}
+
+	// The source coming back starts a new grace period for the next failure.
+	state.reload(func() (*License, error) { return &License{License: "back"}, nil }, start.Add(2*grace))
+	if state.last == nil || !state.failedSince.IsZero() {
+		t.Fatalf("reloaded license should be used, got %+v", state)
+	}
+	state.reload(failing, start.Add(3*grace))
+	if !state.failedSince.Equal(start.Add(3 * grace)) {
+		t.Errorf("failure should count from %v, got %v", start.Add(3*grace), state.failedSince)
+	}
+}
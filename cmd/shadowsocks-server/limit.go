@@ -0,0 +1,190 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	ss "github.com/shadowsocks/shadowsocks-go/shadowsocks"
+)
+
+var (
+	errTooManyConnections = errors.New("too many connections")
+	errTooManyUDPSessions = errors.New("too many udp sessions")
+	errTooManyIPs         = errors.New("too many client ips")
+)
+
+// A client ip stays counted while it has tcp connections open or has sent
+// udp packets within the udp session timeout.
+type ipUsage struct {
+	tcp     int
+	lastUDP time.Time
+}
+
+type userUsage struct {
+	tcp int
+	udp map[string]time.Time // client address -> last packet
+	ips map[string]*ipUsage
+}
+
+// ConnLimiter enforces the per user limits of concurrent tcp connections,
+// udp sessions and distinct client ips.
+type ConnLimiter struct {
+	lock       sync.Mutex
+	users      map[int]*userUsage
+	udpTimeout time.Duration
+}
+
+var limiter *ConnLimiter
+
+func initLimiter() {
+	udpTimeout := time.Duration(config.Timeout) * time.Second
+	if udpTimeout == 0 {
+		udpTimeout = 60 * time.Second
+	}
+	limiter = &ConnLimiter{
+		users:      make(map[int]*userUsage),
+		udpTimeout: udpTimeout,
+	}
+	go limiter.run()
+}
+
+func userLimit(limit, defaultLimit int) int {
+	if limit != 0 {
+		return limit
+	}
+	return defaultLimit
+}
+
+func exceeds(count, limit int) bool {
+	return limit > 0 && count >= limit
+}
+
+func (l *ConnLimiter) getUsage(userID int) *userUsage {
+	usage, have := l.users[userID]
+	if !have {
+		usage = &userUsage{
+			udp: make(map[string]time.Time),
+			ips: make(map[string]*ipUsage),
+		}
+		l.users[userID] = usage
+	}
+	return usage
+}
+
+// checkIP reports whether ip is already counted for the user or there is room
+// for one more. Must be called with lock held.
+func (l *ConnLimiter) checkIP(user *SSUser, usage *userUsage, ip string, now time.Time) error {
+	if _, have := usage.ips[ip]; have {
+		return nil
+	}
+	l.expire(usage, now)
+	if exceeds(len(usage.ips), userLimit(user.MaxIPs, config.MaxIPsPerUser)) {
+		return errTooManyIPs
+	}
+	return nil
+}
+
+// AcquireTCP counts a new tcp connection from ip for user. The caller must
+// call ReleaseTCP once the connection is closed.
+func (l *ConnLimiter) AcquireTCP(user *SSUser, ip string) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	usage := l.getUsage(user.UserID)
+	if exceeds(usage.tcp, userLimit(user.MaxConnections, config.MaxConnectionsPerUser)) {
+		return l.reject(user, errTooManyConnections)
+	}
+	if err := l.checkIP(user, usage, ip, time.Now()); err != nil {
+		return l.reject(user, err)
+	}
+	usage.tcp++
+	ipu, have := usage.ips[ip]
+	if !have {
+		ipu = &ipUsage{}
+		usage.ips[ip] = ipu
+	}
+	ipu.tcp++
+	return nil
+}
+
+func (l *ConnLimiter) ReleaseTCP(userID int, ip string) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	usage, have := l.users[userID]
+	if !have {
+		return
+	}
+	usage.tcp--
+	if ipu, have := usage.ips[ip]; have {
+		ipu.tcp--
+	}
+	l.expire(usage, time.Now())
+	if usage.tcp <= 0 && len(usage.udp) == 0 && len(usage.ips) == 0 {
+		delete(l.users, userID)
+	}
+}
+
+// TouchUDP counts a udp packet from src for user. A new client address
+// starts a udp session, which lasts until it has been idle for the udp
+// timeout.
+func (l *ConnLimiter) TouchUDP(user *SSUser, src *net.UDPAddr) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	now := time.Now()
+	usage := l.getUsage(user.UserID)
+	addr := src.String()
+	ip := src.IP.String()
+	if _, have := usage.udp[addr]; !have {
+		l.expire(usage, now)
+		if exceeds(len(usage.udp), userLimit(user.MaxUDPSessions, config.MaxUDPSessionsPerUser)) {
+			return l.reject(user, errTooManyUDPSessions)
+		}
+		if err := l.checkIP(user, usage, ip, now); err != nil {
+			return l.reject(user, err)
+		}
+	}
+	usage.udp[addr] = now
+	ipu, have := usage.ips[ip]
+	if !have {
+		ipu = &ipUsage{}
+		usage.ips[ip] = ipu
+	}
+	ipu.lastUDP = now
+	return nil
+}
+
+func (l *ConnLimiter) reject(user *SSUser, err error) error {
+	ss.GetUserStatisticService().IncRejections(uint32(user.UserID))
+	return err
+}
+
+// expire drops idle udp sessions and client ips that are no longer in use.
+// Must be called with lock held.
+func (l *ConnLimiter) expire(usage *userUsage, now time.Time) {
+	for addr, last := range usage.udp {
+		if now.Sub(last) > l.udpTimeout {
+			delete(usage.udp, addr)
+		}
+	}
+	for ip, ipu := range usage.ips {
+		if ipu.tcp <= 0 && now.Sub(ipu.lastUDP) > l.udpTimeout {
+			delete(usage.ips, ip)
+		}
+	}
+}
+
+func (l *ConnLimiter) run() {
+	for {
+		time.Sleep(l.udpTimeout)
+		now := time.Now()
+		l.lock.Lock()
+		for userID, usage := range l.users {
+			l.expire(usage, now)
+			if usage.tcp <= 0 && len(usage.udp) == 0 && len(usage.ips) == 0 {
+				delete(l.users, userID)
+			}
+		}
+		l.lock.Unlock()
+	}
+}
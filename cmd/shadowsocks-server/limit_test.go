@@ -0,0 +1,155 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	ss "github.com/shadowsocks/shadowsocks-go/shadowsocks"
+)
+
+// newTestLimiter returns a ConnLimiter with the server wide limits of cfg.
+// It is not running, idle udp sessions expire when the limits are checked.
+func newTestLimiter(cfg *ss.Config, udpTimeout time.Duration) *ConnLimiter {
+	config = cfg
+	ss.CreateUserStatisticService()
+	return &ConnLimiter{users: make(map[int]*userUsage), udpTimeout: udpTimeout}
+}
+
+func TestConnLimiterTCP(t *testing.T) {
+	tests := []struct {
+		name string
+		user SSUser
+		cfg  ss.Config
+		ips  []string
+		want []error
+	}{
+		{"connections", SSUser{MaxConnections: 2}, ss.Config{},
+			[]string{"a", "a", "a"}, []error{nil, nil, errTooManyConnections}},
+		{"default connections", SSUser{}, ss.Config{MaxConnectionsPerUser: 1},
+			[]string{"a", "a"}, []error{nil, errTooManyConnections}},
+		{"user over default connections", SSUser{MaxConnections: 3}, ss.Config{MaxConnectionsPerUser: 1},
+			[]string{"a", "a", "a"}, []error{nil, nil, nil}},
+		{"unlimited connections", SSUser{}, ss.Config{},
+			[]string{"a", "a", "a", "a"}, []error{nil, nil, nil, nil}},
+		{"ips", SSUser{MaxIPs: 2}, ss.Config{},
+			[]string{"a", "b", "c", "a"}, []error{nil, nil, errTooManyIPs, nil}},
+		{"default ips", SSUser{}, ss.Config{MaxIPsPerUser: 1},
+			[]string{"a", "b", "a"}, []error{nil, errTooManyIPs, nil}},
+		{"unlimited ips", SSUser{}, ss.Config{},
+			[]string{"a", "b", "c"}, []error{nil, nil, nil}},
+	}
+	for _, test := range tests {
+		cfg := test.cfg
+		l := newTestLimiter(&cfg, time.Minute)
+		for i, ip := range test.ips {
+			if err := l.AcquireTCP(&test.user, ip); err != test.want[i] {
+				t.Errorf("%s: connection %d from %s: got %v, want %v", test.name, i, ip, err, test.want[i])
+			}
+		}
+	}
+}
+
+func TestConnLimiterReleaseTCP(t *testing.T) {
+	l := newTestLimiter(&ss.Config{}, time.Minute)
+	user := &SSUser{UserID: 1, MaxConnections: 1, MaxIPs: 1}
+	if err := l.AcquireTCP(user, "a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.AcquireTCP(user, "a"); err != errTooManyConnections {
+		t.Errorf("got %v, want %v", err, errTooManyConnections)
+	}
+	l.ReleaseTCP(1, "a")
+	if _, have := l.users[1]; have {
+		t.Error("user without connections should be forgotten")
+	}
+	// The ip of the released connection no longer counts.
+	if err := l.AcquireTCP(user, "b"); err != nil {
+		t.Errorf("connection after release: %v", err)
+	}
+	if n := ss.GetUserStatisticService().Get(1).Rejections; n != 1 {
+		t.Errorf("rejections %d, want 1", n)
+	}
+}
+
+func TestConnLimiterUDP(t *testing.T) {
+	addr := func(ip string, port int) *net.UDPAddr {
+		return &net.UDPAddr{IP: net.ParseIP(ip), Port: port}
+	}
+	a1, a2, a3 := addr("192.0.2.1", 1), addr("192.0.2.1", 2), addr("192.0.2.1", 3)
+	b1 := addr("192.0.2.2", 1)
+	tests := []struct {
+		name string
+		user SSUser
+		cfg  ss.Config
+		srcs []*net.UDPAddr
+		want []error
+	}{
+		{"sessions", SSUser{MaxUDPSessions: 2}, ss.Config{},
+			[]*net.UDPAddr{a1, a2, a3, a1}, []error{nil, nil, errTooManyUDPSessions, nil}},
+		{"default sessions", SSUser{}, ss.Config{MaxUDPSessionsPerUser: 1},
+			[]*net.UDPAddr{a1, a2, a1}, []error{nil, errTooManyUDPSessions, nil}},
+		{"unlimited sessions", SSUser{}, ss.Config{},
+			[]*net.UDPAddr{a1, a2, a3, b1}, []error{nil, nil, nil, nil}},
+		{"ips", SSUser{MaxIPs: 1}, ss.Config{},
+			[]*net.UDPAddr{a1, a2, b1}, []error{nil, nil, errTooManyIPs}},
+		{"default ips", SSUser{}, ss.Config{MaxIPsPerUser: 1},
+			[]*net.UDPAddr{a1, b1}, []error{nil, errTooManyIPs}},
+	}
+	for _, test := range tests {
+		cfg := test.cfg
+		l := newTestLimiter(&cfg, time.Minute)
+		for i, src := range test.srcs {
+			if err := l.TouchUDP(&test.user, src); err != test.want[i] {
+				t.Errorf("%s: packet %d from %s: got %v, want %v", test.name, i, src, err, test.want[i])
+			}
+		}
+	}
+}
+
+func TestConnLimiterUDPExpiry(t *testing.T) {
+	l := newTestLimiter(&ss.Config{}, 50*time.Millisecond)
+	user := &SSUser{UserID: 1, MaxUDPSessions: 1, MaxIPs: 1}
+	a1 := &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 1}
+	a2 := &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 2}
+	if err := l.TouchUDP(user, a1); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.TouchUDP(user, a2); err != errTooManyUDPSessions {
+		t.Errorf("got %v, want %v", err, errTooManyUDPSessions)
+	}
+	if err := l.AcquireTCP(user, "192.0.2.2"); err != errTooManyIPs {
+		t.Errorf("got %v, want %v", err, errTooManyIPs)
+	}
+	time.Sleep(100 * time.Millisecond)
+	// The idle session and its ip are gone.
+	if err := l.TouchUDP(user, a2); err != nil {
+		t.Errorf("session after the idle one expired: %v", err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if err := l.AcquireTCP(user, "192.0.2.2"); err != nil {
+		t.Errorf("connection after the udp sessions expired: %v", err)
+	}
+}
+
+func TestUoTCountsAsUDPSession(t *testing.T) {
+	limiter = newTestLimiter(&ss.Config{AllowPrivateDestinations: true}, time.Minute)
+	defer func() { limiter = nil }()
+	user := &SSUser{UserID: 1, MaxUDPSessions: 1, MaxIPs: 1}
+	dst := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 53}
+	stream := uotRelay(user, nil, &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 5000})
+	// All packets of a stream are one session.
+	for i := 0; i < 3; i++ {
+		if !stream.DestinationFilter("127.0.0.1", dst) {
+			t.Fatalf("packet %d of the stream rejected", i)
+		}
+	}
+	other := uotRelay(user, nil, &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 5001})
+	if other.DestinationFilter("127.0.0.1", dst) {
+		t.Error("a second stream should be over max_udp_sessions")
+	}
+	// The ip of the stream counts for max_ips.
+	if err := limiter.AcquireTCP(user, "192.0.2.2"); err != errTooManyIPs {
+		t.Errorf("got %v, want %v", err, errTooManyIPs)
+	}
+}
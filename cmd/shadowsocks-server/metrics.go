@@ -0,0 +1,334 @@
+package main
+
+// Metrics in the Prometheus text exposition format, served at /metrics of
+// the statistic server. The format is simple enough that we write it by hand
+// instead of pulling in the client library.
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	ss "github.com/shadowsocks/shadowsocks-go/shadowsocks"
+)
+
+const defaultMetricsMaxUsers = 1000
+
+// Handshake failure reasons
+const (
+	failLicense = "license_expired"
+	failUserID  = "read_user_id"
+	failNoUser  = "unknown_user"
+	failQuota   = "over_quota"
+	failLimit   = "limit"
+	failACL     = "acl"
+	failCipher  = "cipher"
+	failRequest = "bad_request"
+	failOTA     = "ota_auth"
+	failDecrypt = "decrypt"
+)
+
+var (
+	activeTCPConns int64
+
+	handshakeFailures = newCounterVec("ss_handshake_failures_total",
+		"Connections and packets dropped before relaying, by reason.", "proto", "reason")
+	blackListRejections = newCounterVec("ss_blacklist_rejections_total",
+		"Requests rejected by the black list.", "proto")
+	privateRejections = newCounterVec("ss_private_rejections_total",
+		"Requests to private, loopback, link-local and multicast addresses rejected.", "proto")
+	aclRejections = newCounterVec("ss_acl_rejections_total",
+		"Requests rejected by the ACL policy of the user.", "proto", "policy")
+	dialErrors = newCounterVec("ss_dial_errors_total",
+		"Failed connections to the target host.")
+	dialDuration = newHistogram("ss_dial_duration_seconds",
+		"Time to connect to the target host.",
+		[]float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10})
+
+	metricsUsers = &userLabels{users: make(map[uint32]bool)}
+)
+
+type counterVec struct {
+	name   string
+	help   string
+	labels []string
+
+	lock   sync.RWMutex
+	values map[string]*uint64
+	keys   map[string][]string
+}
+
+func newCounterVec(name, help string, labels ...string) *counterVec {
+	return &counterVec{
+		name:   name,
+		help:   help,
+		labels: labels,
+		values: make(map[string]*uint64),
+		keys:   make(map[string][]string),
+	}
+}
+
+func (c *counterVec) Inc(values ...string) {
+	key := strings.Join(values, "\xff")
+	c.lock.RLock()
+	v, have := c.values[key]
+	c.lock.RUnlock()
+	if !have {
+		c.lock.Lock()
+		if v, have = c.values[key]; !have {
+			v = new(uint64)
+			c.values[key] = v
+			c.keys[key] = values
+		}
+		c.lock.Unlock()
+	}
+	atomic.AddUint64(v, 1)
+}
+
+func (c *counterVec) write(w io.Writer) {
+	writeMetricHeader(w, c.name, c.help, "counter")
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	keys := make([]string, 0, len(c.values))
+	for k := range c.values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(w, "%s%s %d\n", c.name, formatLabels(c.labels, c.keys[k]), atomic.LoadUint64(c.values[k]))
+	}
+}
+
+type histogram struct {
+	name    string
+	help    string
+	buckets []float64
+
+	lock   sync.Mutex
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+func newHistogram(name, help string, buckets []float64) *histogram {
+	return &histogram{
+		name:    name,
+		help:    help,
+		buckets: buckets,
+		counts:  make([]uint64, len(buckets)),
+	}
+}
+
+func (h *histogram) Observe(v float64) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	for i, le := range h.buckets {
+		if v <= le {
+			h.counts[i]++
+		}
+	}
+	h.count++
+	h.sum += v
+}
+
+func (h *histogram) write(w io.Writer) {
+	writeMetricHeader(w, h.name, h.help, "histogram")
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	for i, le := range h.buckets {
+		fmt.Fprintf(w, "%s_bucket{le=\"%s\"} %d\n", h.name, formatFloat(le), h.counts[i])
+	}
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", h.name, h.count)
+	fmt.Fprintf(w, "%s_sum %s\n", h.name, formatFloat(h.sum))
+	fmt.Fprintf(w, "%s_count %d\n", h.name, h.count)
+}
+
+// userLabels picks the users exported with their own user label. Once a user
+// is picked it stays, so the series of a user and of "other" never go
+// backwards.
+type userLabels struct {
+	lock  sync.Mutex
+	users map[uint32]bool
+}
+
+func (u *userLabels) label(userID uint32, max int) string {
+	if max < 0 {
+		return "other"
+	}
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	if !u.users[userID] {
+		if len(u.users) >= max {
+			return "other"
+		}
+		u.users[userID] = true
+	}
+	return strconv.FormatUint(uint64(userID), 10)
+}
+
+func writeMetricHeader(w io.Writer, name, help, typ string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+func writeGauge(w io.Writer, name, help string, value float64) {
+	writeMetricHeader(w, name, help, "gauge")
+	fmt.Fprintf(w, "%s %s\n", name, formatFloat(value))
+}
+
+func writeCounter(w io.Writer, name, help string, value float64) {
+	writeMetricHeader(w, name, help, "counter")
+	fmt.Fprintf(w, "%s %s\n", name, formatFloat(value))
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatLabels(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		pairs[i] = fmt.Sprintf("%s=\"%s\"", name, labelEscaper.Replace(values[i]))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func writeUserMetrics(w io.Writer) {
+	max := config.MetricsMaxUsers
+	if max == 0 {
+		max = defaultMetricsMaxUsers
+	}
+	perUser := make(map[string]*ss.UserStatistic)
+	for userID, stat := range ss.GetUserStatisticMap() {
+		label := metricsUsers.label(userID, max)
+		sum, have := perUser[label]
+		if !have {
+			sum = &ss.UserStatistic{}
+			perUser[label] = sum
+		}
+		sum.BytesIn += stat.BytesIn
+		sum.BytesOut += stat.BytesOut
+		sum.Connections += stat.Connections
+		sum.Rejections += stat.Rejections
+	}
+	labels := make([]string, 0, len(perUser))
+	for label := range perUser {
+		labels = append(labels, label)
+	}
+	sort.Strings(labels)
+
+	families := []struct {
+		name  string
+		help  string
+		value func(*ss.UserStatistic) uint64
+	}{
+		{"ss_user_bytes_in_total", "Bytes received from the clients of a user.",
+			func(s *ss.UserStatistic) uint64 { return s.BytesIn }},
+		{"ss_user_bytes_out_total", "Bytes sent to the clients of a user.",
+			func(s *ss.UserStatistic) uint64 { return s.BytesOut }},
+		{"ss_user_connections_total", "TCP connections of a user.",
+			func(s *ss.UserStatistic) uint64 { return s.Connections }},
+		{"ss_user_rejections_total", "Connections and packets of a user rejected by limits or quota.",
+			func(s *ss.UserStatistic) uint64 { return s.Rejections }},
+	}
+	for _, f := range families {
+		writeMetricHeader(w, f.name, f.help, "counter")
+		for _, label := range labels {
+			fmt.Fprintf(w, "%s{user=\"%s\"} %d\n", f.name, label, f.value(perUser[label]))
+		}
+	}
+}
+
+func writeMetrics(w io.Writer) {
+	writeUserMetrics(w)
+	writeGauge(w, "ss_tcp_connections_active", "TCP connections being relayed.",
+		float64(atomic.LoadInt64(&activeTCPConns)))
+	nat := natTable.Stats()
+	writeGauge(w, "ss_udp_nat_entries", "Live UDP NAT entries.", float64(nat.Entries))
+	writeCounter(w, "ss_udp_nat_created_total", "UDP NAT entries created.", float64(nat.Created))
+	writeCounter(w, "ss_udp_nat_expired_total", "UDP NAT entries dropped for being idle.", float64(nat.Expired))
+	writeCounter(w, "ss_udp_nat_evicted_total", "UDP NAT entries dropped for the entry limits.", float64(nat.Evicted))
+	writeCounter(w, "ss_udp_nat_filtered_total", "UDP packets from peers the NAT mode doesn't let through.", float64(nat.Filtered))
+	writeCounter(w, "ss_udp_nat_dropped_total", "UDP replies dropped because the send queue of the client was full.", float64(nat.Dropped))
+	writeCounter(w, "ss_udp_nat_truncated_total", "UDP replies dropped for being larger than the buffer of their NAT entry, after udp_max_size was raised.", float64(nat.Truncated))
+	writeCounter(w, "ss_udp_nat_resolve_failures_total", "UDP domain targets that could not be resolved.", float64(nat.ResolveFailed))
+	writeCounter(w, "ss_udp_oversize_dropped_total", "UDP datagrams dropped for being over udp_max_size.", float64(ss.UDPOversizeDrops()))
+	writeCounter(w, "ss_udp_rate_limited_total", "UDP packets dropped for the bandwidth of their user.", float64(nat.RateLimited))
+	handshakeFailures.write(w)
+	blackListRejections.write(w)
+	writeBlackListHits(w)
+	privateRejections.write(w)
+	aclRejections.write(w)
+	hits, misses := resolver.CacheStats()
+	writeMetricHeader(w, "ss_dns_cache_lookups_total", "Domain lookups, by whether the cache answered.", "counter")
+	fmt.Fprintf(w, "ss_dns_cache_lookups_total{result=\"hit\"} %d\n", hits)
+	fmt.Fprintf(w, "ss_dns_cache_lookups_total{result=\"miss\"} %d\n", misses)
+	dialErrors.write(w)
+	dialDuration.write(w)
+
+	waits, waitTime := ss.BucketWaitStats()
+	writeCounter(w, "ss_bucket_waits_total", "Times a transfer waited for rate limit tokens.", float64(waits))
+	writeCounter(w, "ss_bucket_wait_seconds_total", "Time spent waiting for rate limit tokens.", waitTime.Seconds())
+
+	if lcfg := GetLicenseLimit(); lcfg != nil {
+		if !lcfg.Expire.IsZero() {
+			writeGauge(w, "ss_license_expire_timestamp_seconds", "Expire time of the license.",
+				float64(lcfg.Expire.Unix()))
+		}
+		expired := 0.0
+		if lcfg.IsExpired() {
+			expired = 1
+		}
+		writeGauge(w, "ss_license_expired", "Whether the license is expired or invalid.", expired)
+	}
+}
+
+// writeBlackListHits writes the hits of the black list rules by type and
+// action, a label per rule would grow with the list.
+func writeBlackListHits(w io.Writer) {
+	writeMetricHeader(w, "ss_blacklist_rule_hits_total", "Destinations matched by a black list rule, by rule type and action.", "counter")
+	list := getBlackList()
+	if list == nil {
+		return
+	}
+	hits := make(map[string]uint64)
+	for _, rule := range list.Rules() {
+		action := "block"
+		if rule.Allow {
+			action = "allow"
+		}
+		hits[rule.Type()+"\xff"+action] += rule.Hits()
+	}
+	keys := make([]string, 0, len(hits))
+	for key := range hits {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		fmt.Fprintf(w, "ss_blacklist_rule_hits_total%s %d\n",
+			formatLabels([]string{"type", "action"}, strings.Split(key, "\xff")), hits[key])
+	}
+}
+
+func processMetricsRequest(writer http.ResponseWriter, request *http.Request) {
+	defer request.Body.Close()
+	writer.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	writeMetrics(writer)
+}
+
+func observeDial(start time.Time, err error) {
+	if err != nil {
+		dialErrors.Inc()
+		return
+	}
+	dialDuration.Observe(time.Since(start).Seconds())
+}
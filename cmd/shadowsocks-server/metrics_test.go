@@ -0,0 +1,39 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"testing"
+
+	ss "github.com/shadowsocks/shadowsocks-go/shadowsocks"
+)
+
+func TestBlackListHits(t *testing.T) {
+	list, err := ss.ParseRules(strings.NewReader("example.com\nexample.org\nport:25\n@@domain:ok.example.com\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	blackListLock.Lock()
+	blackList = list
+	blackListLock.Unlock()
+	defer func() {
+		blackListLock.Lock()
+		blackList = nil
+		blackListLock.Unlock()
+	}()
+	for _, host := range []string{"www.example.com", "example.org", "ok.example.com"} {
+		CheckBlackList(host, nil, 443)
+	}
+	CheckBlackList("mail.example.net", net.ParseIP("192.0.2.1"), 25)
+
+	var b bytes.Buffer
+	writeBlackListHits(&b)
+	want := `ss_blacklist_rule_hits_total{type="domain",action="allow"} 1
+ss_blacklist_rule_hits_total{type="domain",action="block"} 2
+ss_blacklist_rule_hits_total{type="port",action="block"} 1
+`
+	if got := b.String(); !strings.HasSuffix(got, want) {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+}
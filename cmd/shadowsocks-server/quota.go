@@ -0,0 +1,260 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	ss "github.com/shadowsocks/shadowsocks-go/shadowsocks"
+)
+
+const (
+	quotaPeriodDaily   = "daily"
+	quotaPeriodMonthly = "monthly"
+
+	quotaCheckInterval = 10 * time.Second
+)
+
+type quotaState int
+
+const (
+	quotaOK quotaState = iota
+	quotaThrottled
+	quotaExhausted
+)
+
+// quotaUsage is the transfer of one user in the current quota period. It is
+// what we save to the quota state file.
+type quotaUsage struct {
+	PeriodStart time.Time `json:"period_start"`
+	Bytes       uint64    `json:"bytes"`
+}
+
+// QuotaManager charges the traffic counted by UserStatisticService to the
+// quota period of each user and keeps the usage in a state file, so that it
+// survives restarts.
+type QuotaManager struct {
+	lock      sync.Mutex
+	stateFile string
+	cutActive bool
+	usage     map[int]*quotaUsage
+	users     map[int]*SSUser
+	states    map[int]quotaState
+	collector *ss.StatisticCollector
+	dirty     bool
+
+	writeBucketCache *LRU
+	readBucketCache  *LRU
+}
+
+var quota *QuotaManager
+
+func initQuota(writeBucketCache, readBucketCache *LRU) {
+	stateFile := config.QuotaStateFile
+	if stateFile == "" {
+		stateFile = filepath.Join(filepath.Dir(configFile), "quota.json")
+	}
+	quota = &QuotaManager{
+		stateFile:        stateFile,
+		cutActive:        config.QuotaCutActive,
+		usage:            make(map[int]*quotaUsage),
+		users:            make(map[int]*SSUser),
+		states:           make(map[int]quotaState),
+		collector:        ss.GetUserStatisticService().NewCollector(),
+		writeBucketCache: writeBucketCache,
+		readBucketCache:  readBucketCache,
+	}
+	if err := quota.load(); err != nil && !os.IsNotExist(err) {
+		serverLog.Error("cannot read quota state", "file", stateFile, "err", err)
+	}
+	go quota.run()
+}
+
+// quotaPeriodStart returns the start of the quota period now is in. anchor is
+// the hour of day for daily periods and the day of month for monthly ones.
+func quotaPeriodStart(now time.Time, period string, anchor int) time.Time {
+	switch period {
+	case quotaPeriodDaily:
+		if anchor < 0 || anchor > 23 {
+			anchor = 0
+		}
+		start := time.Date(now.Year(), now.Month(), now.Day(), anchor, 0, 0, 0, now.Location())
+		if now.Before(start) {
+			start = start.AddDate(0, 0, -1)
+		}
+		return start
+	case quotaPeriodMonthly:
+		// Not every month has day 29-31, so stick with day 28 at most.
+		if anchor < 1 {
+			anchor = 1
+		} else if anchor > 28 {
+			anchor = 28
+		}
+		start := time.Date(now.Year(), now.Month(), anchor, 0, 0, 0, 0, now.Location())
+		if now.Before(start) {
+			start = start.AddDate(0, -1, 0)
+		}
+		return start
+	}
+	return time.Time{}
+}
+
+func hasQuota(user *SSUser) bool {
+	return user.QuotaBytes > 0 && (user.QuotaPeriod == quotaPeriodDaily || user.QuotaPeriod == quotaPeriodMonthly)
+}
+
+// currentUsage returns the usage of user in the current period, starting a
+// new period if the last one is over. Must be called with lock held.
+func (q *QuotaManager) currentUsage(user *SSUser, now time.Time) *quotaUsage {
+	start := quotaPeriodStart(now, user.QuotaPeriod, user.QuotaAnchor)
+	usage, have := q.usage[user.UserID]
+	if !have || !usage.PeriodStart.Equal(start) {
+		usage = &quotaUsage{PeriodStart: start}
+		q.usage[user.UserID] = usage
+		q.dirty = true
+	}
+	return usage
+}
+
+func (q *QuotaManager) stateOf(user *SSUser, now time.Time) quotaState {
+	if !hasQuota(user) {
+		return quotaOK
+	}
+	usage := q.currentUsage(user, now)
+	if usage.Bytes < uint64(user.QuotaBytes) {
+		return quotaOK
+	}
+	if user.OverQuotaBandwidth > 0 {
+		return quotaThrottled
+	}
+	return quotaExhausted
+}
+
+// Check remembers the latest user info and reports the quota state of user.
+func (q *QuotaManager) Check(user *SSUser) quotaState {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if hasQuota(user) {
+		q.users[user.UserID] = user
+	} else {
+		delete(q.users, user.UserID)
+	}
+	state := q.stateOf(user, time.Now())
+	q.states[user.UserID] = state
+	return state
+}
+
+// Bandwidth returns the upload and download bandwidth user should get, and
+// false if the user is out of quota and should be rejected. Within quota the
+// bandwidth policy of the user applies, see PolicyEngine.Adjust.
+func (q *QuotaManager) Bandwidth(user *SSUser) (up, down int, ok bool) {
+	switch q.Check(user) {
+	case quotaThrottled:
+		return user.OverQuotaBandwidth, user.OverQuotaBandwidth, true
+	case quotaExhausted:
+		return 0, 0, false
+	}
+	up, down = policies.Adjust(user, user.uploadBandwidth(), user.downloadBandwidth(), time.Now())
+	return up, down, true
+}
+
+func (q *QuotaManager) run() {
+	for {
+		time.Sleep(quotaCheckInterval)
+		q.account(time.Now())
+		if err := q.Save(); err != nil {
+			serverLog.Error("cannot save quota state", "file", q.stateFile, "err", err)
+		}
+	}
+}
+
+// account charges the traffic since the last run to the users with quota,
+// then evaluates all of them, idle ones too: users that just ran out of
+// quota are throttled or cut, throttled users get their bandwidth back when
+// a new period starts.
+func (q *QuotaManager) account(now time.Time) {
+	deltas := q.collector.Collect()
+
+	q.lock.Lock()
+	for userID, delta := range deltas {
+		user, have := q.users[int(userID)]
+		if !have || delta.BytesIn+delta.BytesOut == 0 {
+			continue
+		}
+		usage := q.currentUsage(user, now)
+		usage.Bytes += delta.BytesIn + delta.BytesOut
+		q.dirty = true
+	}
+	var throttled, restored []*SSUser
+	var exhausted []int
+	for _, user := range q.users {
+		oldState := q.states[user.UserID]
+		state := q.stateOf(user, now)
+		q.states[user.UserID] = state
+		if state == oldState {
+			continue
+		}
+		switch state {
+		case quotaOK:
+			serverLog.Info("user is within quota again", "user", user.UserID)
+			if oldState == quotaThrottled {
+				restored = append(restored, user)
+			}
+		case quotaThrottled:
+			serverLog.Info("user is over quota, throttled", "user", user.UserID, "bandwidth", user.OverQuotaBandwidth)
+			throttled = append(throttled, user)
+		case quotaExhausted:
+			serverLog.Info("user is over quota", "user", user.UserID)
+			if q.cutActive {
+				exhausted = append(exhausted, user.UserID)
+			}
+		}
+	}
+	q.lock.Unlock()
+
+	for _, user := range throttled {
+		applyUserBandwidth(q.writeBucketCache, q.readBucketCache, user, user.OverQuotaBandwidth, user.OverQuotaBandwidth)
+	}
+	for _, user := range restored {
+		up, down := policies.Adjust(user, user.uploadBandwidth(), user.downloadBandwidth(), now)
+		applyUserBandwidth(q.writeBucketCache, q.readBucketCache, user, up, down)
+	}
+	for _, userID := range exhausted {
+		conns.KickUser(userID, closeOverQuota)
+	}
+}
+
+func (q *QuotaManager) load() error {
+	data, err := ioutil.ReadFile(q.stateFile)
+	if err != nil {
+		return err
+	}
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	return json.Unmarshal(data, &q.usage)
+}
+
+// Save writes the quota usage to the state file if it has changed.
+func (q *QuotaManager) Save() error {
+	q.lock.Lock()
+	if !q.dirty {
+		q.lock.Unlock()
+		return nil
+	}
+	data, err := json.Marshal(q.usage)
+	q.dirty = false
+	q.lock.Unlock()
+	if err != nil {
+		return err
+	}
+	// Write to a temporary file first, so a crash will not leave a broken
+	// state file behind.
+	tmpFile := q.stateFile + ".tmp"
+	if err = ioutil.WriteFile(tmpFile, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpFile, q.stateFile)
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	ss "github.com/shadowsocks/shadowsocks-go/shadowsocks"
+)
+
+func TestQuotaPeriodStart(t *testing.T) {
+	at := func(year int, month time.Month, day, hour int) time.Time {
+		return time.Date(year, month, day, hour, 0, 0, 0, time.UTC)
+	}
+	tests := []struct {
+		now    time.Time
+		period string
+		anchor int
+		want   time.Time
+	}{
+		{at(2024, 3, 10, 5), quotaPeriodDaily, 4, at(2024, 3, 10, 4)},
+		{at(2024, 3, 10, 3), quotaPeriodDaily, 4, at(2024, 3, 9, 4)},
+		{at(2024, 3, 1, 0), quotaPeriodDaily, 0, at(2024, 3, 1, 0)},
+		{at(2024, 3, 10, 3), quotaPeriodDaily, 24, at(2024, 3, 10, 0)},
+		{at(2024, 3, 15, 0), quotaPeriodMonthly, 10, at(2024, 3, 10, 0)},
+		{at(2024, 3, 5, 0), quotaPeriodMonthly, 10, at(2024, 2, 10, 0)},
+		{at(2024, 1, 5, 0), quotaPeriodMonthly, 10, at(2023, 12, 10, 0)},
+		{at(2024, 3, 27, 0), quotaPeriodMonthly, 31, at(2024, 2, 28, 0)},
+		{at(2024, 3, 27, 0), quotaPeriodMonthly, 0, at(2024, 3, 1, 0)},
+		{at(2024, 3, 27, 0), "weekly", 1, time.Time{}},
+	}
+	for _, test := range tests {
+		if got := quotaPeriodStart(test.now, test.period, test.anchor); !got.Equal(test.want) {
+			t.Errorf("%s anchor %d at %v: got %v, want %v", test.period, test.anchor, test.now, got, test.want)
+		}
+	}
+}
+
+// newTestQuota returns a QuotaManager counting the traffic of service, its
+// state file is in dir.
+func newTestQuota(t *testing.T, dir string, service *ss.UserStatisticService) *QuotaManager {
+	writeCache, readCache := setupBandwidth(t, &ss.Config{})
+	return &QuotaManager{
+		stateFile:        filepath.Join(dir, "quota.json"),
+		usage:            make(map[int]*quotaUsage),
+		users:            make(map[int]*SSUser),
+		states:           make(map[int]quotaState),
+		collector:        service.NewCollector(),
+		writeBucketCache: writeCache,
+		readBucketCache:  readCache,
+	}
+}
+
+// bucketRate returns the bandwidth of the cached bucket of userID, 0 if
+// there is none.
+func bucketRate(cache *LRU, userID int) int64 {
+	if bucket, have := cache.Get(userID); have {
+		return bucket.(*ss.Bucket).OriginRate
+	}
+	return 0
+}
+
+func TestQuotaStates(t *testing.T) {
+	dir, err := ioutil.TempDir("", "quota")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	service := ss.NewUserStatisticService()
+	q := newTestQuota(t, dir, service)
+	throttled := &SSUser{UserID: 1, Bandwidth: 10, QuotaBytes: 1000, QuotaPeriod: quotaPeriodDaily, OverQuotaBandwidth: 1}
+	exhausted := &SSUser{UserID: 2, QuotaBytes: 1000, QuotaPeriod: quotaPeriodDaily}
+	for _, user := range []*SSUser{throttled, exhausted} {
+		if state := q.Check(user); state != quotaOK {
+			t.Fatalf("user %d starts with state %d", user.UserID, state)
+		}
+	}
+
+	now := time.Now()
+	service.IncInBytes(1, 600)
+	service.IncOutBytes(1, 600)
+	service.IncInBytes(2, 1000)
+	q.account(now)
+	if q.states[1] != quotaThrottled || q.states[2] != quotaExhausted {
+		t.Fatalf("got states %v", q.states)
+	}
+	if rate := bucketRate(q.writeBucketCache, 1); rate != 1 {
+		t.Errorf("throttled user has bandwidth %d, want 1", rate)
+	}
+
+	// Idle users are evaluated too, a new period lifts the limits.
+	q.account(now.Add(24 * time.Hour))
+	if q.states[1] != quotaOK || q.states[2] != quotaOK {
+		t.Fatalf("a new period should start within quota, got states %v", q.states)
+	}
+	if rate := bucketRate(q.writeBucketCache, 1); rate != 10 {
+		t.Errorf("user back within quota has bandwidth %d, want 10", rate)
+	}
+}
+
+func TestQuotaStatePersists(t *testing.T) {
+	dir, err := ioutil.TempDir("", "quota")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	service := ss.NewUserStatisticService()
+	q := newTestQuota(t, dir, service)
+	user := &SSUser{UserID: 1, QuotaBytes: 1000, QuotaPeriod: quotaPeriodMonthly, QuotaAnchor: 1}
+	q.Check(user)
+	service.IncInBytes(1, 1500)
+	q.account(time.Now())
+	if err := q.Save(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(q.stateFile + ".tmp"); !os.IsNotExist(err) {
+		t.Error("temporary state file should be gone")
+	}
+
+	restarted := newTestQuota(t, dir, service)
+	if err := restarted.load(); err != nil {
+		t.Fatal(err)
+	}
+	if usage := restarted.usage[1]; usage == nil || usage.Bytes != 1500 {
+		t.Fatalf("usage should survive a restart, got %+v", usage)
+	}
+	if state := restarted.Check(user); state != quotaExhausted {
+		t.Errorf("user should still be over quota, got state %d", state)
+	}
+}
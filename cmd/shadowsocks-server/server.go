@@ -15,7 +15,9 @@ import (
 	"runtime/pprof"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"syscall"
+	"time"
 
 	ss "github.com/shadowsocks/shadowsocks-go/shadowsocks"
 )
@@ -38,7 +40,15 @@ const (
 
 var debug ss.DebugLog
 
+var serverLog = ss.NewSubsystemLogger("server")
+
 func getRequest(conn *ss.Conn, auth bool) (host string, ota bool, err error) {
+	reason := failRequest
+	defer func() {
+		if err != nil {
+			handshakeFailures.Inc("tcp", reason)
+		}
+	}()
 	ss.SetReadTimeout(conn)
 
 	// buf size should at least have the same size with the largest possible
@@ -82,10 +92,6 @@ func getRequest(conn *ss.Conn, auth bool) (host string, ota bool, err error) {
 	case typeDm:
 		host = string(buf[idDm0 : idDm0+buf[idDmLen]])
 	}
-	if CheckBlackList(host) {
-		err = fmt.Errorf("Host %s is in Black List", host)
-		return
-	}
 	// parse port
 	port := binary.BigEndian.Uint16(buf[reqEnd-2 : reqEnd])
 	host = net.JoinHostPort(host, strconv.Itoa(int(port)))
@@ -99,6 +105,7 @@ func getRequest(conn *ss.Conn, auth bool) (host string, ota bool, err error) {
 		key := conn.GetKey()
 		actualHmacSha1Buf := ss.HmacSha1(append(iv, key...), buf[:reqEnd])
 		if !bytes.Equal(buf[reqEnd:reqEnd+lenHmacSha1], actualHmacSha1Buf) {
+			reason = failOTA
 			err = fmt.Errorf("verify one time auth failed, iv=%v key=%v data=%v", iv, key, buf[:reqEnd])
 			return
 		}
@@ -106,22 +113,17 @@ func getRequest(conn *ss.Conn, auth bool) (host string, ota bool, err error) {
 	return
 }
 
-func handleConnection(conn *ss.Conn, auth bool, userID int) {
+func handleConnection(conn *ss.Conn, auth bool, user *SSUser, policy *aclPolicy, entry *connEntry) {
 	var host string
+	userID := user.UserID
 
 	conn.UserID = uint32(userID)
 	conn.GetUserStatisticService().IncConnections(conn.UserID)
 
-	// function arguments are always evaluated, so surround debug statement
-	// with if statement
-	if debug {
-		debug.Printf("new client %s->%s\n", conn.RemoteAddr().String(), conn.LocalAddr())
-	}
+	ss.TCPLog.Debug("new client", "client", conn.RemoteAddr(), "local", conn.LocalAddr(), "user", userID)
 	closed := false
 	defer func() {
-		if debug {
-			debug.Printf("closed pipe %s<->%s\n", conn.RemoteAddr(), host)
-		}
+		ss.TCPLog.Debug("closed pipe", "client", conn.RemoteAddr(), "target", host)
 		if !closed {
 			conn.Close()
 		}
@@ -129,18 +131,37 @@ func handleConnection(conn *ss.Conn, auth bool, userID int) {
 
 	host, ota, err := getRequest(conn, auth)
 	if err != nil {
-		log.Println("error getting request", conn.RemoteAddr(), conn.LocalAddr(), err)
+		ss.TCPLog.Warn("error getting request", "client", conn.RemoteAddr(), "user", userID, "err", err)
+		return
+	}
+	if host == net.JoinHostPort(ss.UoTHost, "0") {
+		handleUDPOverTCP(conn, ota, user, policy, entry)
+		return
+	}
+	conns.SetTarget(entry, host)
+	addr, reject, err := checkTCPDestination(policy, host)
+	if err != nil {
+		conns.SetCloseReason(entry, closeDialError)
+		ss.TCPLog.Warn("error resolving target", "target", host, "err", err)
+		return
+	}
+	if reject != "" {
+		conns.SetCloseReason(entry, closeBlocked)
+		ss.TCPLog.Info("target blocked", "user", userID, "target", host, "reason", reject)
 		return
 	}
-	debug.Println("connecting", host)
-	remote, err := net.Dial("tcp", host)
+	ss.TCPLog.Debug("connecting", "target", host, "addr", addr)
+	dialStart := time.Now()
+	remote, err := net.Dial("tcp", addr)
+	observeDial(dialStart, err)
 	if err != nil {
+		conns.SetCloseReason(entry, closeDialError)
 		if ne, ok := err.(*net.OpError); ok && (ne.Err == syscall.EMFILE || ne.Err == syscall.ENFILE) {
 			// log too many open file error
 			// EMFILE is process reaches open file limits, ENFILE is system limit
-			log.Println("dial error:", err)
+			ss.TCPLog.Error("dial error", "err", err)
 		} else {
-			log.Println("error connecting to:", host, err)
+			ss.TCPLog.Warn("error connecting to target", "target", host, "err", err)
 		}
 		return
 	}
@@ -149,28 +170,97 @@ func handleConnection(conn *ss.Conn, auth bool, userID int) {
 			remote.Close()
 		}
 	}()
-	if debug {
-		debug.Printf("piping %s<->%s ota=%v connOta=%v", conn.RemoteAddr(), host, ota, conn.IsOta())
-	}
+	atomic.AddInt64(&activeTCPConns, 1)
+	defer atomic.AddInt64(&activeTCPConns, -1)
+	ss.TCPLog.Debug("piping", "client", conn.RemoteAddr(), "target", host, "ota", ota, "conn_ota", conn.IsOta())
+	clientErr := make(chan error, 1)
 	if ota {
-		go ss.PipeThenCloseOta(conn, remote)
+		go func() { clientErr <- ss.PipeThenCloseOta(conn, remote) }()
 	} else {
-		go ss.PipeThenClose(conn, remote)
+		go func() { clientErr <- ss.PipeThenClose(conn, remote) }()
 	}
-	ss.PipeThenClose(remote, conn)
+	remoteErr := ss.PipeThenClose(remote, conn)
+	// conn is closed now, closing remote as well makes sure the other pipe
+	// does not stay blocked writing to it
+	remote.Close()
+	conns.SetCloseReason(entry, relayCloseReason(<-clientErr, remoteErr))
 	closed = true
 	return
 }
 
+// handleUDPOverTCP relays the datagrams sent over conn through the UDP NAT
+// table. The limits and traffic of the user are those of conn.
+func handleUDPOverTCP(conn *ss.Conn, ota bool, user *SSUser, policy *aclPolicy, entry *connEntry) {
+	userID := user.UserID
+	conns.SetTarget(entry, "udp-over-tcp")
+	if ota {
+		conns.SetCloseReason(entry, closeError)
+		ss.TCPLog.Warn("udp over tcp with one time auth", "user", userID, "client", conn.RemoteAddr())
+		return
+	}
+	if !policy.allowProto("udp") {
+		conns.SetCloseReason(entry, closeBlocked)
+		ss.TCPLog.Info("udp over tcp rejected by acl", "user", userID, "client", conn.RemoteAddr())
+		return
+	}
+	relay := uotRelay(user, policy, conn.RemoteAddr())
+	atomic.AddInt64(&activeTCPConns, 1)
+	defer atomic.AddInt64(&activeTCPConns, -1)
+	ss.TCPLog.Debug("udp over tcp", "client", conn.RemoteAddr(), "user", userID)
+	conns.SetCloseReason(entry, closeReason(relay.ServeUDPOverTCP(conn)))
+}
+
+// uotRelay returns the relay of the datagrams user sends over a stream from
+// client. Each flow is a NAT mapping with its own registry entry and access
+// log record, as for datagrams sent over UDP.
+func uotRelay(user *SSUser, policy *aclPolicy, client net.Addr) *ss.UDPConn {
+	userID := user.UserID
+	// The stream is a udp session of the client, every packet counts as one
+	// sent over UDP would.
+	src := &net.UDPAddr{}
+	if addr, ok := client.(*net.TCPAddr); ok {
+		src.IP, src.Port = addr.IP, addr.Port
+	}
+	allowed := udpDestinationFilter(userID, policy)
+	return &ss.UDPConn{
+		UserID:        uint32(userID),
+		NAT:           natTable,
+		NATObserver:   conns,
+		MaxNATEntries: userLimit(user.MaxUDPSessions, config.MaxUDPSessionsPerUser),
+		Resolver:      resolver,
+		DestinationFilter: func(host string, dst *net.UDPAddr) bool {
+			if err := limiter.TouchUDP(user, src); err != nil {
+				ss.UDPLog.Debug("reject packet", "user", userID, "client", client, "err", err)
+				return false
+			}
+			return allowed(host, dst)
+		},
+	}
+}
+
 func waitSignal(enableProfile bool) {
 	var sigChan = make(chan os.Signal, 1)
 	signal.Notify(sigChan, os.Interrupt, os.Kill, syscall.SIGHUP)
 	for sig := range sigChan {
 		if sig == syscall.SIGHUP {
+			if err := ReloadBlackList(); err != nil {
+				serverLog.Error("cannot reload black list", "err", err)
+			}
 		} else {
 			if enableProfile {
 				pprof.StopCPUProfile()
 			}
+			// Close the UDP mappings first, so that they are in the access
+			// log and the statistics.
+			natTable.Close()
+			if err := quota.Save(); err != nil {
+				serverLog.Error("cannot save quota state", "err", err)
+			}
+			if flusher != nil {
+				if err := flusher.Stop(); err != nil {
+					serverLog.Error("cannot flush statistics", "err", err)
+				}
+			}
 			log.Fatal("Server Exit\n")
 		}
 	}
@@ -179,28 +269,52 @@ func waitSignal(enableProfile bool) {
 func handleAccepted(conn net.Conn, auth bool, cipherCache, writeBucketCache, readBucketCache *LRU) {
 	lcfg := GetLicenseLimit()
 	if lcfg.IsExpired() {
-		debug.Printf("License is Expired!")
+		ss.LicenseLog.Debug("license is expired, reject connection")
+		handshakeFailures.Inc("tcp", failLicense)
 		conn.Close()
 		return
 	}
 	var err error
 	buf := make([]byte, 4)
 	if _, err = io.ReadFull(conn, buf); err != nil {
-		log.Printf("Read UserID error\n")
+		ss.TCPLog.Warn("read user id error", "client", conn.RemoteAddr(), "err", err)
+		handshakeFailures.Inc("tcp", failUserID)
 		conn.Close()
 		return
 	}
 	userID := ss.Byte2UserID(buf)
-	// log.Printf("Got New Connection for UserID: %d\n", userID)
-	password, bandwidth := getPasswordAndBandwidth(userID)
-	if password == "" {
-		log.Printf("Error do not have user for ID: %d\n", userID)
+	user := getUser(userID)
+	if user == nil || user.Password == "" {
+		ss.TCPLog.Warn("unknown user", "user", userID, "client", conn.RemoteAddr())
+		handshakeFailures.Inc("tcp", failNoUser)
 		conn.Close()
 		return
 	}
-	if bandwidth > lcfg.MaxBandwidth {
-		bandwidth = lcfg.MaxBandwidth
+	policy, err := getUserPolicy(user)
+	if err != nil || !policy.allowProto("tcp") {
+		ss.TCPLog.Warn("rejected by acl", "user", userID, "client", conn.RemoteAddr(), "err", err)
+		ss.GetUserStatisticService().IncRejections(uint32(userID))
+		handshakeFailures.Inc("tcp", failACL)
+		conn.Close()
+		return
+	}
+	password := user.Password
+	up, down, ok := quota.Bandwidth(user)
+	if !ok {
+		ss.TCPLog.Debug("user is over quota", "user", userID)
+		ss.GetUserStatisticService().IncRejections(uint32(userID))
+		handshakeFailures.Inc("tcp", failQuota)
+		conn.Close()
+		return
+	}
+	clientIP, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+	if err = limiter.AcquireTCP(user, clientIP); err != nil {
+		ss.TCPLog.Warn("reject connection", "user", userID, "client", clientIP, "err", err)
+		handshakeFailures.Inc("tcp", failLimit)
+		conn.Close()
+		return
 	}
+	defer limiter.ReleaseTCP(userID, clientIP)
 	// Creating cipher upon first connection.
 	cipher, have := cipherCache.Get(userID)
 	us := ss.GetUserStatisticService()
@@ -208,37 +322,43 @@ func handleAccepted(conn net.Conn, auth bool, cipherCache, writeBucketCache, rea
 	if !have {
 		cipher, err = ss.NewCipher(config.Method, password)
 		if err != nil {
-			log.Printf("Error generating cipher for UserID: %d %v\n", userID, err)
+			ss.TCPLog.Error("cannot create cipher", "user", userID, "err", err)
+			handshakeFailures.Inc("tcp", failCipher)
 			conn.Close()
 			return
 		}
-		log.Printf("Create cipher for UserID: %d on TCP", userID)
+		ss.TCPLog.Debug("create cipher", "user", userID)
 		cipherCache.Add(userID, cipher)
 	}
 	pcipher := cipher.(*ss.Cipher)
 	ssconn := ss.NewConn(conn, pcipher.Copy())
-	ssconn.WriteBucket = getOrCreateBucket(writeBucketCache, userID, bandwidth)
-	ssconn.ReadBucket = getOrCreateBucket(readBucketCache, userID, bandwidth)
-	handleConnection(ssconn, auth, userID)
+	writeBucket, readBucket := userBuckets(writeBucketCache, readBucketCache, user, up, down)
+	writeLeaf, readLeaf := connLimiters(user, writeBucket, readBucket)
+	defer writeLeaf.Release()
+	defer readLeaf.Release()
+	ssconn.WriteLimiter, ssconn.ReadLimiter = writeLeaf, readLeaf
+	entry := conns.Add(userID, ssconn)
+	defer conns.Remove(entry)
+	handleConnection(ssconn, auth, user, policy, entry)
 }
 
 func runTCPWithUserID(port string, auth bool, writeBucketCache, readBucketCache *LRU) {
 	ln, err := net.Listen("tcp", ":"+port)
 	if err != nil {
-		log.Printf("error listening TCP port %v: %v\n", port, err)
+		ss.TCPLog.Error("cannot listen", "port", port, "err", err)
 		os.Exit(1)
 	}
 	cipherCache, err := NewLRU(10000, nil)
 	if err != nil {
-		log.Printf("Error: Cannot create cipher cache!")
+		serverLog.Error("cannot create cipher cache", "err", err)
 		os.Exit(1)
 	}
-	log.Printf("server listening TCP port %v ...\n", port)
+	ss.TCPLog.Info("server listening", "port", port)
 	for {
 		conn, err := ln.Accept()
 		if err != nil {
 			// listener maybe closed to update password
-			log.Printf("accept error: %v\n", err)
+			ss.TCPLog.Error("accept error", "err", err)
 			continue
 		}
 		go handleAccepted(conn, auth, cipherCache, writeBucketCache, readBucketCache)
@@ -246,52 +366,84 @@ func runTCPWithUserID(port string, auth bool, writeBucketCache, readBucketCache
 }
 
 func handleReadFromUDP(conn *net.UDPConn, auth bool, n int, src *net.UDPAddr, data []byte, cipherCache, writeBucketCache, readBucketCache *LRU) {
-	defer ss.LeakyBuffer.Put(data)
+	defer ss.PutUDPBuffer(data)
 	lcfg := GetLicenseLimit()
 	if lcfg.IsExpired() {
-		debug.Printf("License is Expired!")
+		ss.LicenseLog.Debug("license is expired, drop packet")
+		handshakeFailures.Inc("udp", failLicense)
 		return
 	}
 	var err error
 	if n < 4 {
-		log.Printf("Read UserID error\n")
+		ss.UDPLog.Warn("read user id error", "client", src)
+		handshakeFailures.Inc("udp", failUserID)
 		return
 	}
 	buf := make([]byte, 4)
 	copy(buf, data[:4])
 	userID := ss.Byte2UserID(buf)
-	log.Printf("Got New Connection for UserID: %d\n", userID)
-	password, bandwidth := getPasswordAndBandwidth(userID)
-	if password == "" {
-		log.Printf("Error do not have user for ID: %d\n", userID)
+	ss.UDPLog.Debug("new packet", "user", userID, "client", src)
+	user := getUser(userID)
+	if user == nil || user.Password == "" {
+		ss.UDPLog.Warn("unknown user", "user", userID, "client", src)
+		handshakeFailures.Inc("udp", failNoUser)
 		return
 	}
-	if bandwidth > lcfg.MaxBandwidth {
-		bandwidth = lcfg.MaxBandwidth
+	policy, err := getUserPolicy(user)
+	if err != nil || !policy.allowProto("udp") {
+		ss.UDPLog.Debug("rejected by acl", "user", userID, "client", src, "err", err)
+		ss.GetUserStatisticService().IncRejections(uint32(userID))
+		handshakeFailures.Inc("udp", failACL)
+		return
+	}
+	password := user.Password
+	up, down, ok := quota.Bandwidth(user)
+	if !ok {
+		ss.UDPLog.Debug("user is over quota", "user", userID)
+		ss.GetUserStatisticService().IncRejections(uint32(userID))
+		handshakeFailures.Inc("udp", failQuota)
+		return
+	}
+	if err = limiter.TouchUDP(user, src); err != nil {
+		ss.UDPLog.Debug("reject packet", "user", userID, "client", src, "err", err)
+		handshakeFailures.Inc("udp", failLimit)
+		return
 	}
 	// Creating cipher upon first connection.
 	cipher, have := cipherCache.Get(userID)
-	us := ss.GetUserStatisticService()
-	us.IncInBytes(uint32(userID), n)
 	if !have {
 		cipher, err = ss.NewCipher(config.Method, password)
 		if err != nil {
-			log.Printf("Error generating cipher for UserID: %d %v\n", userID, err)
+			ss.UDPLog.Error("cannot create cipher", "user", userID, "err", err)
+			handshakeFailures.Inc("udp", failCipher)
 			return
 		}
-		log.Printf("Create cipher for UserID: %d on UDP\n", userID)
+		ss.UDPLog.Debug("create cipher", "user", userID)
 		cipherCache.Add(userID, cipher)
 	}
 	pcipher := cipher.(*ss.Cipher)
-	ddata := ss.LeakyBuffer.Get()
+	ddata := ss.GetUDPBuffer(n)
 	dn, iv, err := ss.UDPDecryptData(n, data, pcipher, ddata)
 	if err != nil {
-		log.Printf("Error: %v", err)
+		ss.UDPLog.Warn("cannot decrypt packet", "user", userID, "client", src, "err", err)
+		handshakeFailures.Inc("udp", failDecrypt)
+		ss.PutUDPBuffer(ddata)
+		return
 	}
 	udpConn := ss.NewUDPConn(conn, pcipher)
 	udpConn.UserID = uint32(userID)
-	udpConn.WriteBucket = getOrCreateBucket(writeBucketCache, userID, bandwidth)
-	udpConn.ReadBucket = getOrCreateBucket(readBucketCache, userID, bandwidth)
+	udpConn.WriteBucket, udpConn.ReadBucket = udpBuckets(writeBucketCache, readBucketCache, user, up, down)
+	udpConn.NATObserver = conns
+	udpConn.NAT = natTable
+	udpConn.MaxNATEntries = userLimit(user.MaxUDPSessions, config.MaxUDPSessionsPerUser)
+	udpConn.Resolver = resolver
+	udpConn.DestinationFilter = udpDestinationFilter(userID, policy)
+	// The user ID in front is not counted, as for TCP.
+	if !udpConn.AccountRead(n - 4) {
+		ss.UDPLog.Debug("packet over upload bandwidth dropped", "user", userID, "client", src)
+		ss.PutUDPBuffer(ddata)
+		return
+	}
 	go udpConn.HandleUDPConnection(dn, src, ddata, auth, iv)
 }
 
@@ -302,54 +454,49 @@ func runUDPWithUserID(port string, auth bool, writeBucketCache, readBucketCache
 		Port: port_i,
 	})
 	if err != nil {
-		log.Printf("error listening UDP port %v: %v", port, err)
+		ss.UDPLog.Error("cannot listen", "port", port, "err", err)
 		os.Exit(1)
 	}
 	cipherCache, err := NewLRU(10000, nil)
 	if err != nil {
-		log.Printf("Error: Cannot create cipher cache!")
+		serverLog.Error("cannot create cipher cache", "err", err)
 		os.Exit(1)
 	}
-	log.Printf("server listening UDP port %v ...\n", port)
+	ss.UDPLog.Info("server listening", "port", port)
+	// Packets are handed over in buffers of their size.
+	buf := ss.GetUDPBuffer(ss.UDPBufSize)
 	for {
-		buf := ss.LeakyBuffer.Get()
 		n, src, err := conn.ReadFromUDP(buf)
 		if err != nil {
-			log.Printf("Read packet from UDP error: %v\n", err)
+			ss.UDPLog.Error("read packet error", "err", err)
 			continue
 		}
-		go handleReadFromUDP(conn, auth, n, src, buf, cipherCache, writeBucketCache, readBucketCache)
-	}
-}
-
-func getOrCreateBucket(cache *LRU, userID int, bandwidth int) *ss.Bucket {
-	if bandwidth <= 0 {
-		return nil
-	}
-	var bucket *ss.Bucket
-	cbucket, have := cache.Get(userID)
-	rate := bandwidth * 1000 * 1000 / 8
-	var bursting int64 = 4096
-	if !have {
-		// we should create a bucket
-		bucket = ss.NewBucketWithRate(float64(rate), bursting, int64(bandwidth))
-		cache.Add(userID, bucket)
-	} else {
-		bucket = cbucket.(*ss.Bucket)
-		if bucket.OriginRate != int64(bandwidth) {
-			// For now we just update the rate for TokenBucket is OK
-			bucket.UpdateRate(float64(rate), int64(bandwidth))
+		if ss.UDPTooLarge(n) {
+			ss.UDPLog.Debug("oversized packet dropped", "client", src)
+			continue
 		}
+		data := ss.GetUDPBuffer(n)
+		copy(data, buf)
+		go handleReadFromUDP(conn, auth, n, src, data, cipherCache, writeBucketCache, readBucketCache)
 	}
-	return bucket
 }
 
-func getPasswordAndBandwidth(userID int) (string, int) {
+func getUser(userID int) *SSUser {
+	var user *SSUser
 	if config.UseDatabase {
-		return getPasswordAndBandwidthFromDatabase(userID)
-	} else {
-		return getPasswordFromConfig(userID), -1
+		user = getUserFromDatabase(userID)
+	} else if password := getPasswordFromConfig(userID); password != "" {
+		user = &SSUser{
+			UserID:    userID,
+			Password:  password,
+			Status:    "Enabled",
+			Bandwidth: -1,
+		}
+	}
+	if user != nil {
+		applyBandwidthOverride(user)
 	}
+	return user
 }
 
 func getPasswordFromConfig(userID int) string {
@@ -381,9 +528,16 @@ func unifyPortPassword(config *ss.Config) (err error) {
 var configFile string
 var config *ss.Config
 
+// natTable holds the UDP NAT mappings of all ports.
+var natTable *ss.NATTable
+
 func main() {
 	log.SetOutput(os.Stdout)
 
+	if len(os.Args) > 1 && os.Args[1] == "license" {
+		os.Exit(runLicenseCommand(os.Args[2:]))
+	}
+
 	var cmdConfig ss.Config
 	var printVer bool
 	var core int
@@ -444,6 +598,10 @@ func main() {
 		fmt.Fprintln(os.Stderr, err)
 		os.Exit(1)
 	}
+	if err = ss.ConfigureLogger(config); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
 	if err = unifyPortPassword(config); err != nil {
 		os.Exit(1)
 	}
@@ -456,19 +614,19 @@ func main() {
 			fmt.Print(err)
 			os.Exit(1)
 		}
-		err = initLicense()
-		if err != nil {
-			fmt.Print(err)
-			os.Exit(1)
+	}
+	err = initLicense()
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	} else {
+		lcfg := GetLicenseLimit()
+		if lcfg.IsExpired() {
+			fmt.Println("License is Expired")
 		} else {
-			lcfg := GetLicenseLimit()
-			if lcfg.IsExpired() {
-				fmt.Println("License is Expired")
-			} else {
-				fmt.Println("License is Valid")
-			}
-			fmt.Printf("Expire: %v, Max Users: %d, Max Servers: %d, Max Bandwidth: %d\n", lcfg.Expire, lcfg.MaxUsers, lcfg.MaxServers, lcfg.MaxBandwidth)
+			fmt.Println("License is Valid")
 		}
+		fmt.Printf("Expire: %v, Max Users: %d, Max Servers: %d, Max Bandwidth: %d\n", lcfg.Expire, lcfg.MaxUsers, lcfg.MaxServers, lcfg.MaxBandwidth)
 	}
 	if config.UseRedis {
 		err = initRedis(config.RedisServer)
@@ -482,19 +640,66 @@ func main() {
 
 	writeBucketCache, err := NewLRU(10000, nil)
 	if err != nil {
-		log.Printf("Error: Cannot create write bucket cache!")
+		serverLog.Error("cannot create write bucket cache", "err", err)
 		os.Exit(1)
 	}
 	readBucketCache, err := NewLRU(10000, nil)
 	if err != nil {
-		log.Printf("Error: Cannot create read bucket cache!")
+		serverLog.Error("cannot create read bucket cache", "err", err)
+		os.Exit(1)
+	}
+	if err = initBandwidth(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	initQuota(writeBucketCache, readBucketCache)
+	natMode, err := ss.ParseNATMode(config.UDPNATMode)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	natTable = ss.NewNATTable(natMode, time.Duration(config.UDPNATTimeout)*time.Second,
+		config.UDPNATMaxEntries)
+	if err = initBandwidthPolicies(writeBucketCache, readBucketCache); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	initLimiter()
+	if resolver, err = ss.NewResolver(config); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if err = initPrivateAllowList(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if err = initACL(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if err = initAccessLog(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if err = initStatisticFlusher(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
 		os.Exit(1)
 	}
 	for port, _ := range config.PortPassword {
 		go runTCPWithUserID(port, config.Auth, writeBucketCache, readBucketCache)
 		go runUDPWithUserID(port, config.Auth, writeBucketCache, readBucketCache)
 	}
-	go StartStatisticServer("127.0.0.1:8080")
+	statisticAddr := config.StatisticAddr
+	if statisticAddr == "" {
+		statisticAddr = defaultStatisticAddr
+	}
+	go StartStatisticServer(statisticAddr)
+	if config.AdminAddr != "" {
+		if err = StartAdminServer(writeBucketCache, readBucketCache); err != nil {
+			fmt.Fprintln(os.Stderr, "admin API:", err)
+			os.Exit(1)
+		}
+	}
 
 	waitSignal(profileVer)
 }
@@ -2,9 +2,14 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
+	"net"
 	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"sync"
 	"time"
 
 	ss "github.com/shadowsocks/shadowsocks-go/shadowsocks"
@@ -16,16 +21,59 @@ func processStatisticRequest(writer http.ResponseWriter, request *http.Request)
 	statData := ss.GetUserStatisticMap()
 	data, err := json.Marshal(statData)
 	if err != nil {
-		log.Print(err)
+		serverLog.Error("cannot encode statistics", "err", err)
 		fmt.Fprintf(writer, "{}")
 	} else {
 		writer.Write(data)
 	}
 }
 
+// processConnectionsRequest lists the active connections, of one user with
+// ?user=ID.
+func processConnectionsRequest(writer http.ResponseWriter, request *http.Request) {
+	defer request.Body.Close()
+	userID := -1
+	if user := request.URL.Query().Get("user"); user != "" {
+		var err error
+		if userID, err = strconv.Atoi(user); err != nil {
+			http.Error(writer, "invalid user", http.StatusBadRequest)
+			return
+		}
+	}
+	data, err := json.Marshal(conns.List(userID))
+	if err != nil {
+		serverLog.Error("cannot encode connections", "err", err)
+		fmt.Fprintf(writer, "[]")
+	} else {
+		writer.Write(data)
+	}
+}
+
+// isLoopbackAddr reports whether the listen address addr only accepts
+// connections from the local host.
+func isLoopbackAddr(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
 func StartStatisticServer(addr string) {
 	mux := http.NewServeMux()
 	mux.HandleFunc("/", processStatisticRequest)
+	mux.HandleFunc("/metrics", processMetricsRequest)
+	// The connections show the client addresses and targets of all users,
+	// only serve them to the local host unless asked to.
+	if isLoopbackAddr(addr) || config.StatisticConnections {
+		mux.HandleFunc("/connections", processConnectionsRequest)
+	} else {
+		serverLog.Info("not serving /connections on a non loopback address, set statistic_connections to serve them", "addr", addr)
+	}
 	var server = http.Server{
 		Addr:           addr,
 		Handler:        mux,
@@ -35,13 +83,116 @@ func StartStatisticServer(addr string) {
 	}
 	defer func() {
 		if err := recover(); err != nil {
-			log.Print(err)
+			serverLog.Error("statistic server panic", "err", err)
 		}
 	}()
-	log.Printf("Start Statistic HTTP Server: %s\n", addr)
+	serverLog.Info("start statistic http server", "addr", addr)
 	err := server.ListenAndServe()
 	if err != nil {
-		log.Print("Cannot Start Statistic HTTP Server")
-		log.Fatal(err)
+		serverLog.Error("cannot start statistic http server", "err", err)
+		os.Exit(1)
+	}
+}
+
+const (
+	defaultStatisticAddr  = "127.0.0.1:8080"
+	defaultStatisticTable = "user_statistic"
+)
+
+var validTableName = regexp.MustCompile(`^[A-Za-z0-9_]+$`)
+
+// StatisticFlusher writes the per user deltas to the database periodically.
+// Deltas that failed to be written are kept and retried with the next flush.
+type StatisticFlusher struct {
+	lock      sync.Mutex
+	table     string
+	interval  time.Duration
+	collector *ss.StatisticCollector
+	pending   map[uint32]ss.UserStatistic
+	stop      chan bool
+	done      chan bool
+}
+
+var flusher *StatisticFlusher
+
+func initStatisticFlusher() error {
+	if config.StatisticFlushInterval <= 0 {
+		return nil
+	}
+	if !config.UseDatabase {
+		return errors.New("statistic_flush_interval requires use_database")
+	}
+	table := config.StatisticTable
+	if table == "" {
+		table = defaultStatisticTable
+	}
+	if !validTableName.MatchString(table) {
+		return fmt.Errorf("invalid statistic_table %q", table)
+	}
+	flusher = &StatisticFlusher{
+		table:     table,
+		interval:  time.Duration(config.StatisticFlushInterval) * time.Second,
+		collector: ss.GetUserStatisticService().NewCollector(),
+		pending:   make(map[uint32]ss.UserStatistic),
+		stop:      make(chan bool),
+		done:      make(chan bool),
+	}
+	go flusher.run()
+	return nil
+}
+
+func (f *StatisticFlusher) run() {
+	ticker := time.NewTicker(f.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := f.Flush(); err != nil {
+				serverLog.Warn("cannot flush statistics, will retry", "err", err)
+			}
+		case <-f.stop:
+			close(f.done)
+			return
+		}
+	}
+}
+
+// Flush writes the deltas since the last successful flush in one transaction.
+func (f *StatisticFlusher) Flush() error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	for userID, delta := range f.collector.Collect() {
+		p := f.pending[userID]
+		p.UserID = userID
+		p.BytesIn += delta.BytesIn
+		p.BytesOut += delta.BytesOut
+		p.Connections += delta.Connections
+		f.pending[userID] = p
+	}
+	stats := make([]ss.UserStatistic, 0, len(f.pending))
+	for _, p := range f.pending {
+		if p.BytesIn == 0 && p.BytesOut == 0 && p.Connections == 0 {
+			continue
+		}
+		stats = append(stats, p)
+	}
+	if err := saveStatistics(f.table, stats, time.Now()); err != nil {
+		return err
+	}
+	f.pending = make(map[uint32]ss.UserStatistic)
+	return nil
+}
+
+// Stop stops the periodic flush and does a final one, retrying a few times
+// since there is no next flush to catch up.
+func (f *StatisticFlusher) Stop() (err error) {
+	close(f.stop)
+	<-f.done
+	for i := 0; i < 3; i++ {
+		if err = f.Flush(); err == nil {
+			return
+		}
+		time.Sleep(time.Second)
 	}
+	return
 }
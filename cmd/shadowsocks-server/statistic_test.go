@@ -0,0 +1,66 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	ss "github.com/shadowsocks/shadowsocks-go/shadowsocks"
+)
+
+func TestIsLoopbackAddr(t *testing.T) {
+	tests := []struct {
+		addr string
+		want bool
+	}{
+		{"127.0.0.1:8080", true},
+		{"[::1]:8080", true},
+		{"localhost:8080", true},
+		{":8080", false},
+		{"0.0.0.0:8080", false},
+		{"192.0.2.1:8080", false},
+		{"stats.example.com:8080", false},
+		{"127.0.0.1", false},
+	}
+	for _, test := range tests {
+		if got := isLoopbackAddr(test.addr); got != test.want {
+			t.Errorf("%s: got %v, want %v", test.addr, got, test.want)
+		}
+	}
+}
+
+func TestConnectionsRequest(t *testing.T) {
+	cipher, err := ss.NewCipher("aes-128-cfb", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, userID := range []int{1, 2} {
+		client, server := net.Pipe()
+		defer client.Close()
+		entry := conns.Add(userID, ss.NewConn(server, cipher.Copy()))
+		defer conns.Remove(entry)
+	}
+	list := func(query string) (int, []ConnInfo) {
+		recorder := httptest.NewRecorder()
+		processConnectionsRequest(recorder, httptest.NewRequest("GET", "/connections"+query, nil))
+		var infos []ConnInfo
+		if recorder.Code == http.StatusOK {
+			if err := json.Unmarshal(recorder.Body.Bytes(), &infos); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return recorder.Code, infos
+	}
+
+	if code, _ := list("?user=x"); code != http.StatusBadRequest {
+		t.Errorf("invalid user: got status %d, want 400", code)
+	}
+	if code, infos := list("?user=2"); code != http.StatusOK || len(infos) != 1 || infos[0].UserID != 2 {
+		t.Errorf("got status %d and %+v, want the connection of user 2", code, infos)
+	}
+	if code, infos := list(""); code != http.StatusOK || len(infos) != 2 {
+		t.Errorf("got status %d and %d connections, want 2", code, len(infos))
+	}
+}
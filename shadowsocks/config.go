@@ -35,6 +35,12 @@ type Config struct {
 	EnableDNSProxy  bool   `json:"enable_dns_proxy"`
 	TargetDNSServer string `json:"target_dns_server"`
 	DNSProxyPort    int    `json:"dns_proxy_port"`
+	// UDPOverTCP tells when clients carry UDP over TCP: auto (default),
+	// never or always
+	UDPOverTCP string `json:"udp_over_tcp"`
+	// UDPMaxSize is the largest datagram relayed in bytes, 0 means 65507.
+	// Larger ones are dropped.
+	UDPMaxSize int `json:"udp_max_size"`
 
 	// following options are only used by client
 
@@ -51,6 +57,122 @@ type Config struct {
 	DatabaseURL string `json:"database_url"`
 	UseRedis    bool   `json:"use_redis"`
 	RedisServer string `json:"redis_server"`
+
+	// License Related Config
+	LicenseFile        string `json:"license_file"`
+	LicenseGracePeriod int    `json:"license_grace_period"` // in seconds
+
+	// Traffic Quota Related Config
+	QuotaStateFile string `json:"quota_state_file"`
+	QuotaCutActive bool   `json:"quota_cut_active"`
+
+	// Default per user limits, 0 means no limit
+	MaxConnectionsPerUser int `json:"max_connections_per_user"`
+	MaxUDPSessionsPerUser int `json:"max_udp_sessions_per_user"`
+	MaxIPsPerUser         int `json:"max_ips_per_user"`
+
+	// UDP NAT Related Config, the least recently used mapping makes room
+	// when a limit is reached. The limit of a user is its max_udp_sessions.
+	UDPNATMode       string `json:"udp_nat_mode"`        // full_cone, address_restricted (default) or port_restricted
+	UDPNATTimeout    int    `json:"udp_nat_timeout"`     // idle timeout in seconds, 0 means the value of timeout
+	UDPNATMaxEntries int    `json:"udp_nat_max_entries"` // all users together, 0 means 10000
+
+	// Statistic Related Config
+	StatisticFlushInterval int    `json:"statistic_flush_interval"` // in seconds, 0 disables flushing
+	StatisticTable         string `json:"statistic_table"`
+	MetricsMaxUsers        int    `json:"metrics_max_users"` // 0 means 1000, negative disables per user metrics
+	StatisticAddr          string `json:"statistic_addr"`
+	StatisticConnections   bool   `json:"statistic_connections"` // serve /connections on a non loopback statistic_addr
+
+	// Admin API Related Config, admin_token or admin_client_ca is required
+	AdminAddr     string `json:"admin_addr"`
+	AdminToken    string `json:"admin_token"`
+	AdminTLSCert  string `json:"admin_tls_cert"`
+	AdminTLSKey   string `json:"admin_tls_key"`
+	AdminClientCA string `json:"admin_client_ca"`
+
+	// Access Log Related Config
+	AccessLog            string  `json:"access_log"`             // file name, or syslog
+	AccessLogMaxSize     int     `json:"access_log_max_size"`    // in MB, 0 means 100
+	AccessLogMaxBackups  int     `json:"access_log_max_backups"` // 0 means 5
+	AccessLogSampleRate  float64 `json:"access_log_sample_rate"` // 0 means 1, log everything
+	AccessLogHashTargets bool    `json:"access_log_hash_targets"`
+	AccessLogHashSalt    string  `json:"access_log_hash_salt"`
+
+	// Logging Related Config
+	LogFormat    string            `json:"log_format"`     // text or json
+	LogLevel     string            `json:"log_level"`      // debug, info, warn or error
+	LogLevels    map[string]string `json:"log_levels"`     // per subsystem levels: tcp, udp, dns, db, license
+	LogRateLimit int               `json:"log_rate_limit"` // same warnings per minute, 0 means 10, negative disables
+
+	// Bandwidth Related Config, in Mbps
+	MaxUploadBandwidth   int `json:"max_upload_bandwidth"`   // all users together, 0 means unlimited
+	MaxDownloadBandwidth int `json:"max_download_bandwidth"` // all users together, 0 means unlimited
+	BandwidthBurstMS     int `json:"bandwidth_burst_ms"`     // default burst in ms of traffic, 0 means 100
+	// Users are shared fairly in groups, and groups by weight
+	BandwidthGroups map[string]BandwidthGroup `json:"bandwidth_groups"`
+	// Schedules and burst credits, users pick a policy by name
+	BandwidthPolicies      map[string]BandwidthPolicy `json:"bandwidth_policies"`
+	DefaultBandwidthPolicy string                     `json:"default_bandwidth_policy"`
+
+	// Destinations in private, loopback, link-local and multicast networks are
+	// rejected unless allowed here
+	AllowPrivateDestinations bool     `json:"allow_private_destinations"`
+	PrivateAllowList         []string `json:"private_allow_list"` // IPs or CIDRs
+
+	// DNS Related Config of the server, the system resolver is used without
+	// dns_servers
+	DNSServers     []string            `json:"dns_servers"`      // like 8.8.8.8, tcp://8.8.8.8, tls://1.1.1.1 or https://dns.google/dns-query
+	DNSTimeout     int                 `json:"dns_timeout"`      // per query in seconds, 0 means 5
+	DNSCacheSize   int                 `json:"dns_cache_size"`   // 0 means 10000, negative disables the cache
+	DNSNegativeTTL int                 `json:"dns_negative_ttl"` // in seconds, 0 means 30
+	DNSHosts       map[string][]string `json:"dns_hosts"`        // static addresses of domains
+
+	// ACL Related Config, users pick a policy by name, or get the one of
+	// their group
+	ACLPolicies map[string]ACLPolicy `json:"acl_policies"`
+	GroupACLs   map[string]string    `json:"group_acls"` // group name to policy name
+	DefaultACL  string               `json:"default_acl"`
+}
+
+// BandwidthGroup is a group of users sharing bandwidth, see
+// bandwidth_groups. Bandwidth is in Mbps, 0 means unlimited.
+type BandwidthGroup struct {
+	Weight               float64 `json:"weight"` // share under contention, 0 means 1
+	MaxUploadBandwidth   int     `json:"max_upload_bandwidth"`
+	MaxDownloadBandwidth int     `json:"max_download_bandwidth"`
+}
+
+// BandwidthPolicy changes the bandwidth of the users it is attached to over
+// time. The first window containing the current time sets the bandwidth,
+// outside of the windows users with burst credit left get CreditBandwidth.
+// Bandwidth is in Mbps, not positive means unlimited.
+type BandwidthPolicy struct {
+	TimeZone        string            `json:"timezone"` // like Asia/Shanghai, empty means local time
+	Windows         []BandwidthWindow `json:"windows"`
+	CreditMB        int64             `json:"credit_mb"`        // burst credit, 0 means none
+	CreditRefillMB  int64             `json:"credit_refill_mb"` // per hour
+	CreditBandwidth int               `json:"credit_bandwidth"`
+}
+
+// BandwidthWindow is a daily time range of a BandwidthPolicy, see
+// ss.ParseTimeWindow.
+type BandwidthWindow struct {
+	Days      string `json:"days"` // like mon-fri or sat,sun, empty means every day
+	From      string `json:"from"` // hh:mm
+	To        string `json:"to"`   // hh:mm, at or before from means the next day
+	Bandwidth int    `json:"bandwidth"`
+	Upload    int    `json:"upload"`   // 0 means bandwidth
+	Download  int    `json:"download"` // 0 means bandwidth
+}
+
+// ACLPolicy limits the destinations of the users it is attached to. Allow and
+// Deny hold destination rules in the black list format.
+type ACLPolicy struct {
+	Allow        []string `json:"allow"` // when not empty, only matching destinations are allowed
+	Deny         []string `json:"deny"`
+	Protocols    []string `json:"protocols"` // tcp and/or udp, both when empty
+	BlockPrivate bool     `json:"block_private"`
 }
 
 var readTimeout time.Duration
@@ -111,6 +233,7 @@ func ParseConfig(path string) (config *Config, err error) {
 	if readTimeout == 0 {
 		readTimeout = 60 * time.Second
 	}
+	SetMaxUDPSize(config.UDPMaxSize)
 	if strings.HasSuffix(strings.ToLower(config.Method), "-auth") {
 		config.Method = config.Method[:len(config.Method)-5]
 		config.Auth = true
@@ -129,6 +252,9 @@ func ParseConfig(path string) (config *Config, err error) {
 
 func SetDebug(d DebugLog) {
 	Debug = d
+	if l, ok := GetLogger().(*StdLogger); ok && bool(d) {
+		l.SetLevel(LevelDebug)
+	}
 }
 
 // Useful for command line to override options specified in config file
@@ -6,43 +6,98 @@ import (
 	"io"
 	"net"
 	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
 const (
-	OneTimeAuthMask          byte          = 0x10
-	AddrMask                 byte          = 0xf
-	RateLimitWaitMaxDuration time.Duration = time.Duration(1) * time.Second
+	OneTimeAuthMask byte = 0x10
+	AddrMask        byte = 0xf
 )
 
 type Conn struct {
+	// cipher bytes of this connection, only accessed with sync/atomic. Keep
+	// them first for 64-bit alignment on 32-bit platforms.
+	bytesIn  uint64
+	bytesOut uint64
+	// deadlines in unix nanoseconds, 0 means none, only accessed with
+	// sync/atomic. Waits for the bandwidth limit give up at the deadline.
+	readDeadline  int64
+	writeDeadline int64
 	net.Conn
 	*Cipher
-	readBuf     []byte
-	writeBuf    []byte
-	chunkId     uint32
-	UserID      uint32
-	WriteBucket *Bucket
-	ReadBucket  *Bucket
+	readBuf  []byte
+	writeBuf []byte
+	chunkId  uint32
+	UserID   uint32
+	// WriteLimiter and ReadLimiter limit the rate of the connection, they
+	// may be nil.
+	WriteLimiter Limiter
+	ReadLimiter  Limiter
+	// done is closed when the connection is closed, to wake up waits for
+	// the bandwidth limit.
+	done     chan struct{}
+	doneOnce sync.Once
 }
 
 func NewConn(c net.Conn, cipher *Cipher) *Conn {
 	return &Conn{
-		Conn:        c,
-		Cipher:      cipher,
-		readBuf:     leakyBuf.Get(),
-		writeBuf:    leakyBuf.Get(),
-		WriteBucket: nil,
-		ReadBucket:  nil,
+		Conn:     c,
+		Cipher:   cipher,
+		readBuf:  leakyBuf.Get(),
+		writeBuf: leakyBuf.Get(),
+		done:     make(chan struct{}),
 	}
 }
 
 func (c *Conn) Close() error {
+	c.doneOnce.Do(func() { close(c.done) })
 	leakyBuf.Put(c.readBuf)
 	leakyBuf.Put(c.writeBuf)
 	return c.Conn.Close()
 }
 
+// Abort closes the underlying connection and wakes up a Read or Write
+// waiting for the bandwidth limit. Unlike Close it is safe to call while
+// another goroutine uses the connection, Close must still be called by the
+// owner to release the buffers.
+func (c *Conn) Abort() error {
+	c.doneOnce.Do(func() { close(c.done) })
+	return c.Conn.Close()
+}
+
+func storeDeadline(addr *int64, t time.Time) {
+	var nanos int64
+	if !t.IsZero() {
+		nanos = t.UnixNano()
+	}
+	atomic.StoreInt64(addr, nanos)
+}
+
+func loadDeadline(addr *int64) time.Time {
+	if nanos := atomic.LoadInt64(addr); nanos != 0 {
+		return time.Unix(0, nanos)
+	}
+	return time.Time{}
+}
+
+func (c *Conn) SetDeadline(t time.Time) error {
+	storeDeadline(&c.readDeadline, t)
+	storeDeadline(&c.writeDeadline, t)
+	return c.Conn.SetDeadline(t)
+}
+
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	storeDeadline(&c.readDeadline, t)
+	return c.Conn.SetReadDeadline(t)
+}
+
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	storeDeadline(&c.writeDeadline, t)
+	return c.Conn.SetWriteDeadline(t)
+}
+
 func RawAddr(addr string) (buf []byte, err error) {
 	host, portStr, err := net.SplitHostPort(addr)
 	if err != nil {
@@ -147,6 +202,16 @@ func (c *Conn) GetAndIncrChunkId() (chunkId uint32) {
 	return
 }
 
+// BytesIn returns the bytes read from the underlying connection so far.
+func (c *Conn) BytesIn() uint64 {
+	return atomic.LoadUint64(&c.bytesIn)
+}
+
+// BytesOut returns the bytes written to the underlying connection so far.
+func (c *Conn) BytesOut() uint64 {
+	return atomic.LoadUint64(&c.bytesOut)
+}
+
 func (c *Conn) GetUserStatisticService() *UserStatisticService {
 	return GetUserStatisticService()
 }
@@ -163,6 +228,7 @@ func (c *Conn) Read(b []byte) (n int, err error) {
 		if len(c.iv) == 0 {
 			c.iv = iv
 		}
+		atomic.AddUint64(&c.bytesIn, uint64(c.info.ivLen))
 		uss := c.GetUserStatisticService()
 		if uss != nil {
 			uss.IncInBytes(c.UserID, c.info.ivLen)
@@ -176,15 +242,23 @@ func (c *Conn) Read(b []byte) (n int, err error) {
 		cipherData = cipherData[:len(b)]
 	}
 
+	// Wait for the bandwidth limit before reading, so the client is slowed
+	// down by TCP flow control instead of filling our buffers.
+	if c.ReadLimiter != nil {
+		if err = c.ReadLimiter.WaitReady(loadDeadline(&c.readDeadline), c.done); err != nil {
+			return
+		}
+	}
 	n, err = c.Conn.Read(cipherData)
 	if n > 0 {
 		c.decrypt(b[0:n], cipherData[0:n])
+		atomic.AddUint64(&c.bytesIn, uint64(n))
 		uss := c.GetUserStatisticService()
 		if uss != nil {
 			uss.IncInBytes(c.UserID, n)
 		}
-		if c.ReadBucket != nil {
-			c.ReadBucket.WaitMaxDuration(int64(n), RateLimitWaitMaxDuration)
+		if c.ReadLimiter != nil {
+			c.ReadLimiter.Account(int64(n))
 		}
 	}
 	return
@@ -230,14 +304,20 @@ func (c *Conn) write(b []byte) (n int, err error) {
 	}
 
 	c.encrypt(cipherData[len(iv):], b)
+	if c.WriteLimiter != nil {
+		if err = c.WriteLimiter.WaitReady(loadDeadline(&c.writeDeadline), c.done); err != nil {
+			return
+		}
+	}
 	n, err = c.Conn.Write(cipherData)
 	if n > 0 {
+		atomic.AddUint64(&c.bytesOut, uint64(n))
 		uss := c.GetUserStatisticService()
 		if uss != nil {
 			uss.IncOutBytes(c.UserID, n)
 		}
-		if c.WriteBucket != nil {
-			c.WriteBucket.WaitMaxDuration(int64(n), RateLimitWaitMaxDuration)
+		if c.WriteLimiter != nil {
+			c.WriteLimiter.Account(int64(n))
 		}
 	}
 	return
@@ -1,24 +1,24 @@
 package shadowsocks
 
 import (
-	"log"
-	"os"
+	"fmt"
+	"strings"
 )
 
+// DebugLog is the debug switch of the command line tools, the messages go to
+// the Debug level of the current Logger.
 type DebugLog bool
 
 var Debug DebugLog
 
-var dbgLog = log.New(os.Stdout, "[DEBUG] ", log.Ltime)
-
 func (d DebugLog) Printf(format string, args ...interface{}) {
 	if d {
-		dbgLog.Printf(format, args...)
+		GetLogger().Debug(strings.TrimSuffix(fmt.Sprintf(format, args...), "\n"))
 	}
 }
 
 func (d DebugLog) Println(args ...interface{}) {
 	if d {
-		dbgLog.Println(args...)
+		GetLogger().Debug(strings.TrimSuffix(fmt.Sprintln(args...), "\n"))
 	}
 }
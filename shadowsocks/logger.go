@@ -0,0 +1,393 @@
+package shadowsocks
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type Level int
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+func (l Level) String() string {
+	if l < LevelDebug || l > LevelError {
+		return "level" + strconv.Itoa(int(l))
+	}
+	return levelNames[l]
+}
+
+func ParseLevel(s string) (Level, error) {
+	for i, name := range levelNames {
+		if strings.EqualFold(s, name) {
+			return Level(i), nil
+		}
+	}
+	return LevelInfo, fmt.Errorf("unknown log level %q", s)
+}
+
+// Logger is a leveled, structured logger. keyvals are alternating keys and
+// values, for example
+//
+//	UDPLog.Warn("read error", "addr", remote.LocalAddr(), "err", err)
+//
+// Replace it with SetLogger to send the logs of the package elsewhere.
+type Logger interface {
+	Debug(msg string, keyvals ...interface{})
+	Info(msg string, keyvals ...interface{})
+	Warn(msg string, keyvals ...interface{})
+	Error(msg string, keyvals ...interface{})
+}
+
+// SubsystemKey is the first key of the records logged through a subsystem
+// logger, its value is the name of the subsystem.
+const SubsystemKey = "subsystem"
+
+var (
+	loggerLock sync.RWMutex
+	logger     Logger = NewStdLogger(os.Stdout)
+)
+
+// SetLogger replaces the logger used by the package and the subsystem
+// loggers.
+func SetLogger(l Logger) {
+	loggerLock.Lock()
+	defer loggerLock.Unlock()
+	logger = l
+}
+
+func GetLogger() Logger {
+	loggerLock.RLock()
+	defer loggerLock.RUnlock()
+	return logger
+}
+
+// Subsystem loggers
+var (
+	TCPLog     = NewSubsystemLogger("tcp")
+	UDPLog     = NewSubsystemLogger("udp")
+	DNSLog     = NewSubsystemLogger("dns")
+	DBLog      = NewSubsystemLogger("db")
+	LicenseLog = NewSubsystemLogger("license")
+)
+
+type subsystemLogger string
+
+// NewSubsystemLogger returns a Logger that forwards to the current logger,
+// with the subsystem name as the first key value pair.
+func NewSubsystemLogger(name string) Logger {
+	return subsystemLogger(name)
+}
+
+func (s subsystemLogger) keyvals(keyvals []interface{}) []interface{} {
+	return append([]interface{}{SubsystemKey, string(s)}, keyvals...)
+}
+
+func (s subsystemLogger) Debug(msg string, keyvals ...interface{}) {
+	if l := GetLogger(); enabled(l, LevelDebug) {
+		l.Debug(msg, s.keyvals(keyvals)...)
+	}
+}
+
+func (s subsystemLogger) Info(msg string, keyvals ...interface{}) {
+	if l := GetLogger(); enabled(l, LevelInfo) {
+		l.Info(msg, s.keyvals(keyvals)...)
+	}
+}
+
+func (s subsystemLogger) Warn(msg string, keyvals ...interface{}) {
+	if l := GetLogger(); enabled(l, LevelWarn) {
+		l.Warn(msg, s.keyvals(keyvals)...)
+	}
+}
+
+func (s subsystemLogger) Error(msg string, keyvals ...interface{}) {
+	if l := GetLogger(); enabled(l, LevelError) {
+		l.Error(msg, s.keyvals(keyvals)...)
+	}
+}
+
+// enabled tells whether l may log records of level, so the key values of
+// records it would drop are not built. Loggers other than StdLogger get all.
+func enabled(l Logger, level Level) bool {
+	if std, ok := l.(*StdLogger); ok {
+		return std.enabled(level)
+	}
+	return true
+}
+
+// logLimit counts the records with the same subsystem and message in the
+// current window.
+type logLimit struct {
+	start      time.Time
+	count      int
+	suppressed int
+}
+
+const (
+	maxLogLimits        = 1024
+	defaultLogRateLimit = 10 // per minute
+)
+
+// StdLogger is the default Logger, it writes text or JSON lines. Levels can be
+// set per subsystem, and warnings and errors repeating the same message can
+// be rate limited, the number of suppressed records is reported with the
+// first record of the next window.
+type StdLogger struct {
+	// the lowest level of the logger and its subsystems, accessed with
+	// sync/atomic so records below it are dropped without the lock
+	minLevel int32
+
+	lock       sync.Mutex
+	out        io.Writer
+	json       bool
+	level      Level
+	levels     map[string]Level
+	rateLimit  int
+	rateWindow time.Duration
+	limits     map[string]*logLimit
+	now        func() time.Time
+}
+
+func NewStdLogger(out io.Writer) *StdLogger {
+	return &StdLogger{
+		minLevel: int32(LevelInfo),
+		out:      out,
+		level:    LevelInfo,
+		levels:   make(map[string]Level),
+		limits:   make(map[string]*logLimit),
+		now:      time.Now,
+	}
+}
+
+// SetJSON switches between text and JSON lines output.
+func (l *StdLogger) SetJSON(json bool) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.json = json
+}
+
+func (l *StdLogger) SetLevel(level Level) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.level = level
+	l.updateMinLevel()
+}
+
+// SetSubsystemLevel overrides the level for one subsystem.
+func (l *StdLogger) SetSubsystemLevel(subsystem string, level Level) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.levels[subsystem] = level
+	l.updateMinLevel()
+}
+
+// updateMinLevel is called with the lock held after a level changed.
+func (l *StdLogger) updateMinLevel() {
+	min := l.level
+	for _, level := range l.levels {
+		if level < min {
+			min = level
+		}
+	}
+	atomic.StoreInt32(&l.minLevel, int32(min))
+}
+
+func (l *StdLogger) enabled(level Level) bool {
+	return int32(level) >= atomic.LoadInt32(&l.minLevel)
+}
+
+// SetRateLimit allows at most n warnings and errors with the same message per
+// window, n <= 0 disables rate limiting.
+func (l *StdLogger) SetRateLimit(n int, window time.Duration) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.rateLimit = n
+	l.rateWindow = window
+}
+
+func (l *StdLogger) Debug(msg string, keyvals ...interface{}) {
+	l.log(LevelDebug, msg, keyvals)
+}
+
+func (l *StdLogger) Info(msg string, keyvals ...interface{}) {
+	l.log(LevelInfo, msg, keyvals)
+}
+
+func (l *StdLogger) Warn(msg string, keyvals ...interface{}) {
+	l.log(LevelWarn, msg, keyvals)
+}
+
+func (l *StdLogger) Error(msg string, keyvals ...interface{}) {
+	l.log(LevelError, msg, keyvals)
+}
+
+// allow applies the rate limit, it returns the number of records suppressed
+// in the previous window when a new window starts. Called with the lock held.
+func (l *StdLogger) allow(key string, now time.Time) (ok bool, suppressed int) {
+	lim, have := l.limits[key]
+	if !have || now.Sub(lim.start) >= l.rateWindow {
+		if have {
+			suppressed = lim.suppressed
+		} else if len(l.limits) >= maxLogLimits {
+			for k, v := range l.limits {
+				if now.Sub(v.start) >= l.rateWindow {
+					delete(l.limits, k)
+				}
+			}
+		}
+		lim = &logLimit{start: now}
+		l.limits[key] = lim
+	}
+	lim.count++
+	if lim.count > l.rateLimit {
+		lim.suppressed++
+		return false, 0
+	}
+	return true, suppressed
+}
+
+func (l *StdLogger) log(level Level, msg string, keyvals []interface{}) {
+	if !l.enabled(level) {
+		return
+	}
+	subsystem := ""
+	if len(keyvals) >= 2 && keyvals[0] == SubsystemKey {
+		subsystem = fmt.Sprint(keyvals[1])
+	}
+	if len(keyvals)%2 != 0 {
+		keyvals = append(keyvals, nil)
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	min, have := l.levels[subsystem]
+	if !have {
+		min = l.level
+	}
+	if level < min {
+		return
+	}
+	now := l.now()
+	if level >= LevelWarn && l.rateLimit > 0 {
+		ok, suppressed := l.allow(subsystem+"\xff"+msg, now)
+		if !ok {
+			return
+		}
+		if suppressed > 0 {
+			keyvals = append(keyvals, "suppressed", suppressed)
+		}
+	}
+
+	var buf bytes.Buffer
+	if l.json {
+		writeJSONRecord(&buf, now, level, msg, keyvals)
+	} else {
+		writeTextRecord(&buf, now, level, msg, keyvals)
+	}
+	l.out.Write(buf.Bytes())
+}
+
+// logValue turns errors and Stringers into strings, so they are readable in
+// JSON.
+func logValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case error:
+		return v.Error()
+	case fmt.Stringer:
+		return v.String()
+	}
+	return v
+}
+
+func writeJSONRecord(buf *bytes.Buffer, now time.Time, level Level, msg string, keyvals []interface{}) {
+	writeJSONField(buf, "time", now.Format(time.RFC3339Nano))
+	writeJSONField(buf, "level", level.String())
+	writeJSONField(buf, "msg", msg)
+	for i := 0; i < len(keyvals); i += 2 {
+		writeJSONField(buf, fmt.Sprint(keyvals[i]), logValue(keyvals[i+1]))
+	}
+	buf.WriteString("}\n")
+}
+
+func writeJSONField(buf *bytes.Buffer, key string, value interface{}) {
+	if buf.Len() == 0 {
+		buf.WriteByte('{')
+	} else {
+		buf.WriteByte(',')
+	}
+	k, _ := json.Marshal(key)
+	buf.Write(k)
+	buf.WriteByte(':')
+	v, err := json.Marshal(value)
+	if err != nil {
+		v, _ = json.Marshal(fmt.Sprint(value))
+	}
+	buf.Write(v)
+}
+
+func writeTextRecord(buf *bytes.Buffer, now time.Time, level Level, msg string, keyvals []interface{}) {
+	fmt.Fprintf(buf, "%s [%s] %s", now.Format("2006/01/02 15:04:05"), strings.ToUpper(level.String()), msg)
+	for i := 0; i < len(keyvals); i += 2 {
+		value := fmt.Sprint(logValue(keyvals[i+1]))
+		if value == "" || strings.ContainsAny(value, " =\"\n") {
+			value = strconv.Quote(value)
+		}
+		fmt.Fprintf(buf, " %v=%s", keyvals[i], value)
+	}
+	buf.WriteByte('\n')
+}
+
+// ConfigureLogger sets up the default logger from the log_* options of
+// config. It does nothing if the logger was replaced with SetLogger.
+func ConfigureLogger(config *Config) error {
+	l, ok := GetLogger().(*StdLogger)
+	if !ok {
+		return nil
+	}
+	switch config.LogFormat {
+	case "", "text":
+		l.SetJSON(false)
+	case "json":
+		l.SetJSON(true)
+	default:
+		return fmt.Errorf("unknown log_format %q", config.LogFormat)
+	}
+	if config.LogLevel != "" {
+		level, err := ParseLevel(config.LogLevel)
+		if err != nil {
+			return err
+		}
+		l.SetLevel(level)
+	}
+	for subsystem, name := range config.LogLevels {
+		level, err := ParseLevel(name)
+		if err != nil {
+			return err
+		}
+		l.SetSubsystemLevel(subsystem, level)
+	}
+	rateLimit := config.LogRateLimit
+	if rateLimit == 0 {
+		rateLimit = defaultLogRateLimit
+	}
+	l.SetRateLimit(rateLimit, time.Minute)
+	if Debug {
+		l.SetLevel(LevelDebug)
+	}
+	return nil
+}
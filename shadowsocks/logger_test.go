@@ -0,0 +1,112 @@
+package shadowsocks
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestLogger() (*StdLogger, *bytes.Buffer, *time.Time) {
+	var buf bytes.Buffer
+	now := time.Date(2016, 1, 2, 15, 4, 5, 0, time.UTC)
+	l := NewStdLogger(&buf)
+	l.now = func() time.Time { return now }
+	return l, &buf, &now
+}
+
+func TestStdLoggerText(t *testing.T) {
+	l, buf, _ := newTestLogger()
+	l.Info("new client", SubsystemKey, "tcp", "user", 1000, "err", errors.New("read error"))
+	want := "2016/01/02 15:04:05 [INFO] new client subsystem=tcp user=1000 err=\"read error\"\n"
+	if buf.String() != want {
+		t.Errorf("got %q, want %q", buf.String(), want)
+	}
+}
+
+func TestStdLoggerJSON(t *testing.T) {
+	l, buf, _ := newTestLogger()
+	l.SetJSON(true)
+	l.Warn("cannot decrypt", "user", 1000, "err", errors.New("bad iv"), "odd")
+	var record map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &record); err != nil {
+		t.Fatalf("invalid json %q: %v", buf.String(), err)
+	}
+	if record["level"] != "warn" || record["msg"] != "cannot decrypt" ||
+		record["user"] != float64(1000) || record["err"] != "bad iv" {
+		t.Errorf("wrong record %v", record)
+	}
+	if v, have := record["odd"]; !have || v != nil {
+		t.Errorf("key without value should be null, got %v", record)
+	}
+}
+
+func TestStdLoggerSubsystemLevel(t *testing.T) {
+	l, buf, _ := newTestLogger()
+	l.SetLevel(LevelWarn)
+	l.SetSubsystemLevel("db", LevelDebug)
+	l.Info("dropped")
+	l.Info("dropped", SubsystemKey, "tcp")
+	l.Debug("kept", SubsystemKey, "db")
+	l.Error("kept")
+	if n := strings.Count(buf.String(), "kept"); n != 2 || strings.Contains(buf.String(), "dropped") {
+		t.Errorf("wrong records %q", buf.String())
+	}
+}
+
+func TestStdLoggerRateLimit(t *testing.T) {
+	l, buf, now := newTestLogger()
+	l.SetRateLimit(2, time.Minute)
+	for i := 0; i < 5; i++ {
+		l.Warn("read user id error", SubsystemKey, "tcp")
+		l.Info("not limited")
+	}
+	l.Warn("read user id error", SubsystemKey, "udp")
+	out := buf.String()
+	if n := strings.Count(out, "read user id error subsystem=tcp"); n != 2 {
+		t.Errorf("should log 2 tcp warnings in the window, got %d", n)
+	}
+	if n := strings.Count(out, "not limited"); n != 5 {
+		t.Errorf("info should not be limited, got %d", n)
+	}
+	if n := strings.Count(out, "subsystem=udp"); n != 1 {
+		t.Errorf("subsystems should be limited separately, got %d", n)
+	}
+
+	buf.Reset()
+	*now = now.Add(time.Minute)
+	l.Warn("read user id error", SubsystemKey, "tcp")
+	if !strings.Contains(buf.String(), "suppressed=3") {
+		t.Errorf("next window should report suppressed records, got %q", buf.String())
+	}
+}
+
+func TestSubsystemLogger(t *testing.T) {
+	l, buf, _ := newTestLogger()
+	old := GetLogger()
+	SetLogger(l)
+	defer SetLogger(old)
+	UDPLog.Info("server listening", "port", "8388")
+	if !strings.Contains(buf.String(), "server listening subsystem=udp port=8388") {
+		t.Errorf("got %q", buf.String())
+	}
+}
+
+func TestStdLoggerEnabled(t *testing.T) {
+	l, _, _ := newTestLogger()
+	l.SetLevel(LevelWarn)
+	if l.enabled(LevelInfo) || !l.enabled(LevelWarn) {
+		t.Error("info should be dropped at warn level")
+	}
+	// A subsystem logging more lowers the check, log sorts it out.
+	l.SetSubsystemLevel("db", LevelDebug)
+	if !l.enabled(LevelDebug) {
+		t.Error("debug of the db subsystem should get through")
+	}
+	l.SetSubsystemLevel("db", LevelError)
+	if l.enabled(LevelInfo) {
+		t.Error("info should be dropped once no subsystem logs it")
+	}
+}
@@ -0,0 +1,568 @@
+package shadowsocks
+
+import (
+	"bytes"
+	"container/list"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultNATMaxEntries = 10000
+	// the most targets a mapping remembers the address header of
+	maxNATHeaders = 1024
+	// the most replies of a mapping waiting to be sent to the client
+	natQueueLen = 64
+	// how long a mapping keeps a failure to resolve a domain, addresses are
+	// kept for the TTL of their records
+	natDNSNegativeTTL = 5 * time.Second
+)
+
+var (
+	// ErrNATEvicted ends a mapping dropped to make room for a new one.
+	ErrNATEvicted = errors.New("nat entry evicted")
+	// ErrNATClosed ends the mappings of a closed NATTable.
+	ErrNATClosed = errors.New("nat table closed")
+)
+
+// natKey identifies a mapping. Clients behind the same address but using
+// different users get mappings of their own.
+type natKey struct {
+	userID uint32
+	src    string
+}
+
+// CachedUDPConn is the socket of a NAT mapping, packets from the client go
+// out through it and replies come back on it.
+type CachedUDPConn struct {
+	// accessed with sync/atomic
+	bytesIn    uint64 // bytes relayed for the client
+	bytesOut   uint64
+	lastActive int64 // UnixNano of the last packet either way
+
+	*net.UDPConn
+	key   natKey
+	table *NATTable
+
+	peerLock sync.Mutex
+	// headers maps the targets to the address header of the client
+	headers map[string][]byte
+	// peers are the addresses or endpoints replies are let through from
+	// under the restricted modes
+	peers map[string]struct{}
+	// domains are the domain targets resolved for the client
+	domains map[string]*natResolution
+	// client is where the replies go, the writer of the latest packet of
+	// the client, which has the current limits of the user
+	client packetWriter
+
+	// closed once the relay loop started by UDPConn.relay has ended
+	done chan struct{}
+
+	// guarded by the table lock
+	global   *list.Element
+	user     *list.Element
+	closeErr error // why the table dropped the mapping
+}
+
+// BytesIn returns the payload bytes sent from the client to the targets.
+func (c *CachedUDPConn) BytesIn() uint64 {
+	return atomic.LoadUint64(&c.bytesIn)
+}
+
+// BytesOut returns the payload bytes sent from the targets to the client.
+func (c *CachedUDPConn) BytesOut() uint64 {
+	return atomic.LoadUint64(&c.bytesOut)
+}
+
+func (c *CachedUDPConn) Close() error {
+	return c.UDPConn.Close()
+}
+
+// idleFor returns how long there has been no packet either way.
+func (c *CachedUDPConn) idleFor(now time.Time) time.Duration {
+	return now.Sub(time.Unix(0, atomic.LoadInt64(&c.lastActive)))
+}
+
+// setHeader records the address header the client used for dst, which may
+// be a domain. The latest one wins if the client sent several forms of the
+// same address.
+func (c *CachedUDPConn) setHeader(dst *net.UDPAddr, header []byte) {
+	key := dst.String()
+	c.peerLock.Lock()
+	defer c.peerLock.Unlock()
+	c.addPeerLocked(dst)
+	if old, have := c.headers[key]; have && bytes.Equal(old, header) {
+		return
+	}
+	if c.headers == nil {
+		c.headers = make(map[string][]byte)
+	} else if len(c.headers) >= maxNATHeaders {
+		// Some client sending to lots of targets, forget one.
+		for k := range c.headers {
+			delete(c.headers, k)
+			break
+		}
+	}
+	c.headers[key] = append([]byte(nil), header...)
+}
+
+// peerKey returns what identifies addr as a peer under mode.
+func peerKey(mode NATMode, addr *net.UDPAddr) string {
+	if mode == NATAddressRestricted {
+		return addr.IP.String()
+	}
+	return addr.String()
+}
+
+// addPeerLocked lets replies from dst through. Must be called with peerLock
+// held.
+func (c *CachedUDPConn) addPeerLocked(dst *net.UDPAddr) {
+	mode := c.table.mode
+	if mode == NATFullCone {
+		return
+	}
+	key := peerKey(mode, dst)
+	if _, have := c.peers[key]; have {
+		return
+	}
+	if c.peers == nil {
+		c.peers = make(map[string]struct{})
+	} else if len(c.peers) >= maxNATHeaders {
+		for k := range c.peers {
+			delete(c.peers, k)
+			break
+		}
+	}
+	c.peers[key] = struct{}{}
+}
+
+// permits tells whether a packet from raddr may be relayed to the client.
+func (c *CachedUDPConn) permits(raddr *net.UDPAddr) bool {
+	mode := c.table.mode
+	if mode == NATFullCone {
+		return true
+	}
+	c.peerLock.Lock()
+	defer c.peerLock.Unlock()
+	_, have := c.peers[peerKey(mode, raddr)]
+	return have
+}
+
+// header returns the address header for a reply from raddr: the one the
+// client used for it, or else raddr itself.
+func (c *CachedUDPConn) header(raddr net.Addr) []byte {
+	c.peerLock.Lock()
+	header, have := c.headers[raddr.String()]
+	c.peerLock.Unlock()
+	if have {
+		return header
+	}
+	header, hlen := ParseHeader(raddr)
+	return header[:hlen]
+}
+
+// setClient sends the replies of c through client from now on.
+func (c *CachedUDPConn) setClient(client packetWriter) {
+	c.peerLock.Lock()
+	c.client = client
+	c.peerLock.Unlock()
+}
+
+// natClient sends the replies of a mapping to its client, see setClient.
+type natClient struct {
+	remote *CachedUDPConn
+}
+
+func (w natClient) WritePacket(b []byte) error {
+	w.remote.peerLock.Lock()
+	client := w.remote.client
+	w.remote.peerLock.Unlock()
+	return client.WritePacket(b)
+}
+
+// natResolution is a domain resolved for a mapping, ready is closed once ip,
+// err and expires are set.
+type natResolution struct {
+	ready   chan struct{}
+	ip      net.IP
+	err     error
+	expires time.Time
+}
+
+// ipv4Only tells whether the socket of c can't reach IPv6 addresses.
+func (c *CachedUDPConn) ipv4Only() bool {
+	laddr, ok := c.LocalAddr().(*net.UDPAddr)
+	return ok && laddr.IP.To4() != nil
+}
+
+// resolve returns the address of domain for the packets of c, and until when
+// it holds. The domain is looked up once for the mapping, packets arriving
+// meanwhile wait for the answer.
+func (c *CachedUDPConn) resolve(r *Resolver, domain string) (net.IP, time.Time, error) {
+	now := time.Now()
+	c.peerLock.Lock()
+	res, have := c.domains[domain]
+	if have {
+		select {
+		case <-res.ready:
+			have = now.Before(res.expires)
+		default:
+		}
+	}
+	if have {
+		c.peerLock.Unlock()
+		<-res.ready
+		return res.ip, res.expires, res.err
+	}
+	res = &natResolution{ready: make(chan struct{})}
+	c.addDomainLocked(domain, res)
+	c.peerLock.Unlock()
+
+	res.ip, res.expires, res.err = lookupUDPTarget(r, domain, c.ipv4Only())
+	if res.err != nil {
+		atomic.AddUint64(&c.table.resolveFailed, 1)
+		res.expires = time.Now().Add(natDNSNegativeTTL)
+	}
+	close(res.ready)
+	return res.ip, res.expires, res.err
+}
+
+// resolved tells whether the address of domain is at hand, so that resolve
+// doesn't have to wait for a lookup.
+func (c *CachedUDPConn) resolved(domain string) bool {
+	c.peerLock.Lock()
+	defer c.peerLock.Unlock()
+	res, have := c.domains[domain]
+	if !have {
+		return false
+	}
+	select {
+	case <-res.ready:
+		return time.Now().Before(res.expires)
+	default:
+		return false
+	}
+}
+
+// remember keeps ip as the address of domain until expires, resolved before
+// c existed.
+func (c *CachedUDPConn) remember(domain string, ip net.IP, expires time.Time) {
+	c.peerLock.Lock()
+	defer c.peerLock.Unlock()
+	if _, have := c.domains[domain]; have {
+		return
+	}
+	res := &natResolution{ready: make(chan struct{}), ip: ip, expires: expires}
+	close(res.ready)
+	c.addDomainLocked(domain, res)
+}
+
+// addDomainLocked must be called with peerLock held.
+func (c *CachedUDPConn) addDomainLocked(domain string, res *natResolution) {
+	if c.domains == nil {
+		c.domains = make(map[string]*natResolution)
+	} else if _, have := c.domains[domain]; !have && len(c.domains) >= maxNATHeaders {
+		for k := range c.domains {
+			delete(c.domains, k)
+			break
+		}
+	}
+	c.domains[domain] = res
+}
+
+// lookupUDPTarget returns an address of domain, preferring IPv4, which a
+// socket reaching IPv4 only can use, and until when it holds. A nil
+// resolver uses the system one.
+func lookupUDPTarget(r *Resolver, domain string, ipv4Only bool) (net.IP, time.Time, error) {
+	var ips []net.IP
+	var expires time.Time
+	var err error
+	if r == nil {
+		ips, err = net.LookupIP(domain)
+		expires = time.Now().Add(systemDNSTTL)
+	} else {
+		ips, expires, err = r.lookupIP(domain)
+	}
+	if err != nil {
+		return nil, expires, err
+	}
+	for _, ip := range ips {
+		if ip.To4() != nil {
+			return ip, expires, nil
+		}
+	}
+	if ipv4Only || len(ips) == 0 {
+		return nil, expires, fmt.Errorf("no IPv4 address for %s", domain)
+	}
+	return ips[0], expires, nil
+}
+
+// NATObserver is told when a UDPConn opens and closes a NAT mapping.
+type NATObserver interface {
+	// NATOpened is called with the first target of the mapping.
+	// src is the address of the client.
+	NATOpened(userID uint32, src net.Addr, dst *net.UDPAddr, remote *CachedUDPConn)
+	// NATClosed is called with the error that ended the mapping.
+	NATClosed(remote *CachedUDPConn, err error)
+}
+
+// NATMode is how a NATTable filters the packets coming back to a client.
+// The zero value is NATAddressRestricted.
+type NATMode int
+
+const (
+	// NATAddressRestricted relays packets from the hosts the client has
+	// sent to, from any port.
+	NATAddressRestricted NATMode = iota
+	// NATPortRestricted relays packets from the exact addresses and ports
+	// the client has sent to.
+	NATPortRestricted
+	// NATFullCone relays packets from anyone who knows the mapping, some
+	// games and peer to peer applications need it.
+	NATFullCone
+)
+
+// ParseNATMode parses full_cone, address_restricted or port_restricted,
+// empty means address_restricted.
+func ParseNATMode(s string) (NATMode, error) {
+	switch s {
+	case "", "address_restricted":
+		return NATAddressRestricted, nil
+	case "port_restricted":
+		return NATPortRestricted, nil
+	case "full_cone":
+		return NATFullCone, nil
+	}
+	return 0, fmt.Errorf("unknown nat mode %s", s)
+}
+
+// NATStats are the counters of a NATTable.
+type NATStats struct {
+	Entries  int
+	Created  uint64
+	Expired  uint64 // idle for the idle timeout
+	Evicted  uint64 // dropped for the entry limits
+	Filtered uint64 // packets from peers the mode doesn't let through
+	// replies dropped because the client didn't take them fast enough
+	Dropped uint64
+	// replies dropped for being larger than the buffer of their mapping,
+	// which then grows to take any size
+	Truncated uint64
+	// packets dropped for the bandwidth of their user, either way
+	RateLimited uint64
+	// domain targets that could not be resolved
+	ResolveFailed uint64
+}
+
+// NATTable holds the UDP NAT mappings of a server. A mapping is dropped once
+// idle for the idle timeout. When the table or a user reaches its entry
+// limit, the least recently used mapping of the table or the user makes room
+// for the new one. The limit of a user is set by the UDPConn relaying its
+// packets.
+type NATTable struct {
+	// accessed with sync/atomic
+	created       uint64
+	expired       uint64
+	evicted       uint64
+	filtered      uint64
+	dropped       uint64
+	truncated     uint64
+	rateLimited   uint64
+	resolveFailed uint64
+
+	mode        NATMode
+	idleTimeout time.Duration
+	maxEntries  int
+
+	lock    sync.Mutex
+	entries map[natKey]*CachedUDPConn
+	lru     *list.List // front is the most recently used
+	users   map[uint32]*list.List
+	closed  bool
+	loops   sync.WaitGroup // relay loops of the mappings
+}
+
+// NewNATTable returns a table filtering replies by mode and dropping mappings
+// idle for idleTimeout, not positive means the udp timeout of the config.
+// maxEntries 0 means 10000.
+func NewNATTable(mode NATMode, idleTimeout time.Duration, maxEntries int) *NATTable {
+	if idleTimeout <= 0 {
+		idleTimeout = udpTimeout
+	}
+	if idleTimeout <= 0 {
+		idleTimeout = 60 * time.Second
+	}
+	if maxEntries <= 0 {
+		maxEntries = defaultNATMaxEntries
+	}
+	return &NATTable{
+		mode:        mode,
+		idleTimeout: idleTimeout,
+		maxEntries:  maxEntries,
+		entries:     make(map[natKey]*CachedUDPConn),
+		lru:         list.New(),
+		users:       make(map[uint32]*list.List),
+	}
+}
+
+var (
+	defaultNATOnce sync.Once
+	defaultNAT     *NATTable
+)
+
+// getDefaultNATTable returns the table of UDPConns without one, created on
+// first use so that it gets the udp timeout of the config.
+func getDefaultNATTable() *NATTable {
+	defaultNATOnce.Do(func() {
+		defaultNAT = NewNATTable(NATAddressRestricted, 0, 0)
+	})
+	return defaultNAT
+}
+
+// get returns the mapping of client src for userID, creating it if needed,
+// the user has at most maxPerUser mappings, 0 means no limit. The caller has
+// to run the relay loop of a created mapping and call t.loops.Done when it
+// ends.
+func (t *NATTable) get(userID uint32, src string, maxPerUser int) (c *CachedUDPConn, created bool, err error) {
+	key := natKey{userID, src}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.closed {
+		return nil, false, ErrNATClosed
+	}
+	if c, have := t.entries[key]; have {
+		t.touchLocked(c)
+		return c, false, nil
+	}
+	if userList := t.users[userID]; maxPerUser > 0 && userList != nil && userList.Len() >= maxPerUser {
+		t.evictLocked(userList.Back().Value.(*CachedUDPConn))
+	}
+	if len(t.entries) >= t.maxEntries {
+		t.evictLocked(t.lru.Back().Value.(*CachedUDPConn))
+	}
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{
+		IP:   net.IPv6zero,
+		Port: 0,
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	c = &CachedUDPConn{UDPConn: conn, key: key, table: t, done: make(chan struct{})}
+	atomic.StoreInt64(&c.lastActive, time.Now().UnixNano())
+	c.global = t.lru.PushFront(c)
+	userList := t.users[userID]
+	if userList == nil {
+		userList = list.New()
+		t.users[userID] = userList
+	}
+	c.user = userList.PushFront(c)
+	t.entries[key] = c
+	atomic.AddUint64(&t.created, 1)
+	t.loops.Add(1)
+	return c, true, nil
+}
+
+// lookup returns the mapping of client src for userID, nil if there is none.
+func (t *NATTable) lookup(userID uint32, src string) *CachedUDPConn {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.entries[natKey{userID, src}]
+}
+
+// touch marks c as just used.
+func (t *NATTable) touch(c *CachedUDPConn) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.touchLocked(c)
+}
+
+func (t *NATTable) touchLocked(c *CachedUDPConn) {
+	atomic.StoreInt64(&c.lastActive, time.Now().UnixNano())
+	if c.global != nil {
+		t.lru.MoveToFront(c.global)
+		t.users[c.key.userID].MoveToFront(c.user)
+	}
+}
+
+// removeLocked drops c from the table, it reports whether c was in it.
+func (t *NATTable) removeLocked(c *CachedUDPConn) bool {
+	if c.global == nil {
+		return false
+	}
+	t.lru.Remove(c.global)
+	userList := t.users[c.key.userID]
+	userList.Remove(c.user)
+	if userList.Len() == 0 {
+		delete(t.users, c.key.userID)
+	}
+	c.global, c.user = nil, nil
+	delete(t.entries, c.key)
+	return true
+}
+
+// evictLocked drops c for the entry limits, its relay loop ends with
+// ErrNATEvicted.
+func (t *NATTable) evictLocked(c *CachedUDPConn) {
+	if t.removeLocked(c) {
+		c.closeErr = ErrNATEvicted
+		atomic.AddUint64(&t.evicted, 1)
+		c.Close()
+	}
+}
+
+// remove drops c from the table and closes it. It returns why the mapping
+// ended: the reason the table dropped it for, if any, else err.
+func (t *NATTable) remove(c *CachedUDPConn, err error) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.removeLocked(c) {
+		c.Close()
+	}
+	if c.closeErr != nil {
+		return c.closeErr
+	}
+	return err
+}
+
+// Len returns the number of mappings.
+func (t *NATTable) Len() int {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return len(t.entries)
+}
+
+// Stats returns the counters of the table.
+func (t *NATTable) Stats() NATStats {
+	return NATStats{
+		Entries:       t.Len(),
+		Created:       atomic.LoadUint64(&t.created),
+		Expired:       atomic.LoadUint64(&t.expired),
+		Evicted:       atomic.LoadUint64(&t.evicted),
+		Filtered:      atomic.LoadUint64(&t.filtered),
+		Dropped:       atomic.LoadUint64(&t.dropped),
+		Truncated:     atomic.LoadUint64(&t.truncated),
+		RateLimited:   atomic.LoadUint64(&t.rateLimited),
+		ResolveFailed: atomic.LoadUint64(&t.resolveFailed),
+	}
+}
+
+// Close drops all mappings and waits for their relay loops to end. No new
+// mappings are created afterwards.
+func (t *NATTable) Close() error {
+	t.lock.Lock()
+	t.closed = true
+	for _, c := range t.entries {
+		if t.removeLocked(c) {
+			c.closeErr = ErrNATClosed
+			c.Close()
+		}
+	}
+	t.lock.Unlock()
+	t.loops.Wait()
+	return nil
+}
@@ -0,0 +1,501 @@
+package shadowsocks
+
+import (
+	"bytes"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// openNAT gets the mapping of src for userID, who has at most maxPerUser, and
+// runs a relay loop for it that just waits for the socket to close.
+func openNAT(t *testing.T, table *NATTable, userID uint32, src string, maxPerUser int) *CachedUDPConn {
+	c, created, err := table.get(userID, src, maxPerUser)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if created {
+		go func() {
+			defer table.loops.Done()
+			buf := make([]byte, 64)
+			_, _, err := c.ReadFrom(buf)
+			table.remove(c, err)
+		}()
+	}
+	return c
+}
+
+func natKeys(table *NATTable) map[natKey]bool {
+	table.lock.Lock()
+	defer table.lock.Unlock()
+	keys := make(map[natKey]bool)
+	for key := range table.entries {
+		keys[key] = true
+	}
+	return keys
+}
+
+func TestNATTableLimits(t *testing.T) {
+	table := NewNATTable(NATAddressRestricted, time.Minute, 3)
+	openNAT(t, table, 1, "10.0.0.1:1000", 2)
+	openNAT(t, table, 1, "10.0.0.1:1001", 2)
+	openNAT(t, table, 1, "10.0.0.1:1000", 2)
+	// The user is at its limit, its least recently used mapping goes.
+	openNAT(t, table, 1, "10.0.0.1:1002", 2)
+	keys := natKeys(table)
+	if len(keys) != 2 || keys[natKey{1, "10.0.0.1:1001"}] {
+		t.Fatalf("per user eviction, got %v", keys)
+	}
+	// The same address of another user is another mapping.
+	openNAT(t, table, 2, "10.0.0.1:1000", 2)
+	// The table is full, the least recently used mapping of all goes.
+	openNAT(t, table, 2, "10.0.0.2:1000", 2)
+	keys = natKeys(table)
+	if len(keys) != 3 || keys[natKey{1, "10.0.0.1:1000"}] || !keys[natKey{2, "10.0.0.1:1000"}] {
+		t.Fatalf("table eviction, got %v", keys)
+	}
+	if stats := table.Stats(); stats.Created != 5 || stats.Evicted != 2 || stats.Entries != 3 {
+		t.Errorf("got %+v", stats)
+	}
+
+	table.Close()
+	if n := table.Len(); n != 0 {
+		t.Errorf("closed table has %d entries", n)
+	}
+	if _, _, err := table.get(1, "10.0.0.3:1000", 0); err != ErrNATClosed {
+		t.Errorf("closed table should not open mappings, got %v", err)
+	}
+}
+
+func TestNATTableIdle(t *testing.T) {
+	table := NewNATTable(NATAddressRestricted, 100*time.Millisecond, 0)
+	src, _ := net.ResolveUDPAddr("udp", "10.0.0.1:1000")
+	c, _, err := table.get(1, src.String(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() {
+		defer table.loops.Done()
+		done <- table.remove(c, Pipeloop(&udpClient{conn: &UDPConn{}, addr: src}, c))
+	}()
+
+	// Packets to the target keep the mapping alive.
+	time.Sleep(60 * time.Millisecond)
+	table.touch(c)
+	time.Sleep(70 * time.Millisecond)
+	select {
+	case <-done:
+		t.Fatal("mapping expired although it was used")
+	default:
+	}
+	select {
+	case err := <-done:
+		if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+			t.Errorf("should end with a timeout, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("idle mapping did not expire")
+	}
+	if stats := table.Stats(); stats.Expired != 1 || stats.Entries != 0 {
+		t.Errorf("got %+v", stats)
+	}
+}
+
+func TestNATSessionHeaders(t *testing.T) {
+	table := NewNATTable(NATAddressRestricted, time.Minute, 0)
+	defer table.Close()
+	a := openNAT(t, table, 1, "10.0.0.1:1000", 0)
+	b := openNAT(t, table, 2, "10.0.0.1:1000", 0)
+	dst := &net.UDPAddr{IP: net.ParseIP("93.184.216.34"), Port: 53}
+	domain := append([]byte{typeDm, 11}, "example.com\x00\x35"...)
+	a.setHeader(dst, domain)
+
+	// Replies come from an IPv6 socket, IPv4 addresses may be mapped.
+	raddr := &net.UDPAddr{IP: net.ParseIP("::ffff:93.184.216.34"), Port: 53}
+	if h := a.header(raddr); !bytes.Equal(h, domain) {
+		t.Errorf("session a should get its domain header, got %v", h)
+	}
+	want := []byte{typeIPv4, 93, 184, 216, 34, 0, 53}
+	if h := b.header(raddr); !bytes.Equal(h, want) {
+		t.Errorf("session b sent nothing to the domain, got %v", h)
+	}
+	// The client switching to the IP gets IP replies again.
+	a.setHeader(dst, want)
+	if h := a.header(raddr); !bytes.Equal(h, want) {
+		t.Errorf("latest header should win, got %v", h)
+	}
+}
+
+func TestNATModes(t *testing.T) {
+	dst := &net.UDPAddr{IP: net.ParseIP("93.184.216.34"), Port: 3478}
+	sameHost := &net.UDPAddr{IP: net.ParseIP("::ffff:93.184.216.34"), Port: 3479}
+	stranger := &net.UDPAddr{IP: net.ParseIP("198.51.100.1"), Port: 3478}
+	tests := []struct {
+		mode                          string
+		fromDst, fromHost, fromOthers bool
+	}{
+		{"full_cone", true, true, true},
+		{"", true, true, false},
+		{"port_restricted", true, false, false},
+	}
+	for _, test := range tests {
+		mode, err := ParseNATMode(test.mode)
+		if err != nil {
+			t.Fatal(err)
+		}
+		table := NewNATTable(mode, time.Minute, 0)
+		c := openNAT(t, table, 1, "10.0.0.1:1000", 0)
+		c.setHeader(dst, []byte{typeIPv4, 93, 184, 216, 34, 0x0d, 0x96})
+		if c.permits(dst) != test.fromDst || c.permits(sameHost) != test.fromHost || c.permits(stranger) != test.fromOthers {
+			t.Errorf("%q: got %v %v %v", test.mode, c.permits(dst), c.permits(sameHost), c.permits(stranger))
+		}
+		table.Close()
+	}
+	if _, err := ParseNATMode("symmetric"); err == nil {
+		t.Error("unknown mode should fail")
+	}
+}
+
+// blockedClient is a client that takes no replies until unblocked.
+type blockedClient struct {
+	unblock chan struct{}
+	got     chan []byte
+}
+
+func (c *blockedClient) WritePacket(b []byte) error {
+	<-c.unblock
+	c.got <- b
+	return nil
+}
+
+func TestNATQueueDrops(t *testing.T) {
+	table := NewNATTable(NATFullCone, time.Minute, 0)
+	defer table.Close()
+	c, _, err := table.get(1, "10.0.0.1:1000", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &blockedClient{unblock: make(chan struct{}), got: make(chan []byte, 2*natQueueLen)}
+	go func() {
+		defer table.loops.Done()
+		table.remove(c, Pipeloop(client, c))
+	}()
+
+	peer, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+	dst := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: c.LocalAddr().(*net.UDPAddr).Port}
+	const sent = natQueueLen + 10
+	for i := 0; i < sent; i++ {
+		peer.WriteToUDP([]byte{byte(i)}, dst)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for table.Stats().Dropped == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	close(client.unblock)
+	received := 0
+	for received+int(table.Stats().Dropped) < sent && time.Now().Before(deadline) {
+		select {
+		case <-client.got:
+			received++
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+	// One reply is being written, the queue holds the next ones.
+	if dropped := table.Stats().Dropped; dropped == 0 || received > natQueueLen+1 || received+int(dropped) != sent {
+		t.Errorf("received %d, dropped %d of %d", received, dropped, sent)
+	}
+}
+
+func TestUDPAccountRead(t *testing.T) {
+	table := NewNATTable(NATAddressRestricted, time.Minute, 0)
+	// 1000 bytes per second, a full bucket of 1000 bytes.
+	c := &UDPConn{NAT: table, UserID: 1, ReadBucket: NewBucketWithRate(1000, 1000, 0)}
+	if !c.AccountRead(1500) {
+		t.Fatal("the first packet should pass and put the bucket in debt")
+	}
+	if c.AccountRead(100) {
+		t.Error("packets over the bandwidth should be dropped")
+	}
+	if n := table.Stats().RateLimited; n != 1 {
+		t.Errorf("rate limited %d, want 1", n)
+	}
+}
+
+func TestNATResolve(t *testing.T) {
+	r, err := NewResolver(&Config{DNSHosts: map[string][]string{
+		"game.example": {"2001:db8::1", "192.0.2.1"},
+		"v6.example":   {"2001:db8::2"},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	table := NewNATTable(NATAddressRestricted, time.Minute, 0)
+	defer table.Close()
+	c := openNAT(t, table, 1, "10.0.0.1:1000", 0)
+	if ip, _, err := c.resolve(r, "game.example"); err != nil || !ip.Equal(net.ParseIP("192.0.2.1")) {
+		t.Fatalf("got %v %v, IPv4 should be preferred", ip, err)
+	}
+	// The mapping keeps the answer, other mappings look it up again.
+	r.hosts["game.example"] = []net.IP{net.ParseIP("192.0.2.9")}
+	conn := &UDPConn{NAT: table, UserID: 1, Resolver: r}
+	if ip, _, _ := conn.resolve("10.0.0.1:1000", "game.example"); !ip.Equal(net.ParseIP("192.0.2.1")) {
+		t.Errorf("mapping should keep its answer, got %v", ip)
+	}
+	if ip, _, _ := conn.resolve("10.0.0.2:1000", "game.example"); !ip.Equal(net.ParseIP("192.0.2.9")) {
+		t.Errorf("client without mapping should look up, got %v", ip)
+	}
+
+	if _, _, err := lookupUDPTarget(r, "v6.example", true); err == nil {
+		t.Error("IPv6 address for a socket reaching IPv4 only")
+	}
+	if ip, _, err := lookupUDPTarget(r, "v6.example", false); err != nil || !ip.Equal(net.ParseIP("2001:db8::2")) {
+		t.Errorf("got %v %v", ip, err)
+	}
+
+	// Nothing listens there, lookups fail right away.
+	broken, err := NewResolver(&Config{DNSServers: []string{"127.0.0.1:1"}, DNSTimeout: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if _, _, err := c.resolve(broken, "missing.example"); err == nil {
+			t.Fatal("lookup should fail")
+		}
+	}
+	if n := table.Stats().ResolveFailed; n != 1 {
+		t.Errorf("failed %d times, the failure should be kept", n)
+	}
+}
+
+func TestNATResolveTTL(t *testing.T) {
+	addr, queries := fakeDNSServer(t, map[string]net.IP{"game.example": net.ParseIP("192.0.2.1")}, 300)
+	r, err := NewResolver(&Config{DNSServers: []string{addr}, DNSCacheSize: -1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	table := NewNATTable(NATAddressRestricted, time.Minute, 0)
+	defer table.Close()
+	c := openNAT(t, table, 1, "10.0.0.1:1000", 0)
+	start := time.Now()
+	ip, expires, err := c.resolve(r, "game.example")
+	if err != nil || !ip.Equal(net.ParseIP("192.0.2.1")) {
+		t.Fatalf("got %v %v", ip, err)
+	}
+	if ttl := expires.Sub(start); ttl < 299*time.Second || ttl > 301*time.Second {
+		t.Errorf("answer kept for %v, want the TTL of the record", ttl)
+	}
+	if !c.resolved("game.example") || c.resolved("other.example") {
+		t.Error("only the domain looked up should be at hand")
+	}
+	// Past the TTL the domain is looked up again, the resolver cache is
+	// off.
+	c.domains["game.example"].expires = start.Add(-time.Second)
+	if c.resolved("game.example") {
+		t.Error("expired answer should be looked up again")
+	}
+	c.resolve(r, "game.example")
+	if n := atomic.LoadInt32(queries); n != 2 {
+		t.Errorf("sent %d queries, want 2", n)
+	}
+}
+
+func TestNATRepliesFollowClient(t *testing.T) {
+	echo, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	silent, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer silent.Close()
+	table := NewNATTable(NATAddressRestricted, time.Minute, 0)
+	defer table.Close()
+	c := &UDPConn{NAT: table, UserID: 1}
+	src := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 1000}
+	relay := func(dst net.Addr, client packetWriter) {
+		header, _ := ParseHeader(dst)
+		target, err := c.parseTarget(src.String(), header)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := c.relay(src.String(), src, target, []byte("ping"), client); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The writer of the latest packet, with the current limits of the
+	// user, sends the replies.
+	first := &blockedClient{unblock: make(chan struct{}), got: make(chan []byte, 1)}
+	close(first.unblock)
+	relay(silent.LocalAddr(), first)
+	latest := &blockedClient{unblock: make(chan struct{}), got: make(chan []byte, 1)}
+	close(latest.unblock)
+	relay(echo.LocalAddr(), latest)
+	buf := make([]byte, 64)
+	echo.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, addr, err := echo.ReadFromUDP(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	echo.WriteToUDP(buf[:n], addr)
+	select {
+	case <-latest.got:
+	case <-first.got:
+		t.Error("reply sent through the writer of an older packet")
+	case <-time.After(5 * time.Second):
+		t.Error("no reply")
+	}
+}
+
+func TestPipeloopWaitsForSender(t *testing.T) {
+	table := NewNATTable(NATFullCone, time.Minute, 0)
+	defer table.Close()
+	c, _, err := table.get(1, "10.0.0.1:1000", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &blockedClient{unblock: make(chan struct{}), got: make(chan []byte, 8)}
+	ended := make(chan struct{})
+	go func() {
+		defer table.loops.Done()
+		table.remove(c, Pipeloop(client, c))
+		close(ended)
+	}()
+
+	peer, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+	dst := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: c.LocalAddr().(*net.UDPAddr).Port}
+	for i := 0; i < 3; i++ {
+		peer.WriteToUDP([]byte{byte(i)}, dst)
+	}
+	time.Sleep(50 * time.Millisecond)
+	table.remove(c, nil)
+	select {
+	case <-ended:
+		t.Fatal("Pipeloop returned while a reply was being written")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(client.unblock)
+	select {
+	case <-ended:
+	case <-time.After(time.Second):
+		t.Fatal("Pipeloop did not return")
+	}
+	// The reply being written goes out, the queued ones are dropped.
+	if n := len(client.got); n != 1 {
+		t.Errorf("%d replies written after the mapping closed", n)
+	}
+}
+
+func TestUDPWriteRateLimited(t *testing.T) {
+	table := NewNATTable(NATAddressRestricted, time.Minute, 0)
+	sock, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sock.Close()
+	cipher, err := NewCipher("aes-128-cfb", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := NewUDPConn(sock, cipher)
+	c.NAT = table
+	c.WriteBucket = NewBucketWithRate(1000, 1000, 0)
+	dst := sock.LocalAddr().(*net.UDPAddr)
+	if _, err := c.WriteToUDP(make([]byte, 1500), dst, false); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	if _, err := c.WriteToUDP(make([]byte, 100), dst, false); err == nil {
+		t.Error("replies over the bandwidth should be dropped")
+	}
+	if time.Since(start) > time.Second {
+		t.Error("a reply over the bandwidth should not wait long")
+	}
+	if n := table.Stats().RateLimited; n != 1 {
+		t.Errorf("rate limited %d, want 1", n)
+	}
+}
+
+// pipeloopReplies relays the replies sent to a new mapping of table and
+// returns the sizes of those that reach the client.
+func pipeloopReplies(t *testing.T, table *NATTable, replies ...int) []int {
+	c, _, err := table.get(1, "10.0.0.1:1000", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &blockedClient{unblock: make(chan struct{}), got: make(chan []byte, 8)}
+	close(client.unblock)
+	go func() {
+		defer table.loops.Done()
+		table.remove(c, Pipeloop(client, c))
+	}()
+
+	peer, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+	dst := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: c.LocalAddr().(*net.UDPAddr).Port}
+	for _, n := range replies {
+		peer.WriteToUDP(make([]byte, n), dst)
+	}
+	// The last reply tells all before it were handled.
+	peer.WriteToUDP([]byte("end"), dst)
+	header := len(c.header(peer.LocalAddr().(*net.UDPAddr)))
+	var sizes []int
+	for {
+		select {
+		case packet := <-client.got:
+			if len(packet) == header+3 {
+				return sizes
+			}
+			sizes = append(sizes, len(packet)-header)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("got replies of %v bytes", sizes)
+		}
+	}
+}
+
+func TestPipeloopLargeReplies(t *testing.T) {
+	table := NewNATTable(NATFullCone, time.Minute, 0)
+	defer table.Close()
+	// The first large reply gets through, not only the ones after it.
+	large := 2 * leakyBufSize
+	sizes := pipeloopReplies(t, table, 5, large, large)
+	if len(sizes) != 3 || sizes[0] != 5 || sizes[1] != large || sizes[2] != large {
+		t.Errorf("got replies of %v bytes", sizes)
+	}
+	if n := table.Stats().Truncated; n != 0 {
+		t.Errorf("truncated %d, want 0", n)
+	}
+}
+
+func TestPipeloopOversizedReplies(t *testing.T) {
+	SetMaxUDPSize(1000)
+	defer SetMaxUDPSize(0)
+	table := NewNATTable(NATFullCone, time.Minute, 0)
+	defer table.Close()
+	oversize := UDPOversizeDrops()
+	sizes := pipeloopReplies(t, table, 900, 2000, 900)
+	if len(sizes) != 2 || sizes[0] != 900 || sizes[1] != 900 {
+		t.Errorf("got replies of %v bytes, want the oversized one dropped", sizes)
+	}
+	if n := UDPOversizeDrops() - oversize; n != 1 {
+		t.Errorf("oversize drops %d, want 1", n)
+	}
+	if n := table.Stats().Truncated; n != 0 {
+		t.Errorf("truncated %d, want 0", n)
+	}
+}
@@ -3,31 +3,36 @@ package shadowsocks
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
 	"io"
 	"net"
 	"time"
 )
 
+var errOTAMismatch = errors.New("one time auth chunk mismatch")
+
 func SetReadTimeout(c net.Conn) {
 	if readTimeout != 0 {
 		c.SetReadDeadline(time.Now().Add(readTimeout))
 	}
 }
 
-// PipeThenClose copies data from src to dst, closes dst when done.
-func PipeThenClose(src, dst net.Conn) {
+// PipeThenClose copies data from src to dst, closes dst when done. It returns
+// the error that ended the copy, nil if src reached EOF.
+func PipeThenClose(src, dst net.Conn) (err error) {
 	defer dst.Close()
 	buf := leakyBuf.Get()
 	defer leakyBuf.Put(buf)
 	for {
 		SetReadTimeout(src)
-		n, err := src.Read(buf)
+		var n int
+		n, err = src.Read(buf)
 		// read may return EOF with n > 0
 		// should always process n > 0 bytes before handling error
 		if n > 0 {
 			// Note: avoid overwrite err returned by Read.
-			if _, err := dst.Write(buf[0:n]); err != nil {
-				break
+			if _, werr := dst.Write(buf[0:n]); werr != nil {
+				return werr
 			}
 		}
 		if err != nil {
@@ -42,10 +47,15 @@ func PipeThenClose(src, dst net.Conn) {
 			break
 		}
 	}
+	if err == io.EOF {
+		err = nil
+	}
+	return
 }
 
 // PipeThenClose copies data from src to dst, closes dst when done, with ota verification.
-func PipeThenCloseOta(src *Conn, dst net.Conn) {
+// It returns the error that ended the copy like PipeThenClose.
+func PipeThenCloseOta(src *Conn, dst net.Conn) (err error) {
 	const (
 		dataLenLen  = 2
 		hmacSha1Len = 10
@@ -60,12 +70,13 @@ func PipeThenCloseOta(src *Conn, dst net.Conn) {
 	defer leakyBuf.Put(buf)
 	for i := 1; ; i += 1 {
 		SetReadTimeout(src)
-		if n, err := io.ReadFull(src, buf[:dataLenLen+hmacSha1Len]); err != nil {
+		var n int
+		if n, err = io.ReadFull(src, buf[:dataLenLen+hmacSha1Len]); err != nil {
 			if err == io.EOF {
-				break
+				return nil
 			}
 			Debug.Printf("conn=%p #%v read header error n=%v: %v", src, i, n, err)
-			break
+			return
 		}
 		dataLen := binary.BigEndian.Uint16(buf[:dataLenLen])
 		expectedHmacSha1 := buf[dataLenLen:idxData0]
@@ -76,12 +87,12 @@ func PipeThenCloseOta(src *Conn, dst net.Conn) {
 		} else {
 			dataBuf = buf[idxData0 : idxData0+dataLen]
 		}
-		if n, err := io.ReadFull(src, dataBuf); err != nil {
+		if n, err = io.ReadFull(src, dataBuf); err != nil {
 			if err == io.EOF {
-				break
+				return nil
 			}
 			Debug.Printf("conn=%p #%v read data error n=%v: %v", src, i, n, err)
-			break
+			return
 		}
 		chunkIdBytes := make([]byte, 4)
 		chunkId := src.GetAndIncrChunkId()
@@ -89,11 +100,11 @@ func PipeThenCloseOta(src *Conn, dst net.Conn) {
 		actualHmacSha1 := HmacSha1(append(src.GetIv(), chunkIdBytes...), dataBuf)
 		if !bytes.Equal(expectedHmacSha1, actualHmacSha1) {
 			Debug.Printf("conn=%p #%v read data hmac-sha1 mismatch, iv=%v chunkId=%v src=%v dst=%v len=%v expeced=%v actual=%v", src, i, src.GetIv(), chunkId, src.RemoteAddr(), dst.RemoteAddr(), dataLen, expectedHmacSha1, actualHmacSha1)
-			break
+			return errOTAMismatch
 		}
-		if n, err := dst.Write(dataBuf); err != nil {
+		if n, err = dst.Write(dataBuf); err != nil {
 			Debug.Printf("conn=%p #%v write data error n=%v: %v", dst, i, n, err)
-			break
+			return
 		}
 	}
 }
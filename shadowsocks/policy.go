@@ -0,0 +1,156 @@
+package shadowsocks
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Building blocks of bandwidth policies: time windows that switch the rate
+// of a user on a weekly schedule, and burst credits that let a user go
+// faster until some amount of traffic is used up.
+
+var weekdayNames = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// TimeWindow is a daily time range on some days of the week, in the time
+// zone of Location.
+type TimeWindow struct {
+	days     [7]bool
+	from, to int // minutes since midnight, to <= from means until the next day
+	Location *time.Location
+}
+
+// ParseTimeWindow parses a window like ("mon-fri", "22:00", "06:00"). days is
+// a comma separated list of days (sun, mon, ...) and day ranges, empty or *
+// means every day. A window ending at or before its start runs into the next
+// day, it belongs to the day it starts on. loc nil means local time.
+func ParseTimeWindow(days, from, to string, loc *time.Location) (*TimeWindow, error) {
+	if loc == nil {
+		loc = time.Local
+	}
+	w := &TimeWindow{Location: loc}
+	var err error
+	if w.from, err = parseClock(from); err != nil {
+		return nil, err
+	}
+	if w.to, err = parseClock(to); err != nil {
+		return nil, err
+	}
+	days = strings.ToLower(strings.TrimSpace(days))
+	if days == "" || days == "*" {
+		for d := range w.days {
+			w.days[d] = true
+		}
+		return w, nil
+	}
+	for _, part := range strings.Split(days, ",") {
+		part = strings.TrimSpace(part)
+		first, last := part, part
+		if i := strings.Index(part, "-"); i >= 0 {
+			first, last = part[:i], part[i+1:]
+		}
+		lo, ok1 := weekdayNames[first]
+		hi, ok2 := weekdayNames[last]
+		if !ok1 || !ok2 {
+			return nil, fmt.Errorf("invalid days %q", days)
+		}
+		// Ranges may wrap around the week, like fri-mon.
+		for d := lo; ; d = (d + 1) % 7 {
+			w.days[d] = true
+			if d == hi {
+				break
+			}
+		}
+	}
+	return w, nil
+}
+
+// parseClock parses hh:mm into minutes since midnight, 24:00 is allowed.
+func parseClock(s string) (int, error) {
+	parts := strings.Split(strings.TrimSpace(s), ":")
+	if len(parts) != 2 {
+		return 0, fmt.Errorf("invalid time %q, should be hh:mm", s)
+	}
+	hour, err1 := strconv.Atoi(parts[0])
+	minute, err2 := strconv.Atoi(parts[1])
+	if err1 != nil || err2 != nil || hour < 0 || minute < 0 || minute > 59 ||
+		hour*60+minute > 24*60 {
+		return 0, fmt.Errorf("invalid time %q, should be hh:mm", s)
+	}
+	return hour*60 + minute, nil
+}
+
+// Contains tells whether t is in the window.
+func (w *TimeWindow) Contains(t time.Time) bool {
+	t = t.In(w.Location)
+	minute := t.Hour()*60 + t.Minute()
+	day := t.Weekday()
+	if w.from < w.to {
+		return w.days[day] && minute >= w.from && minute < w.to
+	}
+	if minute >= w.from {
+		return w.days[day]
+	}
+	// After midnight, the window started the day before.
+	return minute < w.to && w.days[(day+6)%7]
+}
+
+// BurstCredit is an allowance of bytes that depletes with usage and refills
+// at a steady rate, up to its capacity. It starts full.
+type BurstCredit struct {
+	lock     sync.Mutex
+	capacity int64
+	refill   float64 // bytes per second
+	credit   float64
+	last     time.Time
+}
+
+// NewBurstCredit returns a full credit of capacity bytes, refilling refill
+// bytes per second.
+func NewBurstCredit(capacity int64, refill float64, now time.Time) *BurstCredit {
+	return &BurstCredit{
+		capacity: capacity,
+		refill:   refill,
+		credit:   float64(capacity),
+		last:     now,
+	}
+}
+
+func (c *BurstCredit) adjust(now time.Time) {
+	if now.After(c.last) {
+		c.credit += c.refill * now.Sub(c.last).Seconds()
+		if c.credit > float64(c.capacity) {
+			c.credit = float64(c.capacity)
+		}
+		c.last = now
+	}
+}
+
+// Use charges count bytes to the credit, it never goes below zero.
+func (c *BurstCredit) Use(now time.Time, count int64) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.adjust(now)
+	c.credit -= float64(count)
+	if c.credit < 0 {
+		c.credit = 0
+	}
+}
+
+// Available returns the bytes left at now.
+func (c *BurstCredit) Available(now time.Time) int64 {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.adjust(now)
+	return int64(c.credit)
+}
@@ -0,0 +1,76 @@
+package shadowsocks
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTimeWindow(t *testing.T) {
+	loc := time.FixedZone("UTC+8", 8*3600)
+	w, err := ParseTimeWindow("mon-fri", "22:00", "06:00", loc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		t    time.Time
+		want bool
+	}{
+		// 2024-01-01 is a Monday.
+		{time.Date(2024, 1, 1, 23, 0, 0, 0, loc), true},
+		{time.Date(2024, 1, 2, 5, 59, 0, 0, loc), true},
+		{time.Date(2024, 1, 2, 6, 0, 0, 0, loc), false},
+		{time.Date(2024, 1, 1, 12, 0, 0, 0, loc), false},
+		// Friday night runs into Saturday, Saturday night is not in.
+		{time.Date(2024, 1, 6, 3, 0, 0, 0, loc), true},
+		{time.Date(2024, 1, 6, 23, 0, 0, 0, loc), false},
+		// Monday early morning belongs to the Sunday window.
+		{time.Date(2024, 1, 1, 3, 0, 0, 0, loc), false},
+		// Other time zones are converted.
+		{time.Date(2024, 1, 1, 15, 0, 0, 0, time.UTC), true},
+	}
+	for _, test := range tests {
+		if got := w.Contains(test.t); got != test.want {
+			t.Errorf("%v: got %v, want %v", test.t, got, test.want)
+		}
+	}
+
+	w, err = ParseTimeWindow("sat,sun", "00:00", "24:00", loc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !w.Contains(time.Date(2024, 1, 7, 23, 59, 0, 0, loc)) || w.Contains(time.Date(2024, 1, 8, 0, 0, 0, 0, loc)) {
+		t.Error("whole day window on weekends")
+	}
+	w, err = ParseTimeWindow("fri-mon", "09:00", "10:00", loc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !w.Contains(time.Date(2024, 1, 7, 9, 30, 0, 0, loc)) || w.Contains(time.Date(2024, 1, 3, 9, 30, 0, 0, loc)) {
+		t.Error("day range wrapping around the week")
+	}
+
+	for _, bad := range [][3]string{{"mon-fry", "1:00", "2:00"}, {"", "25:00", "2:00"}, {"", "1", "2:00"}} {
+		if _, err := ParseTimeWindow(bad[0], bad[1], bad[2], loc); err == nil {
+			t.Errorf("%v should fail", bad)
+		}
+	}
+}
+
+func TestBurstCredit(t *testing.T) {
+	now := time.Now()
+	c := NewBurstCredit(1000, 10, now)
+	c.Use(now, 600)
+	if avail := c.Available(now); avail != 400 {
+		t.Errorf("available %d, want 400", avail)
+	}
+	c.Use(now, 600)
+	if avail := c.Available(now); avail != 0 {
+		t.Errorf("credit should not go below zero, available %d", avail)
+	}
+	if avail := c.Available(now.Add(30 * time.Second)); avail != 300 {
+		t.Errorf("available %d after refill, want 300", avail)
+	}
+	if avail := c.Available(now.Add(time.Hour)); avail != 1000 {
+		t.Errorf("refill should stop at the capacity, available %d", avail)
+	}
+}
@@ -9,12 +9,49 @@ package shadowsocks
 
 import (
 	// "log"
+	"errors"
 	"math"
 	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
+// Totals of the time spent waiting for tokens by all buckets.
+var (
+	bucketWaits     uint64
+	bucketWaitNanos uint64
+)
+
+// BucketWaitStats returns how many times callers had to wait for tokens and
+// the total time they waited.
+func BucketWaitStats() (waits uint64, total time.Duration) {
+	return atomic.LoadUint64(&bucketWaits), time.Duration(atomic.LoadUint64(&bucketWaitNanos))
+}
+
+func countWait(d time.Duration) {
+	atomic.AddUint64(&bucketWaits, 1)
+	atomic.AddUint64(&bucketWaitNanos, uint64(d))
+}
+
+func sleepForTokens(d time.Duration) {
+	countWait(d)
+	time.Sleep(d)
+}
+
+// ErrWaitCanceled is returned by WaitReady when the wait is canceled, like
+// when the connection waiting for tokens is closed.
+var ErrWaitCanceled = errors.New("wait for bandwidth canceled")
+
+// bucketTimeout is returned by WaitReady when the tokens won't be there
+// before the deadline. It is a net.Error, so it is handled like the read or
+// write timeout it stands for.
+type bucketTimeout struct{}
+
+func (bucketTimeout) Error() string   { return "i/o timeout waiting for bandwidth" }
+func (bucketTimeout) Timeout() bool   { return true }
+func (bucketTimeout) Temporary() bool { return true }
+
 // Bucket represents a token bucket that fills at a predetermined rate.
 // Methods on Bucket may be called concurrently.
 type Bucket struct {
@@ -23,6 +60,9 @@ type Bucket struct {
 	quantum      int64
 	fillInterval time.Duration
 	OriginRate   int64
+	// Parent, if set, is a bucket shared with other buckets, like a server
+	// wide limit. Tokens are taken from the bucket and all its ancestors.
+	Parent *Bucket
 
 	// The mutex guards the fields following it.
 	mu sync.Mutex
@@ -103,8 +143,14 @@ func NewBucketWithQuantum(fillInterval time.Duration, capacity, quantum int64) *
 // Wait takes count tokens from the bucket, waiting until they are
 // available.
 func (tb *Bucket) Wait(count int64) {
-	if d := tb.Take(count); d > 0 {
-		time.Sleep(d)
+	d := tb.Take(count)
+	for p := tb.Parent; p != nil; p = p.Parent {
+		if pd := p.Take(count); pd > d {
+			d = pd
+		}
+	}
+	if d > 0 {
+		sleepForTokens(d)
 	}
 }
 
@@ -115,15 +161,87 @@ func (tb *Bucket) Wait(count int64) {
 // If no tokens have been removed, it returns immediately.
 func (tb *Bucket) WaitMaxDuration(count int64, maxWait time.Duration) bool {
 	d, ok := tb.TakeMaxDuration(count, maxWait)
+	for p := tb.Parent; p != nil; p = p.Parent {
+		if pd, pok := p.TakeMaxDuration(count, maxWait); pok && pd > d {
+			d = pd
+		}
+	}
 	if d > 0 {
 		// log.Printf("Sleep Time: %v\n", d)
-		time.Sleep(d)
+		sleepForTokens(d)
 	}
 	return ok
 }
 
 const infinityDuration time.Duration = 0x7fffffffffffffff
 
+// Account takes count tokens for a transfer that already happened, the
+// bucket and its ancestors go into debt if there are not enough. It never
+// blocks, the debt is paid by the next WaitReady.
+func (tb *Bucket) Account(count int64) {
+	now := time.Now()
+	tb.take(now, count, infinityDuration)
+	for p := tb.Parent; p != nil; p = p.Parent {
+		p.take(now, count, infinityDuration)
+	}
+}
+
+// WaitReady waits until the bucket and its ancestors are out of debt. Waiting
+// before a transfer and accounting for it afterwards limits the rate without
+// knowing the size of the transfer up front. It returns early with a timeout
+// if the tokens won't be there before deadline, unless it is zero, and with
+// ErrWaitCanceled when cancel is closed.
+func (tb *Bucket) WaitReady(deadline time.Time, cancel <-chan struct{}) error {
+	for {
+		now := time.Now()
+		d := tb.readyIn(now)
+		for p := tb.Parent; p != nil; p = p.Parent {
+			if pd := p.readyIn(now); pd > d {
+				d = pd
+			}
+		}
+		if d <= 0 {
+			return nil
+		}
+		if !deadline.IsZero() && now.Add(d).After(deadline) {
+			return bucketTimeout{}
+		}
+		countWait(d)
+		timer := time.NewTimer(d)
+		select {
+		case <-timer.C:
+		case <-cancel:
+			timer.Stop()
+			return ErrWaitCanceled
+		}
+		// Other users of the bucket may have taken the tokens, check again.
+	}
+}
+
+// give puts back count tokens taken for a transfer that moved less than
+// expected.
+func (tb *Bucket) give(now time.Time, count int64) {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+	tb.adjust(now)
+	tb.avail += count
+	if tb.avail > tb.capacity {
+		tb.avail = tb.capacity
+	}
+}
+
+// readyIn returns how long until the bucket has tokens, 0 if it has now.
+func (tb *Bucket) readyIn(now time.Time) time.Duration {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+	currentTick := tb.adjust(now)
+	if tb.avail > 0 {
+		return 0
+	}
+	endTick := currentTick + -tb.avail/tb.quantum + 1
+	return tb.startTime.Add(time.Duration(endTick) * tb.fillInterval).Sub(now)
+}
+
 // Take takes count tokens from the bucket without blocking. It returns
 // the time that the caller should wait until the tokens are actually
 // available.
@@ -194,11 +312,27 @@ func (tb *Bucket) available(now time.Time) int64 {
 	return tb.avail
 }
 
-// Capacity returns the capacity that the bucket was created with.
+// Capacity returns the capacity of the bucket.
 func (tb *Bucket) Capacity() int64 {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
 	return tb.capacity
 }
 
+// SetCapacity changes the capacity of the bucket, tokens above the new
+// capacity are dropped.
+func (tb *Bucket) SetCapacity(capacity int64) {
+	if capacity <= 0 {
+		panic("token bucket capacity is not > 0")
+	}
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+	tb.capacity = capacity
+	if tb.avail > capacity {
+		tb.avail = capacity
+	}
+}
+
 // Rate returns the fill rate of the bucket, in tokens per second.
 func (tb *Bucket) Rate() float64 {
 	return 1e9 * float64(tb.quantum) / float64(tb.fillInterval)
@@ -0,0 +1,108 @@
+package shadowsocks
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestTakeMaxDurationTakesNothing(t *testing.T) {
+	tb := NewBucket(time.Millisecond, 100)
+	now := tb.startTime
+	if _, ok := tb.take(now, 5000, time.Second); ok {
+		t.Fatal("take should fail when the wait is over maxWait")
+	}
+	if avail := tb.available(now); avail != 100 {
+		t.Errorf("failed take should leave the bucket alone, available %d", avail)
+	}
+}
+
+func TestTakeAccountsBeyondCapacity(t *testing.T) {
+	tb := NewBucket(time.Millisecond, 100)
+	now := tb.startTime
+	d, ok := tb.take(now, 5000, infinityDuration)
+	if !ok || d != 4900*time.Millisecond {
+		t.Fatalf("got wait %v, %v, want 4.9s", d, ok)
+	}
+	if avail := tb.available(now); avail != -4900 {
+		t.Errorf("bucket should be in debt, available %d", avail)
+	}
+	if d := tb.readyIn(now); d != 4901*time.Millisecond {
+		t.Errorf("ready in %v, want 4.901s", d)
+	}
+	later := now.Add(4901 * time.Millisecond)
+	if d := tb.readyIn(later); d != 0 {
+		t.Errorf("debt should be paid after 4.901s, ready in %v", d)
+	}
+	if avail := tb.available(later); avail != 1 {
+		t.Errorf("available %d, want 1", avail)
+	}
+}
+
+func TestReadyInQuantum(t *testing.T) {
+	tb := NewBucketWithQuantum(10*time.Millisecond, 100, 10)
+	now := tb.startTime
+	tb.take(now, 125, infinityDuration)
+	// 25 tokens of debt, 10 per tick, the third tick brings the bucket to 5.
+	if d := tb.readyIn(now.Add(5 * time.Millisecond)); d != 25*time.Millisecond {
+		t.Errorf("ready in %v, want 25ms", d)
+	}
+}
+
+func TestAccountParent(t *testing.T) {
+	parent := NewBucket(time.Millisecond, 1000)
+	tb := NewBucket(time.Millisecond, 100)
+	tb.Parent = parent
+	tb.Account(300)
+	if avail := parent.Available(); avail > 700 {
+		t.Errorf("parent should be charged, available %d", avail)
+	}
+	if avail := tb.Available(); avail > -200 {
+		t.Errorf("bucket should be in debt, available %d", avail)
+	}
+}
+
+func TestWaitReady(t *testing.T) {
+	tb := NewBucket(time.Millisecond, 10)
+	if err := tb.WaitReady(time.Time{}, nil); err != nil {
+		t.Fatalf("full bucket should not wait: %v", err)
+	}
+	tb.Account(10 + 20)
+	start := time.Now()
+	if err := tb.WaitReady(time.Time{}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 15*time.Millisecond {
+		t.Errorf("should wait for the debt to be paid, waited %v", elapsed)
+	}
+}
+
+func TestWaitReadyDeadline(t *testing.T) {
+	tb := NewBucket(time.Millisecond, 10)
+	tb.Account(10 + 60*1000)
+	start := time.Now()
+	err := tb.WaitReady(start.Add(100*time.Millisecond), nil)
+	if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+		t.Fatalf("should time out, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 50*time.Millisecond {
+		t.Errorf("should not wait when the deadline can't be met, waited %v", elapsed)
+	}
+}
+
+func TestWaitReadyCancel(t *testing.T) {
+	tb := NewBucket(time.Millisecond, 10)
+	tb.Account(10 + 60*1000)
+	cancel := make(chan struct{})
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		close(cancel)
+	}()
+	start := time.Now()
+	if err := tb.WaitReady(time.Time{}, cancel); err != ErrWaitCanceled {
+		t.Fatalf("got %v, want ErrWaitCanceled", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("cancel should end the wait promptly, waited %v", elapsed)
+	}
+}
@@ -0,0 +1,502 @@
+package shadowsocks
+
+// Resolver of the server. Answers are cached for the TTL of the records,
+// names that don't exist for a configurable time. Upstream servers are asked
+// in order over UDP, TCP, DNS-over-TLS or DNS-over-HTTPS; without any the
+// system resolver is used.
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	dnsTypeA    = 1
+	dnsTypeAAAA = 28
+	dnsClassIN  = 1
+
+	dnsRcodeSuccess  = 0
+	dnsRcodeNXDomain = 3
+
+	dnsHeaderLen  = 12
+	dnsMaxUDPSize = 512
+
+	defaultDNSTimeout     = 5 * time.Second
+	defaultDNSNegativeTTL = 30 * time.Second
+	defaultDNSCacheSize   = 10000
+	// systemDNSTTL is how long answers of the system resolver are cached,
+	// it doesn't tell the TTL of the records.
+	systemDNSTTL = 60 * time.Second
+)
+
+var errDNSTruncated = errors.New("truncated dns response")
+
+// dnsUpstream sends a query to a DNS server and returns the response.
+type dnsUpstream interface {
+	exchange(query []byte, timeout time.Duration) ([]byte, error)
+	String() string
+}
+
+// parseDNSUpstream parses a DNS server: 8.8.8.8, udp://8.8.8.8:53,
+// tcp://8.8.8.8, tls://1.1.1.1:853 or https://dns.google/dns-query.
+func parseDNSUpstream(s string) (dnsUpstream, error) {
+	scheme, addr := "udp", s
+	if i := strings.Index(s, "://"); i >= 0 {
+		scheme, addr = s[:i], s[i+3:]
+	}
+	if addr == "" {
+		return nil, fmt.Errorf("invalid dns server %s", s)
+	}
+	switch scheme {
+	case "udp":
+		return &dnsUDPUpstream{addr: withDefaultPort(addr, "53")}, nil
+	case "tcp":
+		return &dnsStreamUpstream{addr: withDefaultPort(addr, "53")}, nil
+	case "tls":
+		addr = withDefaultPort(addr, "853")
+		host, _, _ := net.SplitHostPort(addr)
+		return &dnsStreamUpstream{addr: addr, tlsConfig: &tls.Config{ServerName: host}}, nil
+	case "https":
+		return &dnsHTTPSUpstream{url: s}, nil
+	}
+	return nil, fmt.Errorf("unknown protocol of dns server %s", s)
+}
+
+func withDefaultPort(addr, port string) string {
+	if _, _, err := net.SplitHostPort(addr); err == nil {
+		return addr
+	}
+	return net.JoinHostPort(strings.Trim(addr, "[]"), port)
+}
+
+type dnsUDPUpstream struct {
+	addr string
+}
+
+func (u *dnsUDPUpstream) String() string {
+	return "udp://" + u.addr
+}
+
+func (u *dnsUDPUpstream) exchange(query []byte, timeout time.Duration) ([]byte, error) {
+	resp, err := u.exchangeUDP(query, timeout)
+	if err == errDNSTruncated {
+		// The answer doesn't fit in a datagram, ask again over TCP.
+		return (&dnsStreamUpstream{addr: u.addr}).exchange(query, timeout)
+	}
+	return resp, err
+}
+
+func (u *dnsUDPUpstream) exchangeUDP(query []byte, timeout time.Duration) ([]byte, error) {
+	conn, err := net.DialTimeout("udp", u.addr, timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+	if _, err = conn.Write(query); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, dnsMaxUDPSize)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		// Skip stray datagrams, like late answers to an earlier query.
+		if n < dnsHeaderLen || buf[0] != query[0] || buf[1] != query[1] {
+			continue
+		}
+		if buf[2]&0x02 != 0 {
+			return nil, errDNSTruncated
+		}
+		return buf[:n], nil
+	}
+}
+
+// dnsStreamUpstream is a DNS server over TCP, or over TLS when tlsConfig is
+// set. A connection is made per query.
+type dnsStreamUpstream struct {
+	addr      string
+	tlsConfig *tls.Config
+}
+
+func (u *dnsStreamUpstream) String() string {
+	if u.tlsConfig != nil {
+		return "tls://" + u.addr
+	}
+	return "tcp://" + u.addr
+}
+
+func (u *dnsStreamUpstream) exchange(query []byte, timeout time.Duration) ([]byte, error) {
+	dialer := &net.Dialer{Timeout: timeout}
+	var conn net.Conn
+	var err error
+	if u.tlsConfig != nil {
+		conn, err = tls.DialWithDialer(dialer, "tcp", u.addr, u.tlsConfig)
+	} else {
+		conn, err = dialer.Dial("tcp", u.addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+	msg := make([]byte, 2+len(query))
+	binary.BigEndian.PutUint16(msg, uint16(len(query)))
+	copy(msg[2:], query)
+	if _, err = conn.Write(msg); err != nil {
+		return nil, err
+	}
+	var lenBuf [2]byte
+	if _, err = io.ReadFull(conn, lenBuf[:]); err != nil {
+		return nil, err
+	}
+	resp := make([]byte, binary.BigEndian.Uint16(lenBuf[:]))
+	if _, err = io.ReadFull(conn, resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// dnsHTTPSUpstream is a DNS-over-HTTPS server, see RFC 8484.
+type dnsHTTPSUpstream struct {
+	url string
+}
+
+func (u *dnsHTTPSUpstream) String() string {
+	return u.url
+}
+
+func (u *dnsHTTPSUpstream) exchange(query []byte, timeout time.Duration) ([]byte, error) {
+	req, err := http.NewRequest("POST", u.url, bytes.NewReader(query))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+	client := &http.Client{Timeout: timeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("dns server %s: %s", u.url, resp.Status)
+	}
+	return ioutil.ReadAll(io.LimitReader(resp.Body, 65535))
+}
+
+// newDNSQuery builds a recursive query for name.
+func newDNSQuery(id uint16, name string, qtype uint16) ([]byte, error) {
+	msg := make([]byte, dnsHeaderLen, dnsHeaderLen+len(name)+6)
+	binary.BigEndian.PutUint16(msg[0:], id)
+	binary.BigEndian.PutUint16(msg[2:], 0x0100) // recursion desired
+	binary.BigEndian.PutUint16(msg[4:], 1)      // one question
+	if len(name) > 253 {
+		return nil, fmt.Errorf("domain name too long: %s", name)
+	}
+	for _, label := range strings.Split(name, ".") {
+		if len(label) == 0 || len(label) > 63 {
+			return nil, fmt.Errorf("invalid domain name: %s", name)
+		}
+		msg = append(msg, byte(len(label)))
+		msg = append(msg, label...)
+	}
+	msg = append(msg, 0, byte(qtype>>8), byte(qtype), 0, dnsClassIN)
+	return msg, nil
+}
+
+var errDNSFormat = errors.New("malformed dns response")
+
+// skipDNSName returns the offset after the name starting at off.
+func skipDNSName(msg []byte, off int) (int, error) {
+	for {
+		if off >= len(msg) {
+			return 0, errDNSFormat
+		}
+		c := int(msg[off])
+		switch {
+		case c == 0:
+			return off + 1, nil
+		case c&0xC0 == 0xC0:
+			// compression pointer, ends the name
+			return off + 2, nil
+		case c&0xC0 != 0:
+			return 0, errDNSFormat
+		}
+		off += 1 + c
+	}
+}
+
+// parseDNSResponse returns the addresses of type qtype in the answer of a
+// response, and the lowest TTL of the answer records.
+func parseDNSResponse(msg []byte, id uint16, qtype uint16) (ips []net.IP, ttl uint32, rcode int, err error) {
+	if len(msg) < dnsHeaderLen || binary.BigEndian.Uint16(msg) != id || msg[2]&0x80 == 0 {
+		return nil, 0, 0, errDNSFormat
+	}
+	rcode = int(msg[3] & 0x0F)
+	qdcount := int(binary.BigEndian.Uint16(msg[4:]))
+	ancount := int(binary.BigEndian.Uint16(msg[6:]))
+	off := dnsHeaderLen
+	for i := 0; i < qdcount; i++ {
+		if off, err = skipDNSName(msg, off); err != nil {
+			return nil, 0, 0, err
+		}
+		off += 4
+	}
+	ttl = ^uint32(0)
+	for i := 0; i < ancount; i++ {
+		if off, err = skipDNSName(msg, off); err != nil {
+			return nil, 0, 0, err
+		}
+		if off+10 > len(msg) {
+			return nil, 0, 0, errDNSFormat
+		}
+		rtype := binary.BigEndian.Uint16(msg[off:])
+		class := binary.BigEndian.Uint16(msg[off+2:])
+		rttl := binary.BigEndian.Uint32(msg[off+4:])
+		rdlen := int(binary.BigEndian.Uint16(msg[off+8:]))
+		off += 10
+		if off+rdlen > len(msg) {
+			return nil, 0, 0, errDNSFormat
+		}
+		if rttl < ttl {
+			ttl = rttl
+		}
+		if class == dnsClassIN && rtype == qtype &&
+			(rtype == dnsTypeA && rdlen == net.IPv4len || rtype == dnsTypeAAAA && rdlen == net.IPv6len) {
+			ip := make(net.IP, rdlen)
+			copy(ip, msg[off:off+rdlen])
+			ips = append(ips, ip)
+		}
+		off += rdlen
+	}
+	if ancount == 0 {
+		ttl = 0
+	}
+	return ips, ttl, rcode, nil
+}
+
+type dnsCacheEntry struct {
+	ips     []net.IP
+	err     error
+	expires time.Time
+}
+
+type Resolver struct {
+	cacheHits   uint64 // accessed with sync/atomic
+	cacheMisses uint64 // accessed with sync/atomic
+
+	upstreams   []dnsUpstream
+	timeout     time.Duration
+	negativeTTL time.Duration
+	cacheSize   int // negative disables the cache
+	hosts       map[string][]net.IP
+	now         func() time.Time
+
+	lock  sync.Mutex
+	cache map[string]*dnsCacheEntry
+}
+
+// NewResolver creates a resolver from the dns_ options of config.
+func NewResolver(config *Config) (*Resolver, error) {
+	r := &Resolver{
+		timeout:     time.Duration(config.DNSTimeout) * time.Second,
+		negativeTTL: time.Duration(config.DNSNegativeTTL) * time.Second,
+		cacheSize:   config.DNSCacheSize,
+		hosts:       make(map[string][]net.IP),
+		now:         time.Now,
+		cache:       make(map[string]*dnsCacheEntry),
+	}
+	if r.timeout <= 0 {
+		r.timeout = defaultDNSTimeout
+	}
+	if r.negativeTTL == 0 {
+		r.negativeTTL = defaultDNSNegativeTTL
+	}
+	if r.cacheSize == 0 {
+		r.cacheSize = defaultDNSCacheSize
+	}
+	for _, s := range config.DNSServers {
+		u, err := parseDNSUpstream(s)
+		if err != nil {
+			return nil, err
+		}
+		r.upstreams = append(r.upstreams, u)
+	}
+	for name, addrs := range config.DNSHosts {
+		for _, addr := range addrs {
+			ip := net.ParseIP(addr)
+			if ip == nil {
+				return nil, fmt.Errorf("dns_hosts: invalid address %s of %s", addr, name)
+			}
+			key := canonicalDomain(name)
+			r.hosts[key] = append(r.hosts[key], ip)
+		}
+	}
+	return r, nil
+}
+
+func canonicalDomain(name string) string {
+	return strings.TrimSuffix(strings.ToLower(name), ".")
+}
+
+// CacheStats returns the number of lookups answered from the cache and the
+// number that had to be sent upstream.
+func (r *Resolver) CacheStats() (hits, misses uint64) {
+	return atomic.LoadUint64(&r.cacheHits), atomic.LoadUint64(&r.cacheMisses)
+}
+
+// LookupIP returns the addresses of host, IPv4 addresses first.
+func (r *Resolver) LookupIP(host string) ([]net.IP, error) {
+	ips, _, err := r.lookupIP(host)
+	return ips, err
+}
+
+// lookupIP is LookupIP, it also tells until when the answer holds: the TTL
+// of the records, or of the system resolver for addresses and dns_hosts.
+func (r *Resolver) lookupIP(host string) ([]net.IP, time.Time, error) {
+	now := r.now()
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}, now.Add(systemDNSTTL), nil
+	}
+	name := canonicalDomain(host)
+	if ips, have := r.hosts[name]; have {
+		return ips, now.Add(systemDNSTTL), nil
+	}
+	r.lock.Lock()
+	entry, have := r.cache[name]
+	r.lock.Unlock()
+	if have && now.Before(entry.expires) {
+		atomic.AddUint64(&r.cacheHits, 1)
+		return entry.ips, entry.expires, entry.err
+	}
+	atomic.AddUint64(&r.cacheMisses, 1)
+
+	ips, ttl, notFound, err := r.lookup(name)
+	if notFound {
+		err = &net.DNSError{Err: "no such host", Name: host}
+		ttl = r.negativeTTL
+	}
+	if (err == nil || notFound) && ttl > 0 && r.cacheSize > 0 {
+		r.store(name, &dnsCacheEntry{ips: ips, err: err, expires: now.Add(ttl)})
+	}
+	return ips, now.Add(ttl), err
+}
+
+// ResolveIP returns an address of host, preferring IPv4. A nil resolver
+// uses the system resolver.
+func (r *Resolver) ResolveIP(host string) (net.IP, error) {
+	if r == nil {
+		ipAddr, err := net.ResolveIPAddr("ip", host)
+		if err != nil {
+			return nil, err
+		}
+		return ipAddr.IP, nil
+	}
+	ips, err := r.LookupIP(host)
+	if err != nil {
+		return nil, err
+	}
+	for _, ip := range ips {
+		if ip.To4() != nil {
+			return ip, nil
+		}
+	}
+	return ips[0], nil
+}
+
+func (r *Resolver) store(name string, entry *dnsCacheEntry) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if len(r.cache) >= r.cacheSize {
+		now := r.now()
+		for k, e := range r.cache {
+			if !now.Before(e.expires) {
+				delete(r.cache, k)
+			}
+		}
+		// Still full, drop some entries at random.
+		for k := range r.cache {
+			if len(r.cache) < r.cacheSize*9/10 {
+				break
+			}
+			delete(r.cache, k)
+		}
+	}
+	r.cache[name] = entry
+}
+
+// lookup asks the upstream servers for the A records of name, then for the
+// AAAA records if there are none. notFound tells the name doesn't exist or
+// has no address.
+func (r *Resolver) lookup(name string) (ips []net.IP, ttl time.Duration, notFound bool, err error) {
+	if len(r.upstreams) == 0 {
+		ips, err = net.LookupIP(name)
+		return ips, systemDNSTTL, false, err
+	}
+	for _, qtype := range []uint16{dnsTypeA, dnsTypeAAAA} {
+		ips, recordTTL, rcode, err := r.query(name, qtype)
+		if err != nil {
+			return nil, 0, false, err
+		}
+		if rcode == dnsRcodeNXDomain {
+			return nil, 0, true, nil
+		}
+		if len(ips) > 0 {
+			return ips, time.Duration(recordTTL) * time.Second, false, nil
+		}
+	}
+	return nil, 0, true, nil
+}
+
+// query sends a query to the upstream servers in order, until one answers.
+func (r *Resolver) query(name string, qtype uint16) (ips []net.IP, ttl uint32, rcode int, err error) {
+	var idBuf [2]byte
+	if _, err = rand.Read(idBuf[:]); err != nil {
+		return nil, 0, 0, err
+	}
+	id := binary.BigEndian.Uint16(idBuf[:])
+	q, err := newDNSQuery(id, name, qtype)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	for _, u := range r.upstreams {
+		if _, ok := u.(*dnsHTTPSUpstream); ok {
+			// RFC 8484 asks for id 0, which keeps responses cacheable.
+			q[0], q[1] = 0, 0
+		} else {
+			q[0], q[1] = idBuf[0], idBuf[1]
+		}
+		var resp []byte
+		resp, err = u.exchange(q, r.timeout)
+		if err != nil {
+			DNSLog.Debug("dns query failed", "server", u, "name", name, "err", err)
+			continue
+		}
+		ips, ttl, rcode, err = parseDNSResponse(resp, binary.BigEndian.Uint16(q), qtype)
+		if err != nil {
+			DNSLog.Debug("dns query failed", "server", u, "name", name, "err", err)
+			continue
+		}
+		if rcode != dnsRcodeSuccess && rcode != dnsRcodeNXDomain {
+			err = fmt.Errorf("dns server %s answered rcode %d", u, rcode)
+			DNSLog.Debug("dns query failed", "server", u, "name", name, "err", err)
+			continue
+		}
+		return ips, ttl, rcode, nil
+	}
+	return nil, 0, 0, err
+}
@@ -0,0 +1,131 @@
+package shadowsocks
+
+import (
+	"encoding/binary"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeDNSServer answers A queries for known names from records with the given
+// TTL, NXDOMAIN for the rest.
+func fakeDNSServer(t *testing.T, records map[string]net.IP, ttl uint32) (addr string, queries *int32) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	queries = new(int32)
+	go func() {
+		buf := make([]byte, dnsMaxUDPSize)
+		for {
+			n, src, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(queries, 1)
+			q := buf[:n]
+			end, _ := skipDNSName(q, dnsHeaderLen)
+			var name []byte
+			for off := dnsHeaderLen; q[off] != 0; off += 1 + int(q[off]) {
+				if len(name) > 0 {
+					name = append(name, '.')
+				}
+				name = append(name, q[off+1:off+1+int(q[off])]...)
+			}
+			qtype := binary.BigEndian.Uint16(q[end:])
+			resp := append([]byte(nil), q[:end+4]...)
+			resp[2] |= 0x80
+			ip, have := records[string(name)]
+			if !have {
+				resp[3] = dnsRcodeNXDomain
+			} else if qtype == dnsTypeA {
+				resp[7] = 1
+				rr := []byte{0xC0, dnsHeaderLen, 0, dnsTypeA, 0, dnsClassIN, 0, 0, 0, 0, 0, 4}
+				binary.BigEndian.PutUint32(rr[6:], ttl)
+				resp = append(append(resp, rr...), ip.To4()...)
+			}
+			conn.WriteTo(resp, src)
+		}
+	}()
+	return conn.LocalAddr().String(), queries
+}
+
+func TestResolverCache(t *testing.T) {
+	addr, queries := fakeDNSServer(t, map[string]net.IP{"example.com": net.ParseIP("93.184.216.34")}, 60)
+	r, err := NewResolver(&Config{
+		DNSServers: []string{"udp://" + addr},
+		DNSHosts:   map[string][]string{"static.example.com": {"10.0.0.1"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	r.now = func() time.Time { return now }
+
+	for i := 0; i < 2; i++ {
+		ip, err := r.ResolveIP("Example.com.")
+		if err != nil || !ip.Equal(net.ParseIP("93.184.216.34")) {
+			t.Fatalf("got %v, %v", ip, err)
+		}
+	}
+	if n := atomic.LoadInt32(queries); n != 1 {
+		t.Errorf("second lookup should be cached, sent %d queries", n)
+	}
+	now = now.Add(61 * time.Second)
+	r.ResolveIP("example.com")
+	if n := atomic.LoadInt32(queries); n != 2 {
+		t.Errorf("lookup after the TTL should be sent, sent %d queries", n)
+	}
+
+	if _, err = r.ResolveIP("missing.example.com"); err == nil {
+		t.Error("missing name should fail")
+	}
+	r.ResolveIP("missing.example.com")
+	if n := atomic.LoadInt32(queries); n != 3 {
+		t.Errorf("missing name should be cached, sent %d queries", n)
+	}
+
+	ip, err := r.ResolveIP("static.example.com")
+	if err != nil || !ip.Equal(net.ParseIP("10.0.0.1")) {
+		t.Errorf("hosts override: got %v, %v", ip, err)
+	}
+	if hits, misses := r.CacheStats(); hits != 2 || misses != 3 {
+		t.Errorf("got %d hits and %d misses", hits, misses)
+	}
+}
+
+func TestResolverTimeout(t *testing.T) {
+	// Nothing answers on this socket.
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	addr, _ := fakeDNSServer(t, map[string]net.IP{"example.com": net.ParseIP("93.184.216.34")}, 60)
+	r, err := NewResolver(&Config{DNSServers: []string{conn.LocalAddr().String(), addr}, DNSTimeout: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = r.ResolveIP("example.com"); err != nil {
+		t.Errorf("should fall back to the second server: %v", err)
+	}
+}
+
+func TestParseDNSUpstream(t *testing.T) {
+	tests := map[string]string{
+		"8.8.8.8":                      "udp://8.8.8.8:53",
+		"tcp://[2001:4860::8888]":      "tcp://[2001:4860::8888]:53",
+		"tls://1.1.1.1":                "tls://1.1.1.1:853",
+		"https://dns.google/dns-query": "https://dns.google/dns-query",
+	}
+	for s, want := range tests {
+		u, err := parseDNSUpstream(s)
+		if err != nil || u.String() != want {
+			t.Errorf("%s: got %v, %v, want %s", s, u, err, want)
+		}
+	}
+	if _, err := parseDNSUpstream("quic://1.1.1.1"); err == nil {
+		t.Error("unknown protocol should fail")
+	}
+}
@@ -0,0 +1,312 @@
+package shadowsocks
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// Destination rules, one per line. Lines starting with # are comments.
+//
+//	domain:example.com   example.com and its subdomains
+//	example.com          same as domain:
+//	*.example.com        wildcard, * matches anything and ? one character
+//	full:example.com     only example.com
+//	keyword:example      domains containing example
+//	regex:^ad[0-9]+\.    domains matching the regular expression
+//	cidr:10.0.0.0/8      IPv4 or IPv6 network, a plain IP or network works too
+//	port:25              port or port range, like port:6000-7000
+//
+// A rule prefixed with @@ is an allow rule, it overrides the other rules.
+// CIDR rules match IP literals and, if the caller resolves the domain, the
+// resolved address.
+
+type ruleKind int
+
+const (
+	ruleFull ruleKind = iota
+	ruleDomain
+	ruleKeyword
+	ruleRegex
+	ruleCIDR
+	rulePort
+)
+
+var ruleKindNames = []string{
+	ruleFull:    "full",
+	ruleDomain:  "domain",
+	ruleKeyword: "keyword",
+	ruleRegex:   "regex",
+	ruleCIDR:    "cidr",
+	rulePort:    "port",
+}
+
+type Rule struct {
+	hits uint64 // accessed with sync/atomic
+
+	Text  string // the line the rule was parsed from
+	Allow bool
+
+	kind   ruleKind
+	value  string
+	re     *regexp.Regexp
+	ipnet  *net.IPNet
+	portLo int
+	portHi int
+}
+
+// Type returns full, domain, keyword, regex, cidr or port.
+func (r *Rule) Type() string {
+	return ruleKindNames[r.kind]
+}
+
+// Hits returns how many destinations the rule matched.
+func (r *Rule) Hits() uint64 {
+	return atomic.LoadUint64(&r.hits)
+}
+
+type ruleGroup struct {
+	full    map[string]*Rule
+	domain  map[string]*Rule
+	keyword []*Rule
+	regex   []*Rule
+	cidr    []*Rule
+	port    []*Rule
+}
+
+func newRuleGroup() *ruleGroup {
+	return &ruleGroup{
+		full:   make(map[string]*Rule),
+		domain: make(map[string]*Rule),
+	}
+}
+
+func (g *ruleGroup) add(r *Rule) {
+	switch r.kind {
+	case ruleFull:
+		g.full[r.value] = r
+	case ruleDomain:
+		g.domain[r.value] = r
+	case ruleKeyword:
+		g.keyword = append(g.keyword, r)
+	case ruleRegex:
+		g.regex = append(g.regex, r)
+	case ruleCIDR:
+		g.cidr = append(g.cidr, r)
+	case rulePort:
+		g.port = append(g.port, r)
+	}
+}
+
+// match returns the first rule matching the destination. domain is empty for
+// IP literals, ip is nil if not known.
+func (g *ruleGroup) match(domain string, ip net.IP, port int) *Rule {
+	if domain != "" {
+		if r, have := g.full[domain]; have {
+			return r
+		}
+		for suffix := domain; ; {
+			if r, have := g.domain[suffix]; have {
+				return r
+			}
+			i := strings.IndexByte(suffix, '.')
+			if i < 0 {
+				break
+			}
+			suffix = suffix[i+1:]
+		}
+		for _, r := range g.keyword {
+			if strings.Contains(domain, r.value) {
+				return r
+			}
+		}
+		for _, r := range g.regex {
+			if r.re.MatchString(domain) {
+				return r
+			}
+		}
+	}
+	if ip != nil {
+		for _, r := range g.cidr {
+			if r.ipnet.Contains(ip) {
+				return r
+			}
+		}
+	}
+	for _, r := range g.port {
+		if port >= r.portLo && port <= r.portHi {
+			return r
+		}
+	}
+	return nil
+}
+
+// RuleSet is a list of block and allow rules for destinations. It is not
+// modified after parsing, so it is safe for concurrent use.
+type RuleSet struct {
+	rules []*Rule
+	block *ruleGroup
+	allow *ruleGroup
+}
+
+func NewRuleSet() *RuleSet {
+	return &RuleSet{block: newRuleGroup(), allow: newRuleGroup()}
+}
+
+// Rules returns the rules in the order they were added.
+func (s *RuleSet) Rules() []*Rule {
+	return s.rules
+}
+
+// NeedsIP tells whether there are CIDR rules, which need the resolved address
+// of domains.
+func (s *RuleSet) NeedsIP() bool {
+	return s != nil && (len(s.block.cidr) > 0 || len(s.allow.cidr) > 0)
+}
+
+// Match checks a destination. host is a domain or an IP literal, ip is the
+// address a domain resolved to, or nil. It returns the block rule that
+// matched, or nil if the destination is allowed.
+func (s *RuleSet) Match(host string, ip net.IP, port int) *Rule {
+	if s == nil {
+		return nil
+	}
+	domain := strings.TrimSuffix(strings.ToLower(host), ".")
+	if literal := net.ParseIP(domain); literal != nil {
+		domain = ""
+		ip = literal
+	}
+	if r := s.allow.match(domain, ip, port); r != nil {
+		atomic.AddUint64(&r.hits, 1)
+		return nil
+	}
+	if r := s.block.match(domain, ip, port); r != nil {
+		atomic.AddUint64(&r.hits, 1)
+		return r
+	}
+	return nil
+}
+
+var globReplacer = strings.NewReplacer(`\*`, `.*`, `\?`, `.`)
+
+// ParseRule parses a line of a rule file.
+func ParseRule(line string) (*Rule, error) {
+	r := &Rule{Text: line}
+	if strings.HasPrefix(line, "@@") {
+		r.Allow = true
+		line = line[2:]
+	}
+	kind, value := "", line
+	if i := strings.IndexByte(line, ':'); i > 0 && net.ParseIP(line) == nil {
+		if _, _, err := net.ParseCIDR(line); err != nil {
+			kind, value = line[:i], line[i+1:]
+		}
+	}
+	if value == "" {
+		return nil, fmt.Errorf("empty rule %q", r.Text)
+	}
+	switch kind {
+	case "":
+		if _, ipnet, err := net.ParseCIDR(value); err == nil {
+			r.kind, r.ipnet = ruleCIDR, ipnet
+		} else if ip := net.ParseIP(value); ip != nil {
+			r.kind, r.ipnet = ruleCIDR, singleIPNet(ip)
+		} else if strings.ContainsAny(value, "*?") {
+			re, err := regexp.Compile("^" + globReplacer.Replace(regexp.QuoteMeta(strings.ToLower(value))) + "$")
+			if err != nil {
+				return nil, err
+			}
+			r.kind, r.re = ruleRegex, re
+		} else {
+			r.kind, r.value = ruleDomain, strings.TrimSuffix(strings.ToLower(value), ".")
+		}
+	case "domain":
+		r.kind, r.value = ruleDomain, strings.TrimSuffix(strings.ToLower(value), ".")
+	case "full":
+		r.kind, r.value = ruleFull, strings.TrimSuffix(strings.ToLower(value), ".")
+	case "keyword":
+		r.kind, r.value = ruleKeyword, strings.ToLower(value)
+	case "regex":
+		re, err := regexp.Compile(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid regex in rule %q: %v", r.Text, err)
+		}
+		r.kind, r.re = ruleRegex, re
+	case "cidr":
+		if _, ipnet, err := net.ParseCIDR(value); err == nil {
+			r.kind, r.ipnet = ruleCIDR, ipnet
+		} else if ip := net.ParseIP(value); ip != nil {
+			r.kind, r.ipnet = ruleCIDR, singleIPNet(ip)
+		} else {
+			return nil, fmt.Errorf("invalid network in rule %q", r.Text)
+		}
+	case "port":
+		lo, hi := value, value
+		if i := strings.IndexByte(value, '-'); i >= 0 {
+			lo, hi = value[:i], value[i+1:]
+		}
+		var err1, err2 error
+		r.portLo, err1 = strconv.Atoi(lo)
+		r.portHi, err2 = strconv.Atoi(hi)
+		if err1 != nil || err2 != nil || r.portLo < 0 || r.portHi > 65535 || r.portLo > r.portHi {
+			return nil, fmt.Errorf("invalid port in rule %q", r.Text)
+		}
+		r.kind = rulePort
+	default:
+		return nil, fmt.Errorf("unknown rule type %q in rule %q", kind, r.Text)
+	}
+	return r, nil
+}
+
+func singleIPNet(ip net.IP) *net.IPNet {
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}
+}
+
+// Add adds a rule to the set.
+func (s *RuleSet) Add(r *Rule) {
+	s.rules = append(s.rules, r)
+	if r.Allow {
+		s.allow.add(r)
+	} else {
+		s.block.add(r)
+	}
+}
+
+// ParseRules reads rules, one per line.
+func ParseRules(reader io.Reader) (*RuleSet, error) {
+	s := NewRuleSet()
+	scanner := bufio.NewScanner(reader)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		r, err := ParseRule(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", n, err)
+		}
+		s.Add(r)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func LoadRules(path string) (*RuleSet, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return ParseRules(file)
+}
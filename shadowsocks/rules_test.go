@@ -0,0 +1,91 @@
+package shadowsocks
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+const testRules = `
+# comment
+example.com
+full:exact.org
+keyword:tracker
+regex:^ad[0-9]+\.
+*.wild.net
+cidr:10.0.0.0/8
+fe80::/10
+192.0.2.1
+port:25
+port:6000-6010
+@@domain:ok.example.com
+@@cidr:10.1.0.0/16
+`
+
+func TestRuleSetMatch(t *testing.T) {
+	s, err := ParseRules(strings.NewReader(testRules))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		host    string
+		ip      string
+		port    int
+		blocked string
+	}{
+		{"example.com", "", 443, "example.com"},
+		{"WWW.Example.com.", "", 443, "example.com"},
+		{"notexample.com", "", 443, ""},
+		{"ok.example.com", "", 443, ""},
+		{"a.ok.example.com", "", 25, ""},
+		{"exact.org", "", 80, "full:exact.org"},
+		{"www.exact.org", "", 80, ""},
+		{"mytracker.io", "", 80, "keyword:tracker"},
+		{"ad12.foo.com", "", 80, `regex:^ad[0-9]+\.`},
+		{"bad12.foo.com", "", 80, ""},
+		{"a.b.wild.net", "", 80, "*.wild.net"},
+		{"wild.net", "", 80, ""},
+		{"10.2.3.4", "", 80, "cidr:10.0.0.0/8"},
+		{"10.1.3.4", "", 80, ""},
+		{"internal.corp", "10.9.9.9", 80, "cidr:10.0.0.0/8"},
+		{"internal.corp", "", 80, ""},
+		{"fe80::1", "", 80, "fe80::/10"},
+		{"192.0.2.1", "", 80, "192.0.2.1"},
+		{"192.0.2.2", "", 80, ""},
+		{"mail.org", "", 25, "port:25"},
+		{"game.org", "", 6005, "port:6000-6010"},
+		{"game.org", "", 6011, ""},
+	}
+	for _, test := range tests {
+		rule := s.Match(test.host, net.ParseIP(test.ip), test.port)
+		got := ""
+		if rule != nil {
+			got = rule.Text
+		}
+		if got != test.blocked {
+			t.Errorf("%s (%s) port %d: got rule %q, want %q", test.host, test.ip, test.port, got, test.blocked)
+		}
+	}
+	for _, rule := range s.Rules() {
+		if rule.Text == "example.com" && rule.Hits() != 2 {
+			t.Errorf("example.com should have 2 hits, got %d", rule.Hits())
+		}
+		if rule.Text == "@@domain:ok.example.com" && rule.Hits() != 2 {
+			t.Errorf("allow rule should have 2 hits, got %d", rule.Hits())
+		}
+		if rule.Text == "192.0.2.1" && rule.Type() != "cidr" {
+			t.Errorf("address rule should be of type cidr, got %s", rule.Type())
+		}
+	}
+	if !s.NeedsIP() {
+		t.Error("rules with cidr should need the resolved IP")
+	}
+}
+
+func TestParseRuleErrors(t *testing.T) {
+	for _, line := range []string{"port:70000", "port:10-5", "regex:(", "cidr:foo", "unknown:x", "domain:"} {
+		if _, err := ParseRule(line); err == nil {
+			t.Errorf("%q should be invalid", line)
+		}
+	}
+}
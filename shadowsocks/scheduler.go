@@ -0,0 +1,415 @@
+package shadowsocks
+
+// Hierarchical fair-share scheduler. Connections are the leaves of a tree
+// like server -> user group -> user -> connection, every node may have a
+// Bucket limiting its rate. When a bucket runs out of tokens the leaves
+// below it queue up, and the tokens are handed out in weighted fair order:
+// at each level the waiting child that got the least service relative to
+// its weight goes first (start-time fair queueing). A bulk download then
+// can't starve an interactive session of the same user, and a user with
+// weight 3 gets three times the share of a user with weight 1 under
+// contention.
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Limiter limits the rate of a connection. Callers wait with WaitReady
+// before a transfer and report its size with Account afterwards. Bucket and
+// SchedNode are Limiters.
+type Limiter interface {
+	WaitReady(deadline time.Time, cancel <-chan struct{}) error
+	Account(count int64)
+}
+
+// SchedClass describes an inner node of the tree, see Scheduler.NewLeaf.
+type SchedClass struct {
+	Key    string
+	Weight float64 // not positive means 1
+	Bucket *Bucket // nil means no limit of its own
+}
+
+// SchedNode is a node of a Scheduler tree. Leaves are Limiters.
+type SchedNode struct {
+	// buckets on the way from the node to the root, inner nodes only,
+	// accessed with sync/atomic so leaves without any skip the lock
+	limits int32
+
+	sched    *Scheduler
+	parent   *SchedNode
+	key      string
+	weight   float64
+	bucket   *Bucket
+	children map[string]*SchedNode // inner nodes only, leaves are not looked up
+	leaves   int                   // leaves in the subtree, the node is removed at 0
+
+	// vtime is the service of the node divided by its weight. vclock is
+	// the vtime of the child served last, children that start waiting
+	// again begin there, so being idle earns no credit.
+	vtime  float64
+	vclock float64
+
+	waiters int                     // waiting leaves in the subtree
+	active  map[*SchedNode]struct{} // children with waiters
+
+	// leaves only
+	reserve  int64 // tokens taken before each transfer
+	reserved int64 // tokens taken for the transfer in progress
+	granted  chan struct{}
+	// the transfer in progress went without the scheduler, used by the
+	// goroutine of the leaf only
+	unlimited bool
+}
+
+type Scheduler struct {
+	lock    sync.Mutex
+	root    *SchedNode
+	running bool // whether the dispatcher is running
+	kick    chan struct{}
+}
+
+// NewScheduler returns a scheduler whose root is limited by bucket, which
+// may be nil.
+func NewScheduler(bucket *Bucket) *Scheduler {
+	s := &Scheduler{kick: make(chan struct{}, 1)}
+	s.root = s.newNode(nil, "", 1, bucket)
+	return s
+}
+
+func (s *Scheduler) newNode(parent *SchedNode, key string, weight float64, bucket *Bucket) *SchedNode {
+	if weight <= 0 {
+		weight = 1
+	}
+	var limits int32
+	if parent != nil {
+		limits = parent.limits
+	}
+	if bucket != nil {
+		limits++
+	}
+	return &SchedNode{
+		limits:   limits,
+		sched:    s,
+		parent:   parent,
+		key:      key,
+		weight:   weight,
+		bucket:   bucket,
+		children: make(map[string]*SchedNode),
+		active:   make(map[*SchedNode]struct{}),
+	}
+}
+
+// NewLeaf adds a leaf under the inner nodes in path, creating them as
+// needed. The weight and bucket of existing nodes are updated. reserve is
+// the most a transfer of the leaf is expected to move, it is taken from the
+// buckets before the transfer and settled by Account. Not positive means the
+// relay buffer size. The leaf must be released when done.
+//
+// The scheduler only uses the buckets of the nodes, not their Parent.
+func (s *Scheduler) NewLeaf(reserve int64, path ...SchedClass) *SchedNode {
+	if reserve <= 0 {
+		reserve = leakyBufSize
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	node := s.root
+	for _, class := range path {
+		child, have := node.children[class.Key]
+		if !have {
+			child = s.newNode(node, class.Key, class.Weight, class.Bucket)
+			node.children[class.Key] = child
+		} else {
+			child.setClass(class)
+		}
+		node = child
+	}
+	leaf := s.newNode(node, "", 1, nil)
+	leaf.reserve = reserve
+	leaf.granted = make(chan struct{}, 1)
+	for n := leaf; n != nil; n = n.parent {
+		n.leaves++
+	}
+	return leaf
+}
+
+// Update sets the weight and bucket of the inner nodes in path, so the
+// leaves below them get the new limits right away. Nodes that don't exist,
+// because they have no leaves, are left alone.
+func (s *Scheduler) Update(path ...SchedClass) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	node := s.root
+	for _, class := range path {
+		child, have := node.children[class.Key]
+		if !have {
+			return
+		}
+		child.setClass(class)
+		node = child
+	}
+	// Waiters may be able to go with the new buckets.
+	if s.running {
+		select {
+		case s.kick <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (n *SchedNode) setClass(class SchedClass) {
+	switch {
+	case n.bucket == nil && class.Bucket != nil:
+		n.addLimits(1)
+	case n.bucket != nil && class.Bucket == nil:
+		n.addLimits(-1)
+	}
+	n.bucket = class.Bucket
+	if class.Weight > 0 {
+		n.weight = class.Weight
+	} else {
+		n.weight = 1
+	}
+}
+
+// addLimits adds delta to the buckets counted by n and the inner nodes
+// below it. Must be called with the lock held.
+func (n *SchedNode) addLimits(delta int32) {
+	atomic.AddInt32(&n.limits, delta)
+	for _, child := range n.children {
+		child.addLimits(delta)
+	}
+}
+
+// Release removes a leaf from the tree, inner nodes without leaves left are
+// removed too.
+func (n *SchedNode) Release() {
+	s := n.sched
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if n.waiters > 0 {
+		n.setWaiting(false)
+	}
+	n.settle(time.Now(), 0)
+	for node := n; node != nil; node = node.parent {
+		node.leaves--
+		if node.leaves == 0 && node.parent != nil && node.parent.children[node.key] == node {
+			delete(node.parent.children, node.key)
+		}
+	}
+}
+
+// WaitReady waits for the turn of the leaf and takes its reserve from the
+// buckets on the way to the root. See Bucket.WaitReady for deadline and
+// cancel. Without a bucket on the way there is nothing to wait for or to
+// share, it returns right away.
+func (n *SchedNode) WaitReady(deadline time.Time, cancel <-chan struct{}) error {
+	n.unlimited = atomic.LoadInt32(&n.parent.limits) == 0
+	if n.unlimited {
+		return nil
+	}
+	s := n.sched
+	s.lock.Lock()
+	now := time.Now()
+	if n.pathReady(now) && !n.pathContended(now) {
+		n.take(now)
+		s.lock.Unlock()
+		return nil
+	}
+	n.setWaiting(true)
+	if !s.running {
+		s.running = true
+		go s.dispatch()
+	} else {
+		select {
+		case s.kick <- struct{}{}:
+		default:
+		}
+	}
+	s.lock.Unlock()
+
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		timer := time.NewTimer(deadline.Sub(now))
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	var err error
+	select {
+	case <-n.granted:
+		countWait(time.Since(now))
+		return nil
+	case <-cancel:
+		err = ErrWaitCanceled
+	case <-timeout:
+		err = bucketTimeout{}
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if n.waiters > 0 {
+		n.setWaiting(false)
+	} else {
+		// Granted meanwhile, give the tokens back.
+		<-n.granted
+		n.settle(time.Now(), 0)
+	}
+	return err
+}
+
+// Account settles the transfer started by the last WaitReady, count is how
+// much it actually moved.
+func (n *SchedNode) Account(count int64) {
+	if n.unlimited {
+		return
+	}
+	s := n.sched
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	n.settle(time.Now(), count)
+}
+
+// take charges the reserve of leaf n to the buckets and the fair share
+// clocks on the path to the root. Must be called with the lock held.
+func (n *SchedNode) take(now time.Time) {
+	n.charge(now, n.reserve)
+	n.reserved = n.reserve
+}
+
+// settle charges the difference between count and the reserved tokens.
+// Must be called with the lock held.
+func (n *SchedNode) settle(now time.Time, count int64) {
+	n.charge(now, count-n.reserved)
+	n.reserved = 0
+}
+
+func (n *SchedNode) charge(now time.Time, count int64) {
+	if count == 0 {
+		return
+	}
+	for node := n; node != nil; node = node.parent {
+		if node.parent != nil && count > 0 {
+			node.parent.vclock = node.vtime
+		}
+		node.vtime += float64(count) / node.weight
+		if node.bucket == nil {
+			continue
+		}
+		if count > 0 {
+			node.bucket.take(now, count, infinityDuration)
+		} else {
+			node.bucket.give(now, -count)
+		}
+	}
+}
+
+// pathReady tells whether all buckets from n to the root have tokens.
+func (n *SchedNode) pathReady(now time.Time) bool {
+	for node := n; node != nil; node = node.parent {
+		if node.bucket != nil && node.bucket.readyIn(now) > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// pathContended tells whether leaves that could go now are queued for a
+// bucket on the path from n to the root, n then has to queue up behind
+// them. Leaves held back by buckets of their own don't count.
+func (n *SchedNode) pathContended(now time.Time) bool {
+	for node := n; node != nil; node = node.parent {
+		if node.bucket != nil && node.waiters > 0 {
+			if leaf, _ := node.pick(now); leaf != nil {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// setWaiting adds or removes leaf n from the queue.
+func (n *SchedNode) setWaiting(waiting bool) {
+	delta := 1
+	if !waiting {
+		delta = -1
+	}
+	for node := n; node != nil; node = node.parent {
+		node.waiters += delta
+		if node.parent == nil {
+			continue
+		}
+		switch {
+		case waiting && node.waiters == 1:
+			node.parent.active[node] = struct{}{}
+			if node.vtime < node.parent.vclock {
+				node.vtime = node.parent.vclock
+			}
+		case !waiting && node.waiters == 0:
+			delete(node.parent.active, node)
+		}
+	}
+}
+
+type byVTime []*SchedNode
+
+func (s byVTime) Len() int           { return len(s) }
+func (s byVTime) Less(i, j int) bool { return s[i].vtime < s[j].vtime }
+func (s byVTime) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+// pick returns the waiting leaf under n to serve next. If none can go now,
+// it returns how long until one may.
+func (n *SchedNode) pick(now time.Time) (*SchedNode, time.Duration) {
+	if n.bucket != nil {
+		if d := n.bucket.readyIn(now); d > 0 {
+			return nil, d
+		}
+	}
+	if n.granted != nil {
+		return n, 0
+	}
+	children := make(byVTime, 0, len(n.active))
+	for child := range n.active {
+		children = append(children, child)
+	}
+	sort.Sort(children)
+	wait := infinityDuration
+	for _, child := range children {
+		leaf, d := child.pick(now)
+		if leaf != nil {
+			return leaf, 0
+		}
+		if d < wait {
+			wait = d
+		}
+	}
+	return nil, wait
+}
+
+// dispatch hands out tokens to the waiting leaves until there are none.
+func (s *Scheduler) dispatch() {
+	for {
+		s.lock.Lock()
+		if s.root.waiters == 0 {
+			s.running = false
+			s.lock.Unlock()
+			return
+		}
+		now := time.Now()
+		leaf, wait := s.root.pick(now)
+		if leaf != nil {
+			leaf.setWaiting(false)
+			leaf.take(now)
+			leaf.granted <- struct{}{}
+			s.lock.Unlock()
+			continue
+		}
+		s.lock.Unlock()
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-s.kick:
+			timer.Stop()
+		}
+	}
+}
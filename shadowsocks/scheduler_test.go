@@ -0,0 +1,179 @@
+package shadowsocks
+
+import (
+	"testing"
+	"time"
+)
+
+// serve lets the scheduler pick n times between leaves that always wait,
+// each transfer moves a full reserve. It returns how often each was picked.
+func serve(s *Scheduler, n int, leaves ...*SchedNode) map[*SchedNode]int {
+	now := time.Now()
+	for _, leaf := range leaves {
+		if leaf.waiters == 0 {
+			leaf.setWaiting(true)
+		}
+	}
+	picked := make(map[*SchedNode]int)
+	for i := 0; i < n; i++ {
+		leaf, _ := s.root.pick(now)
+		leaf.setWaiting(false)
+		leaf.take(now)
+		leaf.settle(now, leaf.reserve)
+		picked[leaf]++
+		leaf.setWaiting(true)
+	}
+	return picked
+}
+
+func TestSchedulerWeights(t *testing.T) {
+	s := NewScheduler(nil)
+	group := SchedClass{Key: "default"}
+	a := s.NewLeaf(100, group, SchedClass{Key: "1000"})
+	b := s.NewLeaf(100, group, SchedClass{Key: "1001", Weight: 3})
+	picked := serve(s, 400, a, b)
+	if picked[a] < 99 || picked[a] > 101 || picked[b] < 299 || picked[b] > 301 {
+		t.Errorf("weights 1 and 3 should share 1:3, got %d and %d", picked[a], picked[b])
+	}
+}
+
+func TestSchedulerFairBetweenConnections(t *testing.T) {
+	s := NewScheduler(nil)
+	user := SchedClass{Key: "1000"}
+	bulk := s.NewLeaf(4096, user)
+	serve(s, 100, bulk)
+
+	// A connection that was idle goes first, and is not starved afterwards.
+	interactive := s.NewLeaf(100, user)
+	interactive.setWaiting(true)
+	if leaf, _ := s.root.pick(time.Now()); leaf != interactive {
+		t.Fatal("idle connection should be served before the bulk one")
+	}
+	picked := serve(s, 100, bulk, interactive)
+	if picked[interactive] < 90 {
+		t.Errorf("interactive connection got %d of 100 turns", picked[interactive])
+	}
+}
+
+func TestSchedulerBucketBlocksSubtree(t *testing.T) {
+	limited := NewBucket(time.Second, 1)
+	limited.take(time.Now(), 10, infinityDuration)
+	s := NewScheduler(nil)
+	a := s.NewLeaf(100, SchedClass{Key: "1000", Bucket: limited})
+	b := s.NewLeaf(100, SchedClass{Key: "1001"})
+	picked := serve(s, 10, a, b)
+	if picked[a] != 0 || picked[b] != 10 {
+		t.Errorf("user out of tokens should not be served, got %d and %d", picked[a], picked[b])
+	}
+}
+
+func TestSchedulerUpdate(t *testing.T) {
+	limited := NewBucket(time.Second, 1)
+	limited.take(time.Now(), 10, infinityDuration)
+	s := NewScheduler(nil)
+	a := s.NewLeaf(100, SchedClass{Key: "1000", Bucket: limited})
+	a.setWaiting(true)
+	if leaf, _ := s.root.pick(time.Now()); leaf != nil {
+		t.Fatal("user out of tokens should not be served")
+	}
+	// Lifting the limit applies to the existing leaf.
+	s.Update(SchedClass{Key: "1000"})
+	if leaf, _ := s.root.pick(time.Now()); leaf != a {
+		t.Error("user without a bucket should be served")
+	}
+	s.Update(SchedClass{Key: "1001"})
+	if len(s.root.children) != 1 {
+		t.Error("update should not add nodes")
+	}
+}
+
+func TestSchedulerRelease(t *testing.T) {
+	s := NewScheduler(nil)
+	a := s.NewLeaf(0, SchedClass{Key: "g"}, SchedClass{Key: "1000"})
+	b := s.NewLeaf(0, SchedClass{Key: "g"}, SchedClass{Key: "1000"})
+	if a.parent != b.parent {
+		t.Fatal("leaves of a user should share the user node")
+	}
+	a.Release()
+	if len(s.root.children) != 1 {
+		t.Fatal("user node should stay while it has leaves")
+	}
+	b.Release()
+	if len(s.root.children) != 0 || s.root.leaves != 0 {
+		t.Errorf("empty nodes should be removed, %d left", len(s.root.children))
+	}
+}
+
+func TestSchedulerWaitReady(t *testing.T) {
+	bucket := NewBucket(time.Millisecond, 1000)
+	s := NewScheduler(bucket)
+	a := s.NewLeaf(1000, SchedClass{Key: "1000"})
+	b := s.NewLeaf(1000, SchedClass{Key: "1001"})
+	defer a.Release()
+	defer b.Release()
+
+	if err := a.WaitReady(time.Time{}, nil); err != nil {
+		t.Fatal(err)
+	}
+	a.Account(1000)
+	start := time.Now()
+	if err := b.WaitReady(time.Time{}, nil); err != nil {
+		t.Fatal(err)
+	}
+	b.Account(500)
+	if elapsed := time.Since(start); elapsed < 500*time.Millisecond/1000 {
+		t.Errorf("should wait for the root bucket, waited %v", elapsed)
+	}
+
+	bucket.take(time.Now(), 60*1000, infinityDuration)
+	cancel := make(chan struct{})
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		close(cancel)
+	}()
+	if err := a.WaitReady(time.Time{}, cancel); err != ErrWaitCanceled {
+		t.Fatalf("got %v, want ErrWaitCanceled", err)
+	}
+	if s.root.waiters != 0 {
+		t.Errorf("canceled leaf should leave the queue, %d waiters", s.root.waiters)
+	}
+}
+
+func TestSchedulerUnlimitedSkipsLock(t *testing.T) {
+	s := NewScheduler(nil)
+	a := s.NewLeaf(100, SchedClass{Key: "default"}, SchedClass{Key: "1000"})
+	defer a.Release()
+	// transfer moves data with the lock of the scheduler held, it tells
+	// whether that went through without the lock.
+	transfer := func() bool {
+		done := make(chan struct{})
+		s.lock.Lock()
+		go func() {
+			a.WaitReady(time.Time{}, nil)
+			a.Account(100)
+			close(done)
+		}()
+		select {
+		case <-done:
+			s.lock.Unlock()
+			return true
+		case <-time.After(100 * time.Millisecond):
+		}
+		s.lock.Unlock()
+		<-done
+		return false
+	}
+	if !transfer() {
+		t.Error("leaf without buckets should not take the lock")
+	}
+
+	// A bucket of the group applies to the users below it.
+	s.Update(SchedClass{Key: "default", Bucket: NewBucket(time.Millisecond, 1000)})
+	if transfer() {
+		t.Error("leaf with a bucket on its path should go through the scheduler")
+	}
+	s.Update(SchedClass{Key: "default"})
+	if !transfer() {
+		t.Error("leaf should skip the lock again once the limit is lifted")
+	}
+}
@@ -1,122 +1,176 @@
 package shadowsocks
 
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// UserStatistic is a point in time copy of the counters of one user.
 type UserStatistic struct {
 	UserID      uint32
 	BytesIn     uint64
 	BytesOut    uint64
 	Connections uint64
+	Rejections  uint64
 }
 
-func init() {
-	userStatisticMap = make(map[uint32]*UserStatistic)
-	userStatisticService = nil
+// userCounters are only accessed with sync/atomic, so updating them does not
+// need the shard lock.
+type userCounters struct {
+	bytesIn     uint64
+	bytesOut    uint64
+	connections uint64
+	rejections  uint64
 }
 
-const (
-	OpIncConnections uint8 = 1
-	OpIncBytesOut    uint8 = 2
-	OpIncBytesIn     uint8 = 3
-)
+func (c *userCounters) load(userID uint32) UserStatistic {
+	return UserStatistic{
+		UserID:      userID,
+		BytesIn:     atomic.LoadUint64(&c.bytesIn),
+		BytesOut:    atomic.LoadUint64(&c.bytesOut),
+		Connections: atomic.LoadUint64(&c.connections),
+		Rejections:  atomic.LoadUint64(&c.rejections),
+	}
+}
+
+const statisticShards = 64
 
-type UserStaticOp struct {
-	Op     uint8
-	UserID uint32
-	Value  int
+// The shard lock only guards the users map, the write lock is taken when a
+// user is seen for the first time.
+type statisticShard struct {
+	sync.RWMutex
+	users map[uint32]*userCounters
 }
 
+// UserStatisticService keeps cumulative per user counters. Counters never go
+// backwards, consumers that want deltas use a StatisticCollector.
 type UserStatisticService struct {
-	Queue chan UserStaticOp
+	shards [statisticShards]statisticShard
 }
 
-var userStatisticMap map[uint32]*UserStatistic
 var userStatisticService *UserStatisticService
 
-func CreateUserStatisticService() {
-	userStatisticService = &UserStatisticService{
-		Queue: make(chan UserStaticOp, 100),
+func NewUserStatisticService() *UserStatisticService {
+	s := &UserStatisticService{}
+	for i := range s.shards {
+		s.shards[i].users = make(map[uint32]*userCounters)
 	}
-	go userStatisticService.RunUserStaticOpServer()
+	return s
+}
+
+func CreateUserStatisticService() {
+	userStatisticService = NewUserStatisticService()
 }
 
 func GetUserStatisticService() *UserStatisticService {
 	return userStatisticService
 }
 
-func (s *UserStatisticService) RunUserStaticOpServer() {
-	for {
-		op := <-s.Queue
-		userStat := GetUserStatistic(op.UserID)
-		switch op.Op {
-		case OpIncConnections:
-			userStat.IncConnections()
-		case OpIncBytesOut:
-			userStat.IncOutBytes(op.Value)
-		case OpIncBytesIn:
-			userStat.IncInBytes(op.Value)
-		}
+func (s *UserStatisticService) counters(userID uint32) *userCounters {
+	shard := &s.shards[userID%statisticShards]
+	shard.RLock()
+	c, have := shard.users[userID]
+	shard.RUnlock()
+	if have {
+		return c
+	}
+	shard.Lock()
+	defer shard.Unlock()
+	if c, have = shard.users[userID]; !have {
+		c = &userCounters{}
+		shard.users[userID] = c
 	}
+	return c
 }
 
 func (s *UserStatisticService) IncConnections(userID uint32) {
-	op := UserStaticOp{
-		Op:     OpIncConnections,
-		UserID: userID,
-		Value:  1,
-	}
-	s.Queue <- op
+	atomic.AddUint64(&s.counters(userID).connections, 1)
 }
 
-func (s *UserStatisticService) IncInBytes(userID uint32, value int) {
-	op := UserStaticOp{
-		Op:     OpIncBytesIn,
-		UserID: userID,
-		Value:  value,
-	}
-	s.Queue <- op
+func (s *UserStatisticService) IncRejections(userID uint32) {
+	atomic.AddUint64(&s.counters(userID).rejections, 1)
 }
 
-func (s *UserStatisticService) IncOutBytes(userID uint32, value int) {
-	op := UserStaticOp{
-		Op:     OpIncBytesOut,
-		UserID: userID,
-		Value:  value,
-	}
-	s.Queue <- op
+func (s *UserStatisticService) IncInBytes(userID uint32, value int) {
+	atomic.AddUint64(&s.counters(userID).bytesIn, uint64(value))
 }
 
-func (us *UserStatistic) IncBytes(inBytes, outBytes int) {
-	us.BytesIn += uint64(inBytes)
-	us.BytesOut += uint64(outBytes)
+func (s *UserStatisticService) IncOutBytes(userID uint32, value int) {
+	atomic.AddUint64(&s.counters(userID).bytesOut, uint64(value))
 }
 
-func (us *UserStatistic) IncInBytes(bytes int) {
-	us.BytesIn += uint64(bytes)
+// Get returns the counters of one user.
+func (s *UserStatisticService) Get(userID uint32) UserStatistic {
+	return s.counters(userID).load(userID)
 }
 
-func (us *UserStatistic) IncOutBytes(bytes int) {
-	us.BytesOut += uint64(bytes)
+// Snapshot returns a copy of the counters of all users. Every counter is
+// read atomically, the copy can be used freely by the caller.
+func (s *UserStatisticService) Snapshot() map[uint32]UserStatistic {
+	snapshot := make(map[uint32]UserStatistic)
+	for i := range s.shards {
+		shard := &s.shards[i]
+		shard.RLock()
+		for userID, c := range shard.users {
+			snapshot[userID] = c.load(userID)
+		}
+		shard.RUnlock()
+	}
+	return snapshot
 }
 
-func (us *UserStatistic) IncConnections() {
-	us.Connections += 1
+// NewCollector creates a StatisticCollector that starts counting from the
+// current counters.
+func (s *UserStatisticService) NewCollector() *StatisticCollector {
+	return &StatisticCollector{
+		service: s,
+		last:    s.Snapshot(),
+	}
 }
 
-func GetUserStatistic(userID uint32) *UserStatistic {
-	us, have := userStatisticMap[userID]
-	if !have {
-		nus := &UserStatistic{
+// StatisticCollector pulls per user deltas from a UserStatisticService.
+// Every collector has its own position, so several consumers can each get
+// every byte exactly once.
+type StatisticCollector struct {
+	lock    sync.Mutex
+	service *UserStatisticService
+	last    map[uint32]UserStatistic
+}
+
+// Collect reads and resets the collector: it returns what has been counted
+// since the last call and only users with non zero deltas are included. An
+// increment racing with Collect shows up in exactly one of two consecutive
+// calls.
+func (c *StatisticCollector) Collect() map[uint32]UserStatistic {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	deltas := make(map[uint32]UserStatistic)
+	for userID, cur := range c.service.Snapshot() {
+		last := c.last[userID]
+		c.last[userID] = cur
+		delta := UserStatistic{
 			UserID:      userID,
-			BytesIn:     0,
-			BytesOut:    0,
-			Connections: 0,
+			BytesIn:     cur.BytesIn - last.BytesIn,
+			BytesOut:    cur.BytesOut - last.BytesOut,
+			Connections: cur.Connections - last.Connections,
+			Rejections:  cur.Rejections - last.Rejections,
+		}
+		if delta.BytesIn == 0 && delta.BytesOut == 0 && delta.Connections == 0 && delta.Rejections == 0 {
+			continue
 		}
-		userStatisticMap[userID] = nus
-		return nus
-	} else {
-		return us
+		deltas[userID] = delta
 	}
+	return deltas
 }
 
-func GetUserStatisticMap() map[uint32]*UserStatistic {
-	return userStatisticMap
+func GetUserStatistic(userID uint32) UserStatistic {
+	return userStatisticService.Get(userID)
+}
+
+// GetUserStatisticMap returns a snapshot of all user statistics.
+func GetUserStatisticMap() map[uint32]UserStatistic {
+	if userStatisticService == nil {
+		return map[uint32]UserStatistic{}
+	}
+	return userStatisticService.Snapshot()
 }
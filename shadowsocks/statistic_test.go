@@ -0,0 +1,110 @@
+package shadowsocks
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestUserStatisticConcurrentInc(t *testing.T) {
+	s := NewUserStatisticService()
+	const workers, loops = 8, 1000
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < loops; j++ {
+				userID := uint32(j % 100)
+				s.IncInBytes(userID, 1)
+				s.IncOutBytes(userID, 2)
+				if j%10 == 0 {
+					s.IncConnections(userID)
+				}
+				if j%50 == 0 {
+					s.Snapshot()
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	snapshot := s.Snapshot()
+	if len(snapshot) != 100 {
+		t.Fatalf("snapshot should have 100 users, got %d", len(snapshot))
+	}
+	var in, out, conns uint64
+	for userID, stat := range snapshot {
+		if stat.UserID != userID {
+			t.Errorf("user %d has wrong UserID %d", userID, stat.UserID)
+		}
+		in += stat.BytesIn
+		out += stat.BytesOut
+		conns += stat.Connections
+	}
+	if in != workers*loops || out != 2*workers*loops || conns != workers*loops/10 {
+		t.Errorf("wrong totals in=%d out=%d connections=%d", in, out, conns)
+	}
+}
+
+func TestStatisticCollector(t *testing.T) {
+	s := NewUserStatisticService()
+	s.IncInBytes(1, 100)
+	c := s.NewCollector()
+	other := s.NewCollector()
+
+	if deltas := c.Collect(); len(deltas) != 0 {
+		t.Errorf("collector should start from current counters, got %v", deltas)
+	}
+	s.IncInBytes(1, 10)
+	s.IncOutBytes(2, 20)
+	s.IncRejections(2)
+
+	deltas := c.Collect()
+	if len(deltas) != 2 {
+		t.Fatalf("should have deltas for 2 users, got %v", deltas)
+	}
+	if deltas[1].BytesIn != 10 || deltas[1].BytesOut != 0 {
+		t.Errorf("wrong delta for user 1: %+v", deltas[1])
+	}
+	if deltas[2].BytesOut != 20 || deltas[2].Rejections != 1 {
+		t.Errorf("wrong delta for user 2: %+v", deltas[2])
+	}
+	if deltas = c.Collect(); len(deltas) != 0 {
+		t.Errorf("second collect should be empty, got %v", deltas)
+	}
+
+	// Collectors don't reset each other.
+	deltas = other.Collect()
+	if deltas[1].BytesIn != 10 || deltas[2].BytesOut != 20 {
+		t.Errorf("other collector got wrong deltas: %v", deltas)
+	}
+	if stat := s.Get(1); stat.BytesIn != 110 {
+		t.Errorf("cumulative counter should not be reset, got %d", stat.BytesIn)
+	}
+}
+
+func TestStatisticCollectorConcurrent(t *testing.T) {
+	s := NewUserStatisticService()
+	c := s.NewCollector()
+	const loops = 10000
+	done := make(chan bool)
+	go func() {
+		for i := 0; i < loops; i++ {
+			s.IncInBytes(7, 1)
+		}
+		close(done)
+	}()
+	var total uint64
+	for running := true; running; {
+		select {
+		case <-done:
+			running = false
+		default:
+		}
+		total += c.Collect()[7].BytesIn
+	}
+	total += c.Collect()[7].BytesIn
+	if total != loops {
+		t.Errorf("collected %d bytes, should be %d", total, loops)
+	}
+}
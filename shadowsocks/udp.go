@@ -4,18 +4,35 @@ import (
 	"bytes"
 	"errors"
 	"net"
+	"sync/atomic"
+	"time"
 )
 
+// udpMaxWait is how long a packet of a user over its bandwidth may wait for
+// the bucket before it is dropped.
+const udpMaxWait = 20 * time.Millisecond
+
 type UDPConn struct {
 	*net.UDPConn
 	*Cipher
 	readBuf []byte
 	// writeBuf []byte
 	// for shadowsocks-go
-	natlist     NATlist
 	UserID      uint32
 	WriteBucket *Bucket
 	ReadBucket  *Bucket
+	NATObserver NATObserver
+	// NAT holds the mappings of the clients, a table shared by the UDPConns
+	// without one is used when nil.
+	NAT *NATTable
+	// MaxNATEntries is the most mappings the user may have, the least
+	// recently used one makes room when reached. 0 means no limit.
+	MaxNATEntries int
+	// Resolver resolves domains, the system resolver is used when nil.
+	Resolver *Resolver
+	// DestinationFilter, if set, is asked before relaying a packet. host is
+	// the domain or IP sent by the client, dst the address it resolved to.
+	DestinationFilter func(host string, dst *net.UDPAddr) bool
 }
 
 func UDPDecryptData(n int, data []byte, cipher *Cipher, output []byte) (int, []byte, error) {
@@ -33,14 +50,12 @@ func UDPDecryptData(n int, data []byte, cipher *Cipher, output []byte) (int, []b
 }
 
 func NewUDPConn(c *net.UDPConn, cipher *Cipher) *UDPConn {
+	// readBuf is taken on the first read, the server only writes.
 	return &UDPConn{
 		UDPConn: c,
 		Cipher:  cipher,
-		readBuf: leakyBuf.Get(),
 		// for thread safety
 		// writeBuf: leakyBuf.Get(),
-		// for shadowsocks-go
-		natlist: NATlist{conns: map[string]*CachedUDPConn{}},
 	}
 }
 
@@ -61,16 +76,31 @@ func (c *UDPConn) GetUserStatisticService() *UserStatisticService {
 }
 
 func (c *UDPConn) Close() error {
-	leakyBuf.Put(c.readBuf)
+	if c.readBuf != nil {
+		PutUDPBuffer(c.readBuf)
+	}
 	return c.UDPConn.Close()
 }
 
+func (c *UDPConn) getReadBuf() []byte {
+	if c.readBuf == nil {
+		c.readBuf = GetUDPBuffer(UDPBufSize)
+	}
+	return c.readBuf
+}
+
 func (c *UDPConn) Read(b []byte) (n int, err error) {
-	buf := c.readBuf
+	buf := c.getReadBuf()
 	n, err = c.UDPConn.Read(buf[0:])
 	if err != nil {
 		return
 	}
+	if UDPTooLarge(n) {
+		return 0, errDatagramTooLarge
+	}
+	if n < c.info.ivLen {
+		return 0, errors.New("[udp]read error: cannot decrypt")
+	}
 
 	iv := buf[:c.info.ivLen]
 	if err = c.initDecrypt(iv); err != nil {
@@ -92,10 +122,13 @@ func (c *UDPConn) Read(b []byte) (n int, err error) {
 }
 
 func (c *UDPConn) ReadFrom(b []byte) (n int, src net.Addr, err error) {
-	n, src, err = c.UDPConn.ReadFrom(c.readBuf[0:])
+	n, src, err = c.UDPConn.ReadFrom(c.getReadBuf())
 	if err != nil {
 		return
 	}
+	if UDPTooLarge(n) {
+		return 0, src, errDatagramTooLarge
+	}
 	if n < c.info.ivLen {
 		return 0, nil, errors.New("[udp]read error: cannot decrypt")
 	}
@@ -147,6 +180,14 @@ func (c *UDPConn) WriteTo(b []byte, dst net.Addr) (n int, err error) {
 }
 
 func (c *UDPConn) WriteToUDP(b []byte, dst *net.UDPAddr, auth bool) (n int, err error) {
+	// Like AccountRead: a reply waiting long for the bandwidth of the user
+	// is dropped, the bucket is charged what was sent.
+	if c.WriteBucket != nil {
+		if err = c.WriteBucket.WaitReady(time.Now().Add(udpMaxWait), nil); err != nil {
+			atomic.AddUint64(&c.natTable().rateLimited, 1)
+			return
+		}
+	}
 	var iv []byte
 	iv, err = c.initEncrypt()
 	if err != nil {
@@ -175,12 +216,32 @@ func (c *UDPConn) WriteToUDP(b []byte, dst *net.UDPAddr, auth bool) (n int, err
 			uss.IncOutBytes(c.UserID, n)
 		}
 		if c.WriteBucket != nil {
-			c.WriteBucket.WaitMaxDuration(int64(n), RateLimitWaitMaxDuration)
+			c.WriteBucket.Account(int64(n))
 		}
 	}
 	return
 }
 
+// AccountRead charges a packet of n bytes, IV and cipher text, read from the
+// client to the ReadBucket and the statistics of the user, like Conn.Read
+// does. There is no flow control to slow the client down, so it reports
+// false, and the packet should be dropped, when the user is over its upload
+// bandwidth for longer than a short wait.
+func (c *UDPConn) AccountRead(n int) bool {
+	if c.ReadBucket != nil {
+		if err := c.ReadBucket.WaitReady(time.Now().Add(udpMaxWait), nil); err != nil {
+			atomic.AddUint64(&c.natTable().rateLimited, 1)
+			return false
+		}
+		c.ReadBucket.Account(int64(n))
+	}
+	uss := c.GetUserStatisticService()
+	if uss != nil {
+		uss.IncInBytes(c.UserID, n)
+	}
+	return true
+}
+
 func (c *UDPConn) WriteWithUserID(b []byte, userID []byte) (n int, err error) {
 	var iv []byte
 	iv, err = c.initEncrypt()
@@ -205,15 +266,15 @@ func (c *UDPConn) WriteWithUserID(b []byte, userID []byte) (n int, err error) {
 		c.encrypt(cipherData[dataStart:], b)
 	}
 
+	if c.WriteBucket != nil {
+		c.WriteBucket.Wait(int64(len(cipherData)))
+	}
 	n, err = c.UDPConn.Write(cipherData)
 	if n > 0 {
 		uss := c.GetUserStatisticService()
 		if uss != nil {
 			uss.IncOutBytes(c.UserID, n)
 		}
-		if c.WriteBucket != nil {
-			c.WriteBucket.WaitMaxDuration(int64(n), RateLimitWaitMaxDuration)
-		}
 	}
 	return
 }
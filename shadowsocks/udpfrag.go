@@ -0,0 +1,204 @@
+package shadowsocks
+
+// Datagram sizes, and reassembly of the fragmented datagrams of SOCKS5 UDP
+// associations (RFC 1928 section 7). FRAG 0 is a whole datagram, 1 to 127
+// the position of a fragment, with the high bit set on the last one.
+
+import (
+	"errors"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// DefaultMaxUDPSize is the largest UDP payload over IPv4.
+	DefaultMaxUDPSize = 65507
+	maxUDPSizeLimit   = 65535
+	// UDPBufSize is the size of a buffer any datagram can be read into, one
+	// byte more than the largest datagram, to tell oversized datagrams apart
+	// from those filling the buffer.
+	UDPBufSize = maxUDPSizeLimit + 1
+	// buffers of UDPBufSize kept for reuse, fewer than the smaller ones
+	udpMaxNBuf = 256
+
+	socksFragLast = 0x80
+	// the RFC asks for at least 5 seconds
+	defaultFragTimeout = 5 * time.Second
+)
+
+var (
+	udpBuf = NewLeakyBuf(udpMaxNBuf, UDPBufSize)
+
+	// accessed with sync/atomic
+	maxUDPSize      int32 = DefaultMaxUDPSize
+	udpOversize     uint64
+	fragReassembled uint64
+	fragExpired     uint64
+	fragDropped     uint64
+)
+
+// SetMaxUDPSize sets the largest datagram relayed, not positive means
+// DefaultMaxUDPSize. The buffers don't depend on it, it may change while
+// packets are relayed.
+func SetMaxUDPSize(size int) {
+	if size <= 0 {
+		size = DefaultMaxUDPSize
+	}
+	if size > maxUDPSizeLimit {
+		size = maxUDPSizeLimit
+	}
+	atomic.StoreInt32(&maxUDPSize, int32(size))
+}
+
+// MaxUDPSize returns the largest datagram relayed.
+func MaxUDPSize() int {
+	return int(atomic.LoadInt32(&maxUDPSize))
+}
+
+// GetUDPBuffer returns a buffer of size bytes, at most UDPBufSize. Most
+// datagrams are small, so they are copied out of the buffer they were read
+// into before being passed on: buffers up to the relay buffer size share the
+// pool of the TCP relay.
+func GetUDPBuffer(size int) []byte {
+	if size <= leakyBufSize {
+		return leakyBuf.Get()[:size]
+	}
+	return udpBuf.Get()[:size]
+}
+
+// PutUDPBuffer gives back a buffer of GetUDPBuffer.
+func PutUDPBuffer(b []byte) {
+	switch cap(b) {
+	case leakyBufSize:
+		leakyBuf.Put(b[:leakyBufSize])
+	case UDPBufSize:
+		udpBuf.Put(b[:UDPBufSize])
+	}
+}
+
+// UDPTooLarge reports whether a datagram of n bytes is over the maximum size,
+// counting it as dropped. A datagram read into a buffer of UDPBufSize bytes
+// is too large when it fills the buffer.
+func UDPTooLarge(n int) bool {
+	if n > MaxUDPSize() {
+		atomic.AddUint64(&udpOversize, 1)
+		return true
+	}
+	return false
+}
+
+// UDPOversizeDrops returns the number of datagrams dropped for being over the
+// maximum size.
+func UDPOversizeDrops() uint64 {
+	return atomic.LoadUint64(&udpOversize)
+}
+
+// FragStats are the counters of SOCKS5 UDP fragment reassembly.
+type FragStats struct {
+	Reassembled uint64
+	Expired     uint64 // fragments not all there within the timeout
+	Dropped     uint64 // given up for a fragment missing or out of order
+}
+
+// GetFragStats returns the counters of all FragReassemblers.
+func GetFragStats() FragStats {
+	return FragStats{
+		Reassembled: atomic.LoadUint64(&fragReassembled),
+		Expired:     atomic.LoadUint64(&fragExpired),
+		Dropped:     atomic.LoadUint64(&fragDropped),
+	}
+}
+
+// ParseSOCKSUDP splits a SOCKS5 UDP request into its FRAG field, address
+// header and payload.
+func ParseSOCKSUDP(b []byte) (frag byte, header, data []byte, err error) {
+	if len(b) < 3 {
+		return 0, nil, nil, errors.New("socks udp request too short")
+	}
+	if b[0] != 0 || b[1] != 0 {
+		return 0, nil, nil, errors.New("socks udp reserved bytes not zero")
+	}
+	hlen, err := addrHeaderLen(b[3:])
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	return b[2], b[3 : 3+hlen], b[3+hlen:], nil
+}
+
+// FragReassembler reassembles the fragmented datagrams of a SOCKS5 UDP
+// association. Like the RFC it keeps a single datagram in progress, which is
+// given up when a whole datagram or a fragment out of order arrives, or when
+// its fragments take longer than the timeout. It is not safe for concurrent
+// use.
+type FragReassembler struct {
+	// MaxSize is the largest datagram, header included, not positive means
+	// the maximum UDP size.
+	MaxSize int
+	// Timeout is how long the fragments of a datagram may take, not
+	// positive means 5 seconds.
+	Timeout time.Duration
+
+	header  []byte
+	data    []byte
+	last    byte // position of the last fragment added, 0 when none
+	started time.Time
+}
+
+func (r *FragReassembler) reset() {
+	r.header, r.data, r.last = nil, nil, 0
+}
+
+// Add adds a packet of the association, frag is its FRAG field, header and
+// data its address header and payload. It returns the header and payload of
+// a complete datagram, nil while fragments are missing.
+func (r *FragReassembler) Add(frag byte, header, data []byte, now time.Time) ([]byte, []byte) {
+	timeout := r.Timeout
+	if timeout <= 0 {
+		timeout = defaultFragTimeout
+	}
+	if r.last > 0 && now.Sub(r.started) > timeout {
+		atomic.AddUint64(&fragExpired, 1)
+		r.reset()
+	}
+	if frag == 0 {
+		if r.last > 0 {
+			atomic.AddUint64(&fragDropped, 1)
+			r.reset()
+		}
+		return header, data
+	}
+	pos := frag &^ socksFragLast
+	if pos != r.last+1 {
+		if r.last > 0 {
+			atomic.AddUint64(&fragDropped, 1)
+			r.reset()
+		}
+		if pos != 1 {
+			// The start of the datagram is missing.
+			atomic.AddUint64(&fragDropped, 1)
+			return nil, nil
+		}
+	}
+	if pos == 1 {
+		r.header = append([]byte(nil), header...)
+		r.started = now
+	}
+	maxSize := r.MaxSize
+	if maxSize <= 0 {
+		maxSize = MaxUDPSize()
+	}
+	if len(r.header)+len(r.data)+len(data) > maxSize {
+		atomic.AddUint64(&udpOversize, 1)
+		r.reset()
+		return nil, nil
+	}
+	r.data = append(r.data, data...)
+	r.last = pos
+	if frag&socksFragLast == 0 {
+		return nil, nil
+	}
+	header, data = r.header, r.data
+	r.reset()
+	atomic.AddUint64(&fragReassembled, 1)
+	return header, data
+}
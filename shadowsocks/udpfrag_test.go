@@ -0,0 +1,90 @@
+package shadowsocks
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestParseSOCKSUDP(t *testing.T) {
+	frag, header, data, err := ParseSOCKSUDP([]byte{0, 0, 0x81, typeIPv4, 10, 0, 0, 1, 0, 53, 'h', 'i'})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if frag != 0x81 || !bytes.Equal(header, []byte{typeIPv4, 10, 0, 0, 1, 0, 53}) || string(data) != "hi" {
+		t.Errorf("got %x %v %q", frag, header, data)
+	}
+	for _, bad := range [][]byte{{0, 0}, {0, 1, 0, typeIPv4, 10, 0, 0, 1, 0, 53}, {0, 0, 0, typeIPv4, 10}} {
+		if _, _, _, err := ParseSOCKSUDP(bad); err == nil {
+			t.Errorf("%v should fail", bad)
+		}
+	}
+}
+
+func TestFragReassembler(t *testing.T) {
+	header := []byte{typeIPv4, 10, 0, 0, 1, 0, 53}
+	now := time.Now()
+	r := &FragReassembler{MaxSize: 20}
+	before := GetFragStats()
+
+	if h, d := r.Add(0, header, []byte("whole"), now); !bytes.Equal(h, header) || string(d) != "whole" {
+		t.Errorf("whole datagram, got %v %q", h, d)
+	}
+	if h, _ := r.Add(1, header, []byte("ab"), now); h != nil {
+		t.Error("datagram should wait for its last fragment")
+	}
+	r.Add(2, header, []byte("cd"), now)
+	if h, d := r.Add(3|socksFragLast, header, []byte("ef"), now); !bytes.Equal(h, header) || string(d) != "abcdef" {
+		t.Errorf("reassembled, got %v %q", h, d)
+	}
+
+	// A fragment missing, the rest of the datagram is dropped.
+	r.Add(1, header, []byte("ab"), now)
+	if h, _ := r.Add(3|socksFragLast, header, []byte("ef"), now); h != nil {
+		t.Error("datagram with a missing fragment")
+	}
+	// Fragments taking too long.
+	r.Add(1, header, []byte("ab"), now)
+	if h, _ := r.Add(2|socksFragLast, header, []byte("cd"), now.Add(6*time.Second)); h != nil {
+		t.Error("expired datagram")
+	}
+	// Growing past the maximum size.
+	oversize := UDPOversizeDrops()
+	r.Add(1, header, []byte("abcdefgh"), now)
+	if h, _ := r.Add(2|socksFragLast, header, []byte("ijklmnop"), now); h != nil {
+		t.Error("oversized datagram")
+	}
+	if UDPOversizeDrops() != oversize+1 {
+		t.Error("oversized datagram should be counted")
+	}
+
+	stats := GetFragStats()
+	if stats.Reassembled-before.Reassembled != 1 || stats.Expired-before.Expired != 1 || stats.Dropped-before.Dropped != 3 {
+		t.Errorf("got %+v, before %+v", stats, before)
+	}
+}
+
+func TestUDPBuffers(t *testing.T) {
+	small := GetUDPBuffer(100)
+	if len(small) != 100 || cap(small) != leakyBufSize {
+		t.Errorf("small buffer of %d bytes, capacity %d", len(small), cap(small))
+	}
+	large := GetUDPBuffer(leakyBufSize + 1)
+	if len(large) != leakyBufSize+1 || cap(large) != UDPBufSize {
+		t.Errorf("large buffer of %d bytes, capacity %d", len(large), cap(large))
+	}
+	PutUDPBuffer(small)
+	PutUDPBuffer(large)
+	// Buffers of other sizes are left to the garbage collector.
+	PutUDPBuffer(make([]byte, 10))
+
+	defer SetMaxUDPSize(0)
+	SetMaxUDPSize(1000)
+	if !UDPTooLarge(1001) || UDPTooLarge(1000) {
+		t.Error("datagrams over the maximum size should be too large")
+	}
+	SetMaxUDPSize(100000)
+	if MaxUDPSize() != maxUDPSizeLimit || !UDPTooLarge(UDPBufSize) {
+		t.Error("maximum size should be capped to what fits a buffer")
+	}
+}
@@ -3,10 +3,9 @@ package shadowsocks
 import (
 	"bytes"
 	"encoding/binary"
-	"fmt"
 	"net"
 	"strconv"
-	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 )
@@ -26,95 +25,6 @@ const (
 	lenDmBase = 1 + 1 + 2           // 1addrType + 1addrLen + 2port, plus addrLen
 )
 
-var (
-	reqList = ReqList{List: map[string]*ReqNode{}}
-)
-
-type CachedUDPConn struct {
-	*net.UDPConn
-	srcaddr_index string
-}
-
-func NewCachedUDPConn(udpconn *net.UDPConn, index string) *CachedUDPConn {
-	return &CachedUDPConn{udpconn, index}
-}
-
-func (c *CachedUDPConn) Close() error {
-	return c.UDPConn.Close()
-}
-
-type NATlist struct {
-	sync.Mutex
-	conns map[string]*CachedUDPConn
-}
-
-func (self *NATlist) Delete(index string) {
-	self.Lock()
-	c, ok := self.conns[index]
-	if ok {
-		c.Close()
-		delete(self.conns, index)
-	}
-	// Socks5 Request header processing
-	reqList.Refresh()
-	defer self.Unlock()
-}
-
-func (self *NATlist) Get(index string) (c *CachedUDPConn, ok bool, err error) {
-	self.Lock()
-	defer self.Unlock()
-	c, ok = self.conns[index]
-	if !ok {
-		//NAT not exists or expired
-		//delete(self.conns, index)
-		//ok = false
-		//full cone
-		conn, err := net.ListenUDP("udp", &net.UDPAddr{
-			IP:   net.IPv6zero,
-			Port: 0,
-		})
-		if err != nil {
-			return nil, ok, err
-		}
-		c = NewCachedUDPConn(conn, index)
-		self.conns[index] = c
-	}
-	err = nil
-	return
-}
-
-type ReqNode struct {
-	Req    []byte
-	ReqLen int
-}
-
-type ReqList struct {
-	List map[string]*ReqNode
-	sync.Mutex
-}
-
-func (r *ReqList) Refresh() {
-	r.Lock()
-	defer r.Unlock()
-	for k, _ := range r.List {
-		delete(r.List, k)
-	}
-}
-
-func (r *ReqList) Get(dstaddr string) (req *ReqNode, ok bool) {
-	r.Lock()
-	defer r.Unlock()
-	req, ok = r.List[dstaddr]
-	return
-}
-
-func (r *ReqList) Put(dstaddr string, req *ReqNode) {
-	r.Lock()
-	defer r.Unlock()
-	r.List[dstaddr] = req
-	return
-}
-
 func ParseHeader(addr net.Addr) ([]byte, int) {
 	//what if the request address type is domain???
 	ip, port, err := net.SplitHostPort(addr.String())
@@ -139,114 +49,296 @@ func ParseHeader(addr net.Addr) ([]byte, int) {
 	return buf[:1+iplen+2], 1 + iplen + 2
 }
 
-func Pipeloop(ss *UDPConn, srcaddr *net.UDPAddr, remote *CachedUDPConn, auth bool) {
-	buf := leakyBuf.Get()
-	defer leakyBuf.Put(buf)
+// packetWriter sends the replies of a NAT mapping back to its client, as
+// address header plus payload.
+type packetWriter interface {
+	WritePacket(b []byte) error
+}
+
+// udpClient is a client sending packets to the UDP port of the server.
+type udpClient struct {
+	conn *UDPConn
+	addr *net.UDPAddr
+	auth bool
+}
+
+func (w *udpClient) WritePacket(b []byte) error {
+	_, err := w.conn.WriteToUDP(b, w.addr, w.auth)
+	return err
+}
+
+// sendLoop writes the replies queued by Pipeloop to the client one at a
+// time. A client over its bandwidth fills up the queue, and further replies
+// are dropped, instead of piling up goroutines. It returns when stop is
+// closed, dropping the replies still queued, and closes done then.
+func sendLoop(client packetWriter, queue <-chan []byte, stop <-chan struct{}, done chan<- struct{}) {
+	defer close(done)
 	for {
-		remote.SetDeadline(time.Now().Add(readTimeout))
-		n, raddr, err := remote.ReadFrom(buf)
+		select {
+		case packet := <-queue:
+			// Both may be ready, stop wins.
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			if err := client.WritePacket(packet); err != nil {
+				UDPLog.Debug("error writing to client", "err", err)
+			}
+		case <-stop:
+			return
+		}
+	}
+}
+
+// Pipeloop relays the packets from remote back to the client until remote is
+// closed or idle, it returns the error that ended it. client is the writer of
+// the first packet of the client, later packets bring their own, with the
+// limits of the user at the time.
+func Pipeloop(client packetWriter, remote *CachedUDPConn) error {
+	// One byte more than the largest datagram relayed, to tell oversized
+	// replies apart from those filling the buffer.
+	buf := GetUDPBuffer(MaxUDPSize() + 1)
+	defer func() {
+		PutUDPBuffer(buf)
+	}()
+	table := remote.table
+	queue := make(chan []byte, natQueueLen)
+	stop, done := make(chan struct{}), make(chan struct{})
+	remote.peerLock.Lock()
+	if remote.client == nil {
+		remote.client = client
+	}
+	remote.peerLock.Unlock()
+	go sendLoop(natClient{remote}, queue, stop, done)
+	// The client may go away once the mapping is closed, so nothing must be
+	// written to it after Pipeloop returns.
+	defer func() {
+		close(stop)
+		<-done
+	}()
+	for {
+		// Packets to the targets keep the mapping alive too, so the deadline
+		// is counted from the last packet either way.
+		last := time.Unix(0, atomic.LoadInt64(&remote.lastActive))
+		remote.SetReadDeadline(last.Add(table.idleTimeout))
+		n, raddr, err := remote.ReadFromUDP(buf)
 		if err != nil {
-			if ne, ok := err.(*net.OpError); ok && (ne.Err == syscall.EMFILE || ne.Err == syscall.ENFILE) {
+			ne, ok := err.(*net.OpError)
+			if ok && ne.Timeout() {
+				if remote.idleFor(time.Now()) < table.idleTimeout {
+					continue
+				}
+				atomic.AddUint64(&table.expired, 1)
+				UDPLog.Debug("nat entry expired", "addr", remote.LocalAddr())
+			} else if ok && (ne.Err == syscall.EMFILE || ne.Err == syscall.ENFILE) {
 				// log too many open file error
 				// EMFILE is process reaches open file limits, ENFILE is system limit
-				fmt.Println("[UDP] read error:", err)
-			} else if ne.Err.Error() == "use of closed network connection" {
-				fmt.Println("[UDP] Connection Closing:", remote.LocalAddr())
+				UDPLog.Error("read error", "err", err)
+			} else if ok && ne.Err.Error() == "use of closed network connection" {
+				UDPLog.Debug("connection closing", "addr", remote.LocalAddr())
 			} else {
-				fmt.Println("[UDP] error reading from:", remote.LocalAddr(), err)
+				UDPLog.Debug("error reading from remote", "addr", remote.LocalAddr(), "err", err)
 			}
-			return
+			return err
 		}
-		// need improvement here
-		if N, ok := reqList.Get(raddr.String()); ok {
-			go ss.WriteToUDP(append(N.Req[:N.ReqLen], buf[:n]...), srcaddr, auth)
-		} else {
-			fmt.Printf("%v\n", raddr)
-			header, hlen := ParseHeader(raddr)
-			go ss.WriteToUDP(append(header[:hlen], buf[:n]...), srcaddr, auth)
+		if n == len(buf) && n <= MaxUDPSize() {
+			// The maximum size was raised since the buffer was taken, the
+			// reply may have been cut short.
+			atomic.AddUint64(&table.truncated, 1)
+			UDPLog.Debug("reply too large for the buffer dropped", "from", raddr, "addr", remote.LocalAddr())
+			PutUDPBuffer(buf)
+			buf = GetUDPBuffer(MaxUDPSize() + 1)
+			continue
+		}
+		if !remote.permits(raddr) {
+			atomic.AddUint64(&table.filtered, 1)
+			UDPLog.Debug("packet filtered", "from", raddr, "addr", remote.LocalAddr())
+			continue
+		}
+		table.touch(remote)
+		header := remote.header(raddr)
+		if UDPTooLarge(len(header) + n) {
+			UDPLog.Debug("oversized reply dropped", "from", raddr, "size", n, "addr", remote.LocalAddr())
+			continue
+		}
+		packet := make([]byte, 0, len(header)+n)
+		packet = append(append(packet, header...), buf[:n]...)
+		select {
+		case queue <- packet:
+			atomic.AddUint64(&remote.bytesOut, uint64(n))
+		default:
+			atomic.AddUint64(&table.dropped, 1)
+			UDPLog.Debug("reply dropped, client queue full", "addr", remote.LocalAddr())
 		}
 	}
 }
 
-func (c *UDPConn) HandleUDPConnection(n int, src *net.UDPAddr, receive []byte, requireAuth bool, iv []byte) {
+// udpTarget is where a packet of a client goes, as told by its address
+// header.
+type udpTarget struct {
+	dst    *net.UDPAddr
+	host   string // the domain or IP sent by the client
+	header []byte
+	// until when the address of a domain holds
+	expires time.Time
+}
+
+// parseTarget parses the address header at the start of a packet of the
+// client key and resolves it. Only the host of the target is set with an
+// error, when the domain could not be resolved.
+func (c *UDPConn) parseTarget(key string, packet []byte) (target udpTarget, err error) {
+	reqLen, err := addrHeaderLen(packet)
+	if err != nil {
+		return target, err
+	}
 	var dstIP net.IP
-	var reqLen int
-	defer leakyBuf.Put(receive)
-	addrType := receive[idType]
-	switch addrType & AddrMask {
+	switch packet[idType] & AddrMask {
 	case typeIPv4:
-		reqLen = lenIPv4
-		dstIP = net.IP(receive[idIP0 : idIP0+net.IPv4len])
+		dstIP = append(net.IP(nil), packet[idIP0:idIP0+net.IPv4len]...)
 	case typeIPv6:
-		reqLen = lenIPv6
-		dstIP = net.IP(receive[idIP0 : idIP0+net.IPv6len])
+		dstIP = append(net.IP(nil), packet[idIP0:idIP0+net.IPv6len]...)
 	case typeDm:
-		reqLen = int(receive[idDmLen]) + lenDmBase
-		dIP, err := net.ResolveIPAddr("ip", string(receive[idDm0:idDm0+receive[idDmLen]]))
-		if err != nil {
-			fmt.Printf("[UDP] failed to resolve domain name: %s\n", string(receive[idDm0:idDm0+receive[idDmLen]]))
-			return
+		target.host = string(packet[idDm0 : idDm0+packet[idDmLen]])
+		if dstIP, target.expires, err = c.resolve(key, target.host); err != nil {
+			return target, err
 		}
-		dstIP = dIP.IP
-	default:
-		fmt.Printf("[UDP] addr type %d not supported\n", receive[idType])
-		return
-	}
-	auth := addrType&OneTimeAuthMask > 0
-	if auth != requireAuth {
-		fmt.Printf("[UDP] require auth\n")
-		return
 	}
-	dst := &net.UDPAddr{
+	target.dst = &net.UDPAddr{
 		IP:   dstIP,
-		Port: int(binary.BigEndian.Uint16(receive[reqLen-2 : reqLen])),
+		Port: int(binary.BigEndian.Uint16(packet[reqLen-2 : reqLen])),
 	}
-	fmt.Printf("[UDP] Address Type %d, Address: %v, Port: %v\n", addrType&AddrMask, dst.IP, dst.Port)
-	if _, ok := reqList.Get(dst.String()); !ok {
-		req := make([]byte, reqLen)
-		for i := 0; i < reqLen; i++ {
-			req[i] = receive[i]
-		}
-		reqList.Put(dst.String(), &ReqNode{req, reqLen})
+	if target.host == "" {
+		target.host = dstIP.String()
 	}
+	target.header = packet[:reqLen]
+	return target, nil
+}
 
-	if auth {
-		authData := receive[n-10 : n]
-		key := c.GetKey()
-		actualHmacSha1Buf := HmacSha1(append(iv, key...), receive[:n-10])
-		if !bytes.Equal(authData, actualHmacSha1Buf) {
-			fmt.Printf("verify one time auth failed\n")
-			return
-		}
+// needsLookup tells whether the target of packet, from the client key, is a
+// domain parseTarget has to look up first.
+func (c *UDPConn) needsLookup(key string, packet []byte) bool {
+	if len(packet) <= idDmLen || packet[idType]&AddrMask != typeDm {
+		return false
+	}
+	end := idDm0 + int(packet[idDmLen])
+	if len(packet) < end {
+		return false
+	}
+	remote := c.natTable().lookup(c.UserID, key)
+	return remote == nil || !remote.resolved(string(packet[idDm0:end]))
+}
+
+// resolve returns the address of domain for the client key, through the
+// cache of its mapping if it has one, and until when it holds.
+func (c *UDPConn) resolve(key, domain string) (net.IP, time.Time, error) {
+	table := c.natTable()
+	if remote := table.lookup(c.UserID, key); remote != nil {
+		return remote.resolve(c.Resolver, domain)
+	}
+	// The socket of the new mapping doesn't exist yet, an IPv4 address
+	// suits all of them.
+	ip, expires, err := lookupUDPTarget(c.Resolver, domain, false)
+	if err != nil {
+		atomic.AddUint64(&table.resolveFailed, 1)
+	}
+	return ip, expires, err
+}
+
+func (c *UDPConn) natTable() *NATTable {
+	if c.NAT != nil {
+		return c.NAT
 	}
+	return getDefaultNATTable()
+}
 
-	remote, exist, err := c.natlist.Get(src.String())
+// relay sends payload to target through the NAT mapping of the client, src
+// is its address and key tells it apart in the table. Replies from the
+// target carry the address header of target back through client. It returns
+// the mapping used.
+func (c *UDPConn) relay(key string, src net.Addr, target udpTarget, payload []byte, client packetWriter) (*CachedUDPConn, error) {
+	dst, header := target.dst, target.header
+	table := c.natTable()
+	remote, created, err := table.get(c.UserID, key, c.MaxNATEntries)
 	if err != nil {
-		return
+		return nil, err
 	}
-	if !exist {
+	remote.setClient(client)
+	// Replies from dst carry the address the way the client sent it.
+	remote.setHeader(dst, header)
+	if header[idType]&AddrMask == typeDm {
+		remote.remember(target.host, dst.IP, target.expires)
+	}
+	if created {
+		if c.NATObserver != nil {
+			c.NATObserver.NATOpened(c.UserID, src, dst, remote)
+		}
 		go func() {
-			Pipeloop(c, src, remote, auth)
-			c.natlist.Delete(src.String())
+			defer table.loops.Done()
+			defer close(remote.done)
+			err := Pipeloop(client, remote)
+			err = table.remove(remote, err)
+			if c.NATObserver != nil {
+				c.NATObserver.NATClosed(remote, err)
+			}
 		}()
 	}
-	remote.SetDeadline(time.Now().Add(udpTimeout))
-	go func() {
-		if auth {
-			_, err = remote.WriteToUDP(receive[reqLen:n-10], dst)
+	written, err := remote.WriteToUDP(payload, dst)
+	atomic.AddUint64(&remote.bytesIn, uint64(written))
+	if err != nil {
+		if ne, ok := err.(*net.OpError); ok && (ne.Err == syscall.EMFILE || ne.Err == syscall.ENFILE) {
+			// log too many open file error
+			// EMFILE is process reaches open file limits, ENFILE is system limit
+			UDPLog.Error("write error", "err", err)
 		} else {
-			_, err = remote.WriteToUDP(receive[reqLen:n], dst)
+			UDPLog.Debug("error connecting to target", "dst", dst, "err", err)
 		}
-		if err != nil {
-			if ne, ok := err.(*net.OpError); ok && (ne.Err == syscall.EMFILE || ne.Err == syscall.ENFILE) {
-				// log too many open file error
-				// EMFILE is process reaches open file limits, ENFILE is system limit
-				fmt.Println("[udp]write error:", err)
-			} else {
-				fmt.Println("[udp]error connecting to:", dst, err)
-			}
-			c.natlist.Delete(src.String())
+		table.remove(remote, err)
+	}
+	return remote, nil
+}
+
+func (c *UDPConn) HandleUDPConnection(n int, src *net.UDPAddr, receive []byte, requireAuth bool, iv []byte) {
+	defer PutUDPBuffer(receive)
+	addrType := receive[idType]
+	auth := addrType&OneTimeAuthMask > 0
+	if auth != requireAuth {
+		UDPLog.Warn("require auth", "client", src)
+		return
+	}
+	end := n
+	if auth {
+		if end -= 10; end < 0 {
+			UDPLog.Warn("packet too short for one time auth", "client", src)
+			return
 		}
-	}()
-	return
+	}
+	key := src.String()
+	target, err := c.parseTarget(key, receive[:end])
+	if err != nil {
+		if target.host != "" {
+			UDPLog.Debug("cannot resolve target", "host", target.host, "client", src, "err", err)
+		} else {
+			UDPLog.Warn("bad target", "client", src, "err", err)
+		}
+		return
+	}
+	UDPLog.Debug("new packet", "type", addrType&AddrMask, "dst", target.dst, "user", c.UserID)
+	if c.DestinationFilter != nil && !c.DestinationFilter(target.host, target.dst) {
+		UDPLog.Debug("destination rejected", "host", target.host, "dst", target.dst, "user", c.UserID)
+		return
+	}
+	if auth {
+		authData := receive[end:n]
+		key := c.GetKey()
+		actualHmacSha1Buf := HmacSha1(append(iv, key...), receive[:end])
+		if !bytes.Equal(authData, actualHmacSha1Buf) {
+			UDPLog.Warn("verify one time auth failed", "client", src)
+			return
+		}
+	}
+	client := &udpClient{conn: c, addr: src, auth: auth}
+	if _, err = c.relay(key, src, target, receive[len(target.header):end], client); err != nil {
+		UDPLog.Debug("cannot open nat entry", "client", src, "err", err)
+	}
 }
@@ -0,0 +1,373 @@
+package shadowsocks
+
+// UDP over TCP. Networks dropping or throttling UDP can still carry it in a
+// normal connection: the client asks for the reserved target UoTHost, then
+// both sides exchange datagrams as frames of a 2 byte length followed by an
+// address header and the payload. From the client the address is the
+// target, from the server the source of the reply. One time auth is not
+// supported.
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// UoTHost is the target a client asks for to start UDP over TCP.
+	UoTHost = "sp.udp-over-tcp.arpa"
+
+	maxUoTFrame = 0xffff
+	// how long auto mode sticks to UDP over TCP before trying UDP again
+	uotRetryUDP = 5 * time.Minute
+)
+
+var errDatagramTooLarge = errors.New("datagram too large")
+
+// UoTRawAddr returns the request starting UDP over TCP, see
+// DialWithRawAddr.
+func UoTRawAddr() []byte {
+	rawaddr, _ := RawAddr(net.JoinHostPort(UoTHost, "0"))
+	return rawaddr
+}
+
+// WriteUoTFrame writes header and payload as one frame.
+func WriteUoTFrame(w io.Writer, header, payload []byte) error {
+	n := len(header) + len(payload)
+	if n > maxUoTFrame {
+		return errDatagramTooLarge
+	}
+	frame := make([]byte, 2+n)
+	binary.BigEndian.PutUint16(frame, uint16(n))
+	copy(frame[2:], header)
+	copy(frame[2+len(header):], payload)
+	_, err := w.Write(frame)
+	return err
+}
+
+// ReadUoTFrame reads a frame into buf, which should hold 65535 bytes, and
+// returns its size.
+func ReadUoTFrame(r io.Reader, buf []byte) (int, error) {
+	var size [2]byte
+	if _, err := io.ReadFull(r, size[:]); err != nil {
+		return 0, err
+	}
+	n := int(binary.BigEndian.Uint16(size[:]))
+	if n > len(buf) {
+		return 0, errDatagramTooLarge
+	}
+	if _, err := io.ReadFull(r, buf[:n]); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return 0, err
+	}
+	return n, nil
+}
+
+// addrHeaderLen returns the length of the address header at the start of b.
+func addrHeaderLen(b []byte) (int, error) {
+	if len(b) < 1 {
+		return 0, errors.New("empty packet")
+	}
+	var n int
+	switch b[idType] & AddrMask {
+	case typeIPv4:
+		n = lenIPv4
+	case typeIPv6:
+		n = lenIPv6
+	case typeDm:
+		if len(b) <= idDmLen {
+			return 0, errors.New("packet too short")
+		}
+		n = int(b[idDmLen]) + lenDmBase
+	default:
+		return 0, fmt.Errorf("addr type %d not supported", b[idType])
+	}
+	if len(b) < n {
+		return 0, errors.New("packet too short")
+	}
+	return n, nil
+}
+
+// streamClient is a client sending its packets over UDP over TCP. Replies
+// keep the stream from going idle, as packets of the client do.
+type streamClient struct {
+	lock        sync.Mutex
+	conn        net.Conn
+	idleTimeout time.Duration
+}
+
+func (w *streamClient) WritePacket(b []byte) error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if err := WriteUoTFrame(w.conn, b, nil); err != nil {
+		return err
+	}
+	return w.conn.SetReadDeadline(time.Now().Add(w.idleTimeout))
+}
+
+// ServeUDPOverTCP relays the datagrams framed on conn, after the UoTHost
+// request, until conn is closed or idle, no datagram either way, for the
+// idle timeout of the NAT table. c holds the settings of the relay: user,
+// NAT table, resolver and destination filter. Its own socket is not used,
+// traffic and limits are up to conn. Datagrams to a domain that has to be
+// looked up wait for it on their own, the stream goes on meanwhile.
+func (c *UDPConn) ServeUDPOverTCP(conn net.Conn) error {
+	table := c.natTable()
+	// Another kind of key than client addresses, so the mapping of the
+	// stream is its own.
+	key := "tcp/" + conn.RemoteAddr().String()
+	client := &streamClient{conn: conn, idleTimeout: table.idleTimeout}
+	reader := bufio.NewReader(conn)
+	buf := make([]byte, maxUoTFrame)
+	// The mappings used by the stream, there is more than one if one got
+	// evicted. Their relay loops write to conn, so they have to be over
+	// before the caller closes it. lock is held while relaying, nothing is
+	// relayed once the stream is closed.
+	var lock sync.Mutex
+	remotes := make(map[*CachedUDPConn]struct{})
+	closed := false
+	defer func() {
+		lock.Lock()
+		closed = true
+		lock.Unlock()
+		for remote := range remotes {
+			table.remove(remote, nil)
+		}
+		// Replies blocked on the bandwidth of conn give up.
+		conn.SetWriteDeadline(time.Now())
+		for remote := range remotes {
+			<-remote.done
+		}
+	}()
+	// send relays a datagram, it returns the error ending the stream.
+	send := func(packet []byte) error {
+		target, err := c.parseTarget(key, packet)
+		if err != nil {
+			if target.host != "" {
+				UDPLog.Debug("cannot resolve target", "host", target.host, "client", conn.RemoteAddr(), "err", err)
+			} else {
+				UDPLog.Warn("bad target", "client", conn.RemoteAddr(), "err", err)
+			}
+			return nil
+		}
+		UDPLog.Debug("new packet over tcp", "dst", target.dst, "user", c.UserID)
+		if c.DestinationFilter != nil && !c.DestinationFilter(target.host, target.dst) {
+			UDPLog.Debug("destination rejected", "host", target.host, "dst", target.dst, "user", c.UserID)
+			return nil
+		}
+		lock.Lock()
+		defer lock.Unlock()
+		if closed {
+			return nil
+		}
+		remote, err := c.relay(key, conn.RemoteAddr(), target, packet[len(target.header):], client)
+		if err != nil {
+			return err
+		}
+		if _, have := remotes[remote]; !have {
+			// Forget the mappings already gone, a stream may outlive many.
+			for old := range remotes {
+				select {
+				case <-old.done:
+					delete(remotes, old)
+				default:
+				}
+			}
+			remotes[remote] = struct{}{}
+		}
+		return nil
+	}
+	for {
+		conn.SetReadDeadline(time.Now().Add(table.idleTimeout))
+		n, err := ReadUoTFrame(reader, buf)
+		if err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		if UDPTooLarge(n) {
+			UDPLog.Debug("oversized packet dropped", "size", n, "client", conn.RemoteAddr())
+			continue
+		}
+		if c.needsLookup(key, buf[:n]) {
+			packet := append([]byte(nil), buf[:n]...)
+			go func() {
+				if err := send(packet); err != nil {
+					UDPLog.Debug("cannot open nat entry", "client", conn.RemoteAddr(), "err", err)
+				}
+			}()
+			continue
+		}
+		if err = send(buf[:n]); err != nil {
+			return err
+		}
+	}
+}
+
+// UoTMode tells when a client carries UDP over TCP.
+type UoTMode int
+
+const (
+	// UoTAuto uses UDP until a packet gets no reply, then UDP over TCP for
+	// a while.
+	UoTAuto UoTMode = iota
+	UoTNever
+	UoTAlways
+)
+
+// ParseUoTMode parses auto, never or always, empty means auto.
+func ParseUoTMode(s string) (UoTMode, error) {
+	switch s {
+	case "", "auto":
+		return UoTAuto, nil
+	case "never":
+		return UoTNever, nil
+	case "always":
+		return UoTAlways, nil
+	}
+	return 0, fmt.Errorf("unknown udp over tcp mode %s", s)
+}
+
+// UoTSwitch picks between UDP and UDP over TCP for a client.
+type UoTSwitch struct {
+	Mode  UoTMode
+	lock  sync.Mutex
+	until time.Time // auto mode uses UDP over TCP until then
+}
+
+// UseTCP tells whether to send the next packet over TCP.
+func (s *UoTSwitch) UseTCP() bool {
+	switch s.Mode {
+	case UoTAlways:
+		return true
+	case UoTNever:
+		return false
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return time.Now().Before(s.until)
+}
+
+// UDPFailed reports a packet sent over UDP that got no reply. It returns
+// true if the packet should be sent again over TCP.
+func (s *UoTSwitch) UDPFailed() bool {
+	if s.Mode != UoTAuto {
+		return false
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.until = time.Now().Add(uotRetryUDP)
+	return true
+}
+
+// UoTClient relays the datagrams of local clients over UDP over TCP, with a
+// stream per client address. Replies are written back to the client without
+// the address header.
+type UoTClient struct {
+	dial     func() (*Conn, error)
+	timeout  time.Duration
+	lock     sync.Mutex
+	sessions map[string]*uotSession
+}
+
+type uotSession struct {
+	lock   sync.Mutex // serializes the writes
+	stream *Conn
+}
+
+// NewUoTClient returns a client opening streams with dial, which should send
+// UoTRawAddr as the request. Streams idle for timeout are closed.
+func NewUoTClient(dial func() (*Conn, error), timeout time.Duration) *UoTClient {
+	if timeout <= 0 {
+		timeout = 60 * time.Second
+	}
+	return &UoTClient{
+		dial:     dial,
+		timeout:  timeout,
+		sessions: make(map[string]*uotSession),
+	}
+}
+
+// Send sends header and payload for the local client src, conn is the
+// socket src sent them to.
+func (u *UoTClient) Send(conn *net.UDPConn, src *net.UDPAddr, header, payload []byte) error {
+	key := src.String()
+	s, err := u.session(conn, src, key)
+	if err != nil {
+		return err
+	}
+	s.lock.Lock()
+	s.stream.SetReadDeadline(time.Now().Add(u.timeout))
+	err = WriteUoTFrame(s.stream, header, payload)
+	s.lock.Unlock()
+	if err != nil {
+		// The read loop owns the stream, it closes it once Abort wakes it
+		// up.
+		u.remove(key, s)
+		s.stream.Abort()
+	}
+	return err
+}
+
+func (u *UoTClient) session(conn *net.UDPConn, src *net.UDPAddr, key string) (*uotSession, error) {
+	u.lock.Lock()
+	s, have := u.sessions[key]
+	u.lock.Unlock()
+	if have {
+		return s, nil
+	}
+	stream, err := u.dial()
+	if err != nil {
+		return nil, err
+	}
+	u.lock.Lock()
+	if other, have := u.sessions[key]; have {
+		// Another packet of the client got here first.
+		u.lock.Unlock()
+		stream.Close()
+		return other, nil
+	}
+	s = &uotSession{stream: stream}
+	u.sessions[key] = s
+	u.lock.Unlock()
+	go u.readLoop(conn, src, key, s)
+	return s, nil
+}
+
+func (u *UoTClient) remove(key string, s *uotSession) {
+	u.lock.Lock()
+	if u.sessions[key] == s {
+		delete(u.sessions, key)
+	}
+	u.lock.Unlock()
+}
+
+func (u *UoTClient) readLoop(conn *net.UDPConn, src *net.UDPAddr, key string, s *uotSession) {
+	defer s.stream.Close()
+	defer u.remove(key, s)
+	reader := bufio.NewReader(s.stream)
+	buf := make([]byte, maxUoTFrame)
+	for {
+		n, err := ReadUoTFrame(reader, buf)
+		if err != nil {
+			if err != io.EOF {
+				Debug.Printf("udp over tcp stream of %s closed: %v\n", src, err)
+			}
+			return
+		}
+		hlen, err := addrHeaderLen(buf[:n])
+		if err != nil {
+			continue
+		}
+		s.stream.SetReadDeadline(time.Now().Add(u.timeout))
+		conn.WriteToUDP(buf[hlen:n], src)
+	}
+}
@@ -0,0 +1,276 @@
+package shadowsocks
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestUoTFrame(t *testing.T) {
+	var b bytes.Buffer
+	header := []byte{typeIPv4, 127, 0, 0, 1, 0, 53}
+	if err := WriteUoTFrame(&b, header, []byte("query")); err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteUoTFrame(&b, nil, make([]byte, maxUoTFrame+1)); err == nil {
+		t.Error("oversized datagram should fail")
+	}
+	buf := make([]byte, maxUoTFrame)
+	n, err := ReadUoTFrame(&b, buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := append(header, "query"...); !bytes.Equal(buf[:n], want) {
+		t.Errorf("got %v, want %v", buf[:n], want)
+	}
+	b.Write([]byte{0, 10, 1})
+	if _, err := ReadUoTFrame(&b, buf); err == nil {
+		t.Error("truncated frame should fail")
+	}
+}
+
+func TestServeUDPOverTCP(t *testing.T) {
+	echo, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		buf := make([]byte, 64)
+		for {
+			n, addr, err := echo.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			echo.WriteToUDP(buf[:n], addr)
+		}
+	}()
+
+	table := NewNATTable(NATAddressRestricted, time.Minute, 0)
+	defer table.Close()
+	client, server := net.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		c := &UDPConn{NAT: table}
+		done <- c.ServeUDPOverTCP(server)
+	}()
+
+	header, _ := ParseHeader(echo.LocalAddr())
+	if err := WriteUoTFrame(client, header, []byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, maxUoTFrame)
+	n, err := ReadUoTFrame(bufio.NewReader(client), buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := append(header, "ping"...); !bytes.Equal(buf[:n], want) {
+		t.Errorf("got %v, want %v", buf[:n], want)
+	}
+	client.Close()
+	if err := <-done; err != nil {
+		t.Errorf("closed stream should end without error, got %v", err)
+	}
+	if n := table.Len(); n != 0 {
+		t.Errorf("mapping of the stream should be gone, %d left", n)
+	}
+}
+
+func TestUoTRepliesKeepStream(t *testing.T) {
+	// The target keeps replying to a single packet for longer than the idle
+	// timeout.
+	target, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.Close()
+	go func() {
+		buf := make([]byte, 64)
+		n, addr, err := target.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		for i := 0; i < 8; i++ {
+			target.WriteToUDP(buf[:n], addr)
+			time.Sleep(50 * time.Millisecond)
+		}
+	}()
+
+	table := NewNATTable(NATAddressRestricted, 200*time.Millisecond, 0)
+	defer table.Close()
+	client, server := net.Pipe()
+	defer client.Close()
+	done := make(chan error, 1)
+	go func() {
+		c := &UDPConn{NAT: table}
+		done <- c.ServeUDPOverTCP(server)
+	}()
+	header, _ := ParseHeader(target.LocalAddr())
+	if err := WriteUoTFrame(client, header, []byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	reader := bufio.NewReader(client)
+	buf := make([]byte, maxUoTFrame)
+	for i := 0; i < 8; i++ {
+		client.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if _, err := ReadUoTFrame(reader, buf); err != nil {
+			t.Fatalf("reply %d: %v", i, err)
+		}
+	}
+	select {
+	case err := <-done:
+		t.Fatalf("stream with replies should not be idle, ended with %v", err)
+	default:
+	}
+	select {
+	case err := <-done:
+		if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+			t.Errorf("idle stream should time out, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("idle stream should end")
+	}
+}
+
+func TestUoTLookupOffReadLoop(t *testing.T) {
+	echo, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		buf := make([]byte, 64)
+		for {
+			n, addr, err := echo.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			echo.WriteToUDP(buf[:n], addr)
+		}
+	}()
+	// Nothing answers on this socket, lookups take the DNS timeout.
+	dns, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dns.Close()
+	r, err := NewResolver(&Config{DNSServers: []string{dns.LocalAddr().String()}, DNSTimeout: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	table := NewNATTable(NATAddressRestricted, time.Minute, 0)
+	defer table.Close()
+	client, server := net.Pipe()
+	defer client.Close()
+	go func() {
+		c := &UDPConn{NAT: table, Resolver: r}
+		c.ServeUDPOverTCP(server)
+	}()
+	// The stream is unbuffered, writing blocks until the server reads.
+	client.SetDeadline(time.Now().Add(time.Second))
+	slow, _ := RawAddr("slow.example:53")
+	if err := WriteUoTFrame(client, slow, []byte("query")); err != nil {
+		t.Fatal(err)
+	}
+	header, _ := ParseHeader(echo.LocalAddr())
+	if err := WriteUoTFrame(client, header, []byte("ping")); err != nil {
+		t.Fatalf("datagram after a slow lookup should be read: %v", err)
+	}
+	buf := make([]byte, maxUoTFrame)
+	n, err := ReadUoTFrame(bufio.NewReader(client), buf)
+	if err != nil {
+		t.Fatalf("datagram after a slow lookup should go on: %v", err)
+	}
+	if want := append(header, "ping"...); !bytes.Equal(buf[:n], want) {
+		t.Errorf("got %v, want %v", buf[:n], want)
+	}
+}
+
+// failWriteConn fails all writes, reads block until it is closed. It counts
+// the calls to Close.
+type failWriteConn struct {
+	net.Conn
+	closes int32
+}
+
+func (c *failWriteConn) Write(b []byte) (int, error) {
+	return 0, errors.New("write failed")
+}
+
+func (c *failWriteConn) Close() error {
+	atomic.AddInt32(&c.closes, 1)
+	return c.Conn.Close()
+}
+
+func TestUoTClientWriteFails(t *testing.T) {
+	saved := leakyBuf
+	leakyBuf = NewLeakyBuf(maxNBuf, leakyBufSize)
+	defer func() { leakyBuf = saved }()
+	local, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer local.Close()
+	cipher, err := NewCipher("aes-128-cfb", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, server := net.Pipe()
+	defer server.Close()
+	stream := &failWriteConn{Conn: client}
+	u := NewUoTClient(func() (*Conn, error) { return NewConn(stream, cipher), nil }, time.Minute)
+
+	src := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1}
+	header := []byte{typeIPv4, 127, 0, 0, 1, 0, 53}
+	if err := u.Send(local, src, header, []byte("query")); err == nil {
+		t.Fatal("write should fail")
+	}
+	// Abort wakes up the read loop, which closes the stream.
+	deadline := time.Now().Add(5 * time.Second)
+	for atomic.LoadInt32(&stream.closes) < 2 {
+		if time.Now().After(deadline) {
+			t.Fatal("read loop should end")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if n := atomic.LoadInt32(&stream.closes); n != 2 {
+		t.Errorf("stream closed %d times, want an abort and a close", n)
+	}
+	if n := len(leakyBuf.freeList); n != 2 {
+		t.Errorf("%d buffers returned, want the 2 of the stream once", n)
+	}
+	u.lock.Lock()
+	n := len(u.sessions)
+	u.lock.Unlock()
+	if n != 0 {
+		t.Errorf("failed session should be removed, %d left", n)
+	}
+}
+
+func TestUoTSwitch(t *testing.T) {
+	if _, err := ParseUoTMode("sometimes"); err == nil {
+		t.Error("unknown mode should fail")
+	}
+	s := &UoTSwitch{Mode: UoTNever}
+	if s.UDPFailed() || s.UseTCP() {
+		t.Error("never mode should stay on UDP")
+	}
+	s = &UoTSwitch{Mode: UoTAlways}
+	if !s.UseTCP() {
+		t.Error("always mode should use TCP")
+	}
+	s = &UoTSwitch{}
+	if s.UseTCP() {
+		t.Error("auto mode should start with UDP")
+	}
+	if !s.UDPFailed() || !s.UseTCP() {
+		t.Error("auto mode should switch to TCP after a UDP failure")
+	}
+}
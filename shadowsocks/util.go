@@ -6,6 +6,7 @@ import (
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"net"
 	"os"
 )
 
@@ -74,3 +75,43 @@ func Port2Byte(port int) []byte {
 	binary.BigEndian.PutUint16(ret, uint16(port))
 	return ret
 }
+
+var privateNetworks = parseCIDRs(
+	"0.0.0.0/8",          // this network, 0.0.0.0 reaches the local host
+	"10.0.0.0/8",         // RFC1918
+	"100.64.0.0/10",      // carrier-grade NAT
+	"127.0.0.0/8",        // loopback
+	"169.254.0.0/16",     // link-local, cloud metadata services live here
+	"172.16.0.0/12",      // RFC1918
+	"192.168.0.0/16",     // RFC1918
+	"224.0.0.0/4",        // multicast
+	"255.255.255.255/32", // broadcast
+	"::/128",             // unspecified
+	"::1/128",            // loopback
+	"fc00::/7",           // unique local
+	"fe80::/10",          // link-local
+	"ff00::/8",           // multicast
+)
+
+func parseCIDRs(cidrs ...string) []*net.IPNet {
+	nets := make([]*net.IPNet, len(cidrs))
+	for i, cidr := range cidrs {
+		_, ipnet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		nets[i] = ipnet
+	}
+	return nets
+}
+
+// IsPrivateIP reports whether ip is in a private, loopback, link-local or
+// multicast network. IPv4-mapped IPv6 addresses are checked as IPv4.
+func IsPrivateIP(ip net.IP) bool {
+	for _, ipnet := range privateNetworks {
+		if ipnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,23 @@
+package shadowsocks
+
+import (
+	"net"
+	"testing"
+)
+
+func TestIsPrivateIP(t *testing.T) {
+	private := []string{"127.0.0.1", "10.1.2.3", "172.31.0.1", "192.168.1.1",
+		"169.254.169.254", "0.0.0.0", "224.0.0.1", "::1", "::", "fd00::1",
+		"fe80::1", "ff02::1", "::ffff:127.0.0.1"}
+	for _, s := range private {
+		if !IsPrivateIP(net.ParseIP(s)) {
+			t.Errorf("%s should be private", s)
+		}
+	}
+	public := []string{"8.8.8.8", "172.32.0.1", "2001:4860:4860::8888", "::ffff:8.8.8.8"}
+	for _, s := range public {
+		if IsPrivateIP(net.ParseIP(s)) {
+			t.Errorf("%s should not be private", s)
+		}
+	}
+}